@@ -0,0 +1,546 @@
+// capability.go - signed spool read and write capabilities
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/memspool/client"
+	"github.com/ugorji/go/codec"
+)
+
+// CapabilityScope is the access to a spool granted by a capability.
+type CapabilityScope uint8
+
+const (
+	// ReadScope is the scope of a ReadCapability.
+	ReadScope CapabilityScope = iota + 1
+
+	// WriteScope is the scope of a WriteCapability.
+	WriteScope
+)
+
+const (
+	capabilitySignatureLabel = "katzenpost channels capability"
+	capabilityWriteLabel     = "katzenpost channels capability write"
+
+	capabilityHolderIDLength = 16
+	capabilityWriteKeyLength = 32
+	capabilityMACLength      = 16
+
+	// WriteCapabilityOverhead is the length of the holder ID and MAC
+	// prepended to the messages written with a WriteCapability.
+	WriteCapabilityOverhead = capabilityHolderIDLength + capabilityMACLength
+)
+
+// CapabilityMetadata is the signed metadata of a capability.
+type CapabilityMetadata struct {
+	Issuer     *eddsa.PublicKey
+	Holder     string
+	Scope      CapabilityScope
+	Expiration time.Time
+}
+
+// capabilitySignatureMessage returns the message signed by the issuer
+// of a capability, binding the metadata to the spool. The encoding is
+// explicit so that the signature does not depend on the CBOR encoding.
+func capabilitySignatureMessage(metadata *CapabilityMetadata, spool *UnreliableSpoolWriterChannel) []byte {
+	message := []byte(capabilitySignatureLabel)
+	message = append(message, metadata.Issuer.Bytes()...)
+	var rawHolderLength [4]byte
+	binary.BigEndian.PutUint32(rawHolderLength[:], uint32(len(metadata.Holder)))
+	message = append(message, rawHolderLength[:]...)
+	message = append(message, metadata.Holder...)
+	message = append(message, byte(metadata.Scope))
+	var rawExpiration [8]byte
+	binary.BigEndian.PutUint64(rawExpiration[:], uint64(metadata.Expiration.Unix()))
+	message = append(message, rawExpiration[:]...)
+	return append(message, spoolBinding(capabilitySignatureLabel, spool)...)
+}
+
+// verifyCapability verifies the metadata and signature of a capability.
+func verifyCapability(metadata *CapabilityMetadata, scope CapabilityScope, spool *UnreliableSpoolWriterChannel, signature []byte, issuer *eddsa.PublicKey) error {
+	if metadata.Issuer == nil || !metadata.Issuer.Equal(issuer) {
+		return errors.New("capability was issued by another key")
+	}
+	if metadata.Scope != scope {
+		return errors.New("capability has the wrong scope")
+	}
+	if time.Now().After(metadata.Expiration) {
+		return errors.New("capability expired")
+	}
+	if !issuer.Verify(signature, capabilitySignatureMessage(metadata, spool)) {
+		return errors.New("invalid capability signature")
+	}
+	return nil
+}
+
+// capabilityMAC returns the MAC authenticating a message written
+// to the given spool by the holder of the given write key.
+func capabilityMAC(writeKey []byte, spool *UnreliableSpoolWriterChannel, message []byte) []byte {
+	mac := hmac.New(sha256.New, writeKey)
+	mac.Write(spoolBinding(capabilityWriteLabel, spool))
+	mac.Write(message)
+	return mac.Sum(nil)[:capabilityMACLength]
+}
+
+// ReadCapability grants it's holder the reading of the messages
+// the issuer accepted, which it relays to a spool of the holder's own.
+type ReadCapability struct {
+	Metadata  *CapabilityMetadata
+	Spool     *UnreliableSpoolReaderChannel
+	Signature []byte
+}
+
+// serializedReadCapability has no methods so that encoding
+// it does not recurse into MarshalBinary.
+type serializedReadCapability ReadCapability
+
+// MarshalBinary serializes this capability.
+func (c *ReadCapability) MarshalBinary() ([]byte, error) {
+	var serialized []byte
+	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode((*serializedReadCapability)(c))
+	if err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+// UnmarshalBinary deserializes this capability.
+func (c *ReadCapability) UnmarshalBinary(data []byte) error {
+	err := codec.NewDecoderBytes(data, cborHandle).Decode((*serializedReadCapability)(c))
+	if err != nil {
+		return err
+	}
+	if c.Metadata == nil || c.Spool == nil {
+		return errors.New("incomplete read capability")
+	}
+	return nil
+}
+
+// Verify returns an error unless this capability was signed by
+// the given issuer, grants reading and has not expired.
+func (c *ReadCapability) Verify(issuer *eddsa.PublicKey) error {
+	if c.Metadata == nil || c.Spool == nil {
+		return errors.New("incomplete read capability")
+	}
+	return verifyCapability(c.Metadata, ReadScope, c.Spool.GetSpoolWriter(), c.Signature, issuer)
+}
+
+// Read reads and returns a message from the spool.
+func (c *ReadCapability) Read(spoolService client.SpoolService) ([]byte, error) {
+	if time.Now().After(c.Metadata.Expiration) {
+		return nil, errors.New("capability expired")
+	}
+	return c.Spool.Read(spoolService)
+}
+
+// WriteCapability grants it's holder the writing to a spool. The
+// written messages are authenticated with the holder's write key
+// so that the issuer only accepts those of current holders.
+type WriteCapability struct {
+	Metadata  *CapabilityMetadata
+	Spool     *UnreliableSpoolWriterChannel
+	HolderID  []byte
+	WriteKey  []byte
+	Signature []byte
+}
+
+// serializedWriteCapability has no methods so that encoding
+// it does not recurse into MarshalBinary.
+type serializedWriteCapability WriteCapability
+
+// MarshalBinary serializes this capability.
+func (c *WriteCapability) MarshalBinary() ([]byte, error) {
+	var serialized []byte
+	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode((*serializedWriteCapability)(c))
+	if err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+// UnmarshalBinary deserializes this capability.
+func (c *WriteCapability) UnmarshalBinary(data []byte) error {
+	err := codec.NewDecoderBytes(data, cborHandle).Decode((*serializedWriteCapability)(c))
+	if err != nil {
+		return err
+	}
+	if c.Metadata == nil || c.Spool == nil || len(c.HolderID) != capabilityHolderIDLength || len(c.WriteKey) != capabilityWriteKeyLength {
+		return errors.New("incomplete write capability")
+	}
+	return nil
+}
+
+// Verify returns an error unless this capability was signed by
+// the given issuer, grants writing and has not expired.
+func (c *WriteCapability) Verify(issuer *eddsa.PublicKey) error {
+	if c.Metadata == nil || c.Spool == nil {
+		return errors.New("incomplete write capability")
+	}
+	return verifyCapability(c.Metadata, WriteScope, c.Spool, c.Signature, issuer)
+}
+
+// PayloadLength returns the maximum length of the messages written
+// with this capability.
+func (c *WriteCapability) PayloadLength() int {
+	return c.Spool.PayloadLength() - WriteCapabilityOverhead
+}
+
+// Write writes the given message to the spool. The check of the
+// expiration here only spares a write the issuer would reject.
+func (c *WriteCapability) Write(spoolService client.SpoolService, message []byte) error {
+	if time.Now().After(c.Metadata.Expiration) {
+		return errors.New("capability expired")
+	}
+	entry := make([]byte, 0, WriteCapabilityOverhead+len(message))
+	entry = append(entry, c.HolderID...)
+	entry = append(entry, capabilityMAC(c.WriteKey, c.Spool, message)...)
+	entry = append(entry, message...)
+	return c.Spool.Write(spoolService, entry)
+}
+
+// CapabilityHolder is a holder capabilities were issued to.
+type CapabilityHolder struct {
+	Name       string
+	Scope      CapabilityScope
+	Expiration time.Time
+	ID         []byte
+
+	// WriteKey authenticates the messages of a write holder.
+	WriteKey []byte
+
+	// Spool is the spool of a read holder the accepted messages
+	// are relayed to, Pending holds those not relayed yet.
+	Spool   *UnreliableSpoolReaderChannel
+	Pending [][]byte
+}
+
+// CapabilityReissue holds the capabilities reissued by a revocation,
+// they must be delivered to their holders.
+type CapabilityReissue struct {
+	ReadCapabilities  []*ReadCapability
+	WriteCapabilities []*WriteCapability
+}
+
+// CapabilityIssuer owns a spool and issues signed capabilities to
+// read and write it. Read only accepts the messages written by write
+// holders which are neither revoked nor expired, and relays them to
+// the spools of the read holders, so that no holder can read or purge
+// the issuer's spool. Revoking a write holder migrates the issuer to
+// a new spool and reissues the write capabilities of the remaining
+// holders. The previous spool is read until it is drained and then
+// purged, the messages revoked holders wrote to it are dropped.
+type CapabilityIssuer struct {
+	spoolService client.SpoolService
+
+	SigningPrivateKey *eddsa.PrivateKey
+	SpoolReaderChan   *UnreliableSpoolReaderChannel
+	RetiredReaderChan *UnreliableSpoolReaderChannel
+	Holders           []*CapabilityHolder
+
+	// SkipGarbage makes Read skip spool entries which fail to
+	// authenticate rather than return an error.
+	SkipGarbage    bool
+	SkippedEntries uint64
+}
+
+// NewCapabilityIssuer creates a new CapabilityIssuer with a new spool.
+func NewCapabilityIssuer(spoolReceiver, spoolProvider string, spool client.SpoolService) (*CapabilityIssuer, error) {
+	spoolReader, err := NewUnreliableSpoolReaderChannel(spoolReceiver, spoolProvider, spool)
+	if err != nil {
+		return nil, err
+	}
+	signingPrivateKey, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &CapabilityIssuer{
+		spoolService:      spool,
+		SigningPrivateKey: signingPrivateKey,
+		SpoolReaderChan:   spoolReader,
+	}, nil
+}
+
+// LoadCapabilityIssuer loads a saved CapabilityIssuer and sets it's spoolService.
+func LoadCapabilityIssuer(data []byte, spoolService client.SpoolService) (*CapabilityIssuer, error) {
+	i := new(CapabilityIssuer)
+	err := codec.NewDecoderBytes(data, cborHandle).Decode(i)
+	if err != nil {
+		return nil, err
+	}
+	i.SetSpoolService(spoolService)
+	return i, nil
+}
+
+// SetSpoolService sets this issuer's spoolService.
+func (i *CapabilityIssuer) SetSpoolService(spoolService client.SpoolService) {
+	i.spoolService = spoolService
+}
+
+// Save returns the serialization of this issuer.
+func (i *CapabilityIssuer) Save() ([]byte, error) {
+	var serialized []byte
+	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode(i)
+	if err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+// PublicKey returns the key capabilities are verified with.
+func (i *CapabilityIssuer) PublicKey() *eddsa.PublicKey {
+	return i.SigningPrivateKey.PublicKey()
+}
+
+func (i *CapabilityIssuer) sign(holder *CapabilityHolder, spool *UnreliableSpoolWriterChannel) (*CapabilityMetadata, []byte) {
+	metadata := &CapabilityMetadata{
+		Issuer:     i.PublicKey(),
+		Holder:     holder.Name,
+		Scope:      holder.Scope,
+		Expiration: holder.Expiration,
+	}
+	return metadata, i.SigningPrivateKey.Sign(capabilitySignatureMessage(metadata, spool))
+}
+
+func (i *CapabilityIssuer) readCapability(holder *CapabilityHolder) *ReadCapability {
+	spool := *holder.Spool
+	metadata, signature := i.sign(holder, spool.GetSpoolWriter())
+	return &ReadCapability{
+		Metadata:  metadata,
+		Spool:     &spool,
+		Signature: signature,
+	}
+}
+
+func (i *CapabilityIssuer) writeCapability(holder *CapabilityHolder) *WriteCapability {
+	spool := i.SpoolReaderChan.GetSpoolWriter()
+	metadata, signature := i.sign(holder, spool)
+	return &WriteCapability{
+		Metadata:  metadata,
+		Spool:     spool,
+		HolderID:  holder.ID,
+		WriteKey:  holder.WriteKey,
+		Signature: signature,
+	}
+}
+
+// addHolder adds a holder which expires after the given lifetime.
+func (i *CapabilityIssuer) addHolder(name string, scope CapabilityScope, lifetime time.Duration) (*CapabilityHolder, error) {
+	for _, holder := range i.Holders {
+		if holder.Name == name {
+			return nil, errors.New("holder name already in use")
+		}
+	}
+	id, err := randomBytes(capabilityHolderIDLength)
+	if err != nil {
+		return nil, err
+	}
+	// the signature covers the expiration in seconds
+	holder := &CapabilityHolder{
+		Name:       name,
+		Scope:      scope,
+		Expiration: time.Now().Add(lifetime).UTC().Truncate(time.Second),
+		ID:         id,
+	}
+	switch scope {
+	case ReadScope:
+		holder.Spool, err = NewUnreliableSpoolReaderChannel(i.SpoolReaderChan.SpoolReceiver, i.SpoolReaderChan.SpoolProvider, i.spoolService)
+	case WriteScope:
+		holder.WriteKey, err = randomBytes(capabilityWriteKeyLength)
+	}
+	if err != nil {
+		return nil, err
+	}
+	i.Holders = append(i.Holders, holder)
+	return holder, nil
+}
+
+// IssueReadCapability issues a capability to read the spool
+// to the named holder, which expires after the given lifetime.
+func (i *CapabilityIssuer) IssueReadCapability(name string, lifetime time.Duration) (*ReadCapability, error) {
+	holder, err := i.addHolder(name, ReadScope, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	return i.readCapability(holder), nil
+}
+
+// IssueWriteCapability issues a capability to write the spool
+// to the named holder, which expires after the given lifetime.
+func (i *CapabilityIssuer) IssueWriteCapability(name string, lifetime time.Duration) (*WriteCapability, error) {
+	holder, err := i.addHolder(name, WriteScope, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	return i.writeCapability(holder), nil
+}
+
+// Revoke revokes the capability of the named holder, the expired
+// holders are dropped as well. The spools of the dropped read holders
+// are purged. Revoking a write holder moves the issuer to a new spool
+// and the capabilities of the remaining write holders are reissued
+// for it.
+func (i *CapabilityIssuer) Revoke(name string) (*CapabilityReissue, error) {
+	var revoked *CapabilityHolder
+	holders := make([]*CapabilityHolder, 0, len(i.Holders))
+	dropped := []*CapabilityHolder{}
+	now := time.Now()
+	for _, holder := range i.Holders {
+		switch {
+		case holder.Name == name:
+			revoked = holder
+		case now.After(holder.Expiration):
+			dropped = append(dropped, holder)
+		default:
+			holders = append(holders, holder)
+		}
+	}
+	if revoked == nil {
+		return nil, errors.New("no such holder")
+	}
+	if revoked.Scope == WriteScope && i.RetiredReaderChan != nil {
+		return nil, errors.New("the retired spool must be drained first")
+	}
+	for _, holder := range append(dropped, revoked) {
+		if holder.Scope != ReadScope {
+			continue
+		}
+		spool := holder.Spool
+		err := i.spoolService.PurgeSpool(spool.SpoolID, spool.SpoolPrivateKey, spool.SpoolReceiver, spool.SpoolProvider)
+		if err != nil {
+			return nil, err
+		}
+	}
+	reissue := new(CapabilityReissue)
+	if revoked.Scope == WriteScope {
+		spoolReader, err := NewUnreliableSpoolReaderChannel(i.SpoolReaderChan.SpoolReceiver, i.SpoolReaderChan.SpoolProvider, i.spoolService)
+		if err != nil {
+			return nil, err
+		}
+		if err := spoolReader.RequireStamps(i.SpoolReaderChan.StampDifficulty); err != nil {
+			return nil, err
+		}
+		i.RetiredReaderChan = i.SpoolReaderChan
+		i.SpoolReaderChan = spoolReader
+		for _, holder := range holders {
+			if holder.Scope == WriteScope {
+				reissue.WriteCapabilities = append(reissue.WriteCapabilities, i.writeCapability(holder))
+			}
+		}
+	}
+	i.Holders = holders
+	return reissue, nil
+}
+
+func (i *CapabilityIssuer) holder(id []byte) *CapabilityHolder {
+	for _, holder := range i.Holders {
+		if bytes.Equal(holder.ID, id) {
+			return holder
+		}
+	}
+	return nil
+}
+
+// openEntry returns the message of an entry read from the given spool
+// if a current write holder wrote it.
+func (i *CapabilityIssuer) openEntry(spool *UnreliableSpoolWriterChannel, entry []byte) ([]byte, error) {
+	if len(entry) < WriteCapabilityOverhead {
+		return nil, errors.New("truncated capability entry")
+	}
+	holder := i.holder(entry[:capabilityHolderIDLength])
+	if holder == nil || holder.Scope != WriteScope {
+		return nil, errors.New("entry of an unknown write holder")
+	}
+	if time.Now().After(holder.Expiration) {
+		return nil, errors.New("capability expired")
+	}
+	message := entry[WriteCapabilityOverhead:]
+	if !hmac.Equal(capabilityMAC(holder.WriteKey, spool, message), entry[capabilityHolderIDLength:WriteCapabilityOverhead]) {
+		return nil, errors.New("invalid capability MAC")
+	}
+	return message, nil
+}
+
+// relay writes the pending messages to the spools of the read
+// holders which have not expired, a failed write is retried by
+// the following reads.
+func (i *CapabilityIssuer) relay(message []byte) {
+	now := time.Now()
+	for _, holder := range i.Holders {
+		if holder.Scope != ReadScope || now.After(holder.Expiration) {
+			continue
+		}
+		if message != nil {
+			holder.Pending = append(holder.Pending, message)
+		}
+		for len(holder.Pending) > 0 {
+			if err := holder.Spool.GetSpoolWriter().Write(i.spoolService, holder.Pending[0]); err != nil {
+				break
+			}
+			holder.Pending = holder.Pending[1:]
+		}
+	}
+}
+
+// Read reads and returns a message, from the retired spool until it
+// is drained and from the spool afterwards, and relays it to the
+// read holders. ErrNoMessage is returned at the end of the spool.
+func (i *CapabilityIssuer) Read() ([]byte, error) {
+	message, err := skipGarbage(i.SkipGarbage, &i.SkippedEntries, i.readMessage)
+	if err == ErrNoMessage {
+		i.relay(nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	i.relay(message)
+	return message, nil
+}
+
+func (i *CapabilityIssuer) readMessage() ([]byte, error) {
+	for {
+		spool := i.SpoolReaderChan
+		if i.RetiredReaderChan != nil {
+			spool = i.RetiredReaderChan
+		}
+		entry, err := spool.Read(i.spoolService)
+		if err == ErrNoMessage && spool == i.RetiredReaderChan {
+			err = i.spoolService.PurgeSpool(spool.SpoolID, spool.SpoolPrivateKey, spool.SpoolReceiver, spool.SpoolProvider)
+			if err != nil {
+				return nil, err
+			}
+			i.RetiredReaderChan = nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		message, err := i.openEntry(spool.GetSpoolWriter(), entry)
+		if err != nil {
+			return nil, &garbageError{err}
+		}
+		return message, nil
+	}
+}
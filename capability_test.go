@@ -0,0 +1,174 @@
+// capability_test.go - signed spool capability tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapabilityIssuer(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	issuer, err := NewCapabilityIssuer("receiver", "provider", spool)
+	assert.NoError(err)
+
+	writeA, err := issuer.IssueWriteCapability("alice", time.Hour)
+	assert.NoError(err)
+	serialized, err := writeA.MarshalBinary()
+	assert.NoError(err)
+	writeA = new(WriteCapability)
+	assert.NoError(writeA.UnmarshalBinary(serialized))
+	assert.NoError(writeA.Verify(issuer.PublicKey()))
+	writeB, err := issuer.IssueWriteCapability("bob", time.Hour)
+	assert.NoError(err)
+	_, err = issuer.IssueWriteCapability("bob", time.Hour)
+	assert.Error(err)
+	readC, err := issuer.IssueReadCapability("carol", time.Hour)
+	assert.NoError(err)
+	serialized, err = readC.MarshalBinary()
+	assert.NoError(err)
+	readC = new(ReadCapability)
+	assert.NoError(readC.UnmarshalBinary(serialized))
+	assert.NoError(readC.Verify(issuer.PublicKey()))
+
+	// the metadata and issuer are authenticated
+	otherKey, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	assert.Error(writeA.Verify(otherKey.PublicKey()))
+	forged := *writeB
+	forgedMetadata := *writeB.Metadata
+	forgedMetadata.Holder = "mallory"
+	forged.Metadata = &forgedMetadata
+	assert.Error(forged.Verify(issuer.PublicKey()))
+
+	// read holders are relayed the accepted messages to a spool of their own
+	assert.NotEqual(readC.Spool.SpoolID, writeA.Spool.SpoolID)
+	msg1 := []byte("written before the revocation")
+	assert.NoError(writeA.Write(spool, msg1))
+
+	serialized, err = issuer.Save()
+	assert.NoError(err)
+	issuer, err = LoadCapabilityIssuer(serialized, spool)
+	assert.NoError(err)
+
+	// revoking bob moves the spool and reissues the write capabilities
+	reissue, err := issuer.Revoke("bob")
+	assert.NoError(err)
+	_, err = issuer.Revoke("bob")
+	assert.Error(err)
+	assert.Equal(1, len(reissue.WriteCapabilities))
+	assert.Empty(reissue.ReadCapabilities)
+	writeA = reissue.WriteCapabilities[0]
+	assert.Equal("alice", writeA.Metadata.Holder)
+	assert.NoError(writeA.Verify(issuer.PublicKey()))
+	assert.NotEqual(writeB.Spool.SpoolID, writeA.Spool.SpoolID)
+
+	msg2 := []byte("written after the revocation")
+	assert.NoError(writeA.Write(spool, msg2))
+
+	// the retired spool is drained first
+	msg, err := issuer.Read()
+	assert.NoError(err)
+	assert.Equal(msg1, msg)
+	msg, err = issuer.Read()
+	assert.NoError(err)
+	assert.Equal(msg2, msg)
+	assert.Nil(issuer.RetiredReaderChan)
+	msg, err = readC.Read(spool)
+	assert.NoError(err)
+	assert.Equal(msg1, msg)
+	msg, err = readC.Read(spool)
+	assert.NoError(err)
+	assert.Equal(msg2, msg)
+
+	// entries lacking a holder's MAC are rejected
+	assert.NoError(writeA.Spool.Write(spool, []byte("unauthenticated entry of the spool")))
+	_, err = issuer.Read()
+	assert.Error(err)
+	stolen := *writeA
+	stolen.HolderID = writeB.HolderID
+	assert.NoError(stolen.Write(spool, []byte("written with a revoked holder ID")))
+	issuer.SkipGarbage = true
+	msg3 := []byte("written by alice")
+	assert.NoError(writeA.Write(spool, msg3))
+	msg, err = issuer.Read()
+	assert.NoError(err)
+	assert.Equal(msg3, msg)
+	assert.Equal(uint64(1), issuer.SkippedEntries)
+
+	// bob's writes no longer reach the issuer
+	assert.NoError(writeB.Write(spool, []byte("revoked")))
+	_, err = issuer.Read()
+	assert.Equal(ErrNoMessage, err)
+	msg, err = readC.Read(spool)
+	assert.NoError(err)
+	assert.Equal(msg3, msg)
+	_, err = readC.Read(spool)
+	assert.Equal(ErrNoMessage, err)
+
+	// the entries written after reading at the end are read
+	msg4 := []byte("written after polling")
+	assert.NoError(writeA.Write(spool, msg4))
+	msg, err = issuer.Read()
+	assert.NoError(err)
+	assert.Equal(msg4, msg)
+	msg, err = readC.Read(spool)
+	assert.NoError(err)
+	assert.Equal(msg4, msg)
+
+	// revoking carol purges her spool
+	reissue, err = issuer.Revoke("carol")
+	assert.NoError(err)
+	assert.Empty(reissue.WriteCapabilities)
+	_, err = readC.Read(spool)
+	assert.Equal(ErrNoMessage, err)
+}
+
+func TestCapabilityExpiration(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	issuer, err := NewCapabilityIssuer("receiver", "provider", spool)
+	assert.NoError(err)
+	expired, err := issuer.IssueWriteCapability("alice", -time.Minute)
+	assert.NoError(err)
+	assert.Error(expired.Verify(issuer.PublicKey()))
+	assert.Error(expired.Write(spool, []byte("too late")))
+
+	// the issuer rejects the writes of expired holders
+	extended := *expired.Metadata
+	extended.Expiration = time.Now().Add(time.Hour)
+	expired.Metadata = &extended
+	assert.NoError(expired.Write(spool, []byte("too late")))
+	_, err = issuer.Read()
+	assert.Error(err)
+	_, err = issuer.IssueReadCapability("bob", time.Hour)
+	assert.NoError(err)
+
+	// expired holders are not reissued capabilities
+	reissue, err := issuer.Revoke("bob")
+	assert.NoError(err)
+	assert.Empty(reissue.WriteCapabilities)
+	assert.Empty(reissue.ReadCapabilities)
+	assert.Empty(issuer.Holders)
+}
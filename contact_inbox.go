@@ -0,0 +1,239 @@
+// contact_inbox.go - contact requests from strangers
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/memspool/client"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// ContactRequestPayloadLength is the length of the padded
+	// contact request payload.
+	ContactRequestPayloadLength = SpoolPayloadLength - NoiseNOverhead
+
+	contactRequestIDLength = 16
+)
+
+// ContactRequest is a request from a stranger to establish an
+// UnreliableDoubleRatchetChannel, awaiting the inbox owner's decision.
+type ContactRequest struct {
+	ID       []byte
+	Received time.Time
+
+	// Message is the requester's free form note, such as their name.
+	Message string
+
+	// Invitation is the requester's serialized
+	// UnreliableDoubleRatchetChannelInvitation.
+	Invitation []byte
+}
+
+// contactRequestMessage is written to the inbox spool by the requester.
+type contactRequestMessage struct {
+	Message    string
+	Invitation []byte
+}
+
+// ContactInbox is a spool to which anyone holding it's public descriptor
+// may write contact requests. The requests are encrypted to the inbox
+// Noise key using the Noise N one-way pattern since the requester is not
+// yet known to the inbox owner.
+type ContactInbox struct {
+	spoolService client.SpoolService
+
+	SpoolReaderChan *UnreliableSpoolReaderChannel
+	NoisePrivateKey *ecdh.PrivateKey
+	PendingRequests []*ContactRequest
+}
+
+// NewContactInbox creates and returns a new ContactInbox or an error.
+func NewContactInbox(spoolReceiver, spoolProvider string, spool client.SpoolService) (*ContactInbox, error) {
+	noisePrivateKey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	spoolReader, err := NewUnreliableSpoolReaderChannel(spoolReceiver, spoolProvider, spool)
+	if err != nil {
+		return nil, err
+	}
+	return &ContactInbox{
+		spoolService:    spool,
+		SpoolReaderChan: spoolReader,
+		NoisePrivateKey: noisePrivateKey,
+	}, nil
+}
+
+// LoadContactInbox loads a saved ContactInbox and sets it's spoolService.
+func LoadContactInbox(data []byte, spoolService client.SpoolService) (*ContactInbox, error) {
+	c := new(ContactInbox)
+	err := codec.NewDecoderBytes(data, cborHandle).Decode(c)
+	if err != nil {
+		return nil, err
+	}
+	c.SetSpoolService(spoolService)
+	return c, nil
+}
+
+// SetSpoolService sets this inbox's spoolService field.
+func (c *ContactInbox) SetSpoolService(spoolService client.SpoolService) {
+	c.spoolService = spoolService
+}
+
+// Save returns the serialization of this inbox.
+func (c *ContactInbox) Save() ([]byte, error) {
+	var serialized []byte
+	enc := codec.NewEncoderBytes(&serialized, cborHandle)
+	if err := enc.Encode(c); err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+// Descriptor returns the public descriptor of this inbox
+// which may be published for strangers to contact us.
+func (c *ContactInbox) Descriptor() *NoiseWriterDescriptor {
+	return &NoiseWriterDescriptor{
+		SpoolWriterChan:      c.SpoolReaderChan.GetSpoolWriter(),
+		RemoteNoisePublicKey: c.NoisePrivateKey.PublicKey(),
+	}
+}
+
+// ReadRequest reads the next contact request from the inbox spool and
+// adds it to the pending requests.
+func (c *ContactInbox) ReadRequest() (*ContactRequest, error) {
+	ciphertext, err := c.SpoolReaderChan.Read(c.spoolService)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := noiseNDecrypt(c.NoisePrivateKey, c.SpoolReaderChan.GetSpoolWriter(), ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err := unpadPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	message := new(contactRequestMessage)
+	err = codec.NewDecoderBytes(serialized, cborHandle).Decode(message)
+	if err != nil {
+		return nil, err
+	}
+	if len(message.Invitation) == 0 {
+		return nil, errors.New("contact request invitation is missing")
+	}
+	id := make([]byte, contactRequestIDLength)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+	request := &ContactRequest{
+		ID:         id,
+		Received:   time.Now().UTC(),
+		Message:    message.Message,
+		Invitation: message.Invitation,
+	}
+	c.PendingRequests = append(c.PendingRequests, request)
+	return request, nil
+}
+
+// GetRequest returns the pending request with the given ID or nil.
+func (c *ContactInbox) GetRequest(id []byte) *ContactRequest {
+	for _, request := range c.PendingRequests {
+		if bytes.Equal(request.ID, id) {
+			return request
+		}
+	}
+	return nil
+}
+
+func (c *ContactInbox) removeRequest(id []byte) {
+	for i, request := range c.PendingRequests {
+		if bytes.Equal(request.ID, id) {
+			c.PendingRequests = append(c.PendingRequests[:i], c.PendingRequests[i+1:]...)
+			return
+		}
+	}
+}
+
+// Accept accepts the pending request with the given ID by completing
+// the given new channel with the requester. The requester's channel
+// completes on it's next Read.
+func (c *ContactInbox) Accept(id []byte, ratchetCh *UnreliableDoubleRatchetChannel) error {
+	request := c.GetRequest(id)
+	if request == nil {
+		return errors.New("no such contact request")
+	}
+	err := ratchetCh.AcceptInvitation(request.Invitation)
+	if err != nil {
+		return err
+	}
+	c.removeRequest(id)
+	return nil
+}
+
+// Reject discards the pending request with the given ID.
+func (c *ContactInbox) Reject(id []byte) error {
+	if c.GetRequest(id) == nil {
+		return errors.New("no such contact request")
+	}
+	c.removeRequest(id)
+	return nil
+}
+
+// SendContactRequest writes a contact request carrying an invitation to
+// this channel, along with the given message, to the contact inbox
+// described by the given descriptor. The channel completes on the first
+// Read after the inbox owner accepted the request.
+func (r *UnreliableDoubleRatchetChannel) SendContactRequest(inbox *NoiseWriterDescriptor, message string, lifetime time.Duration) error {
+	if inbox.SpoolWriterChan == nil || inbox.RemoteNoisePublicKey == nil {
+		return errors.New("incomplete contact inbox descriptor")
+	}
+	invitation, err := r.Invite(lifetime)
+	if err != nil {
+		return err
+	}
+	var serialized []byte
+	err = codec.NewEncoderBytes(&serialized, cborHandle).Encode(&contactRequestMessage{
+		Message:    message,
+		Invitation: invitation,
+	})
+	if err != nil {
+		return err
+	}
+	payload, err := padPayload(serialized, ContactRequestPayloadLength)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := noiseNEncrypt(inbox.RemoteNoisePublicKey, inbox.SpoolWriterChan, payload)
+	if err != nil {
+		return err
+	}
+	err = inbox.SpoolWriterChan.Write(r.SpoolCh.spoolService, ciphertext)
+	if err != nil {
+		// allow the request to be retried
+		r.PendingInvitation = nil
+		return err
+	}
+	return nil
+}
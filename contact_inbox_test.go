@@ -0,0 +1,100 @@
+// contact_inbox_test.go - contact request inbox tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContactInbox(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	inbox, err := NewContactInbox("receiver_alice", "provider_alice", spool)
+	assert.NoError(err)
+
+	// Alice publishes her inbox descriptor.
+	published, err := inbox.Descriptor().EncodeText()
+	assert.NoError(err)
+
+	descriptor := new(NoiseWriterDescriptor)
+	err = descriptor.DecodeText(published)
+	assert.NoError(err)
+	bobAlice := newTestRatchetChannel(t, "bob", spool)
+	err = bobAlice.SendContactRequest(descriptor, "Hi, it's Bob.", time.Hour)
+	assert.NoError(err)
+
+	request, err := inbox.ReadRequest()
+	assert.NoError(err)
+	assert.Equal("Hi, it's Bob.", request.Message)
+
+	// Alice reviews her requests later.
+	blob, err := inbox.Save()
+	assert.NoError(err)
+	inbox, err = LoadContactInbox(blob, spool)
+	assert.NoError(err)
+	assert.Equal(1, len(inbox.PendingRequests))
+
+	aliceBob := newTestRatchetChannel(t, "alice", spool)
+	err = inbox.Accept(request.ID, aliceBob)
+	assert.NoError(err)
+	assert.Empty(inbox.PendingRequests)
+
+	msg1 := []byte("Welcome Bob.")
+	err = aliceBob.Write(msg1)
+	assert.NoError(err)
+	msg1Read, err := bobAlice.Read()
+	assert.NoError(err)
+	assert.Equal(msg1, msg1Read)
+
+	msg2 := []byte("Thanks Alice.")
+	err = bobAlice.Write(msg2)
+	assert.NoError(err)
+	msg2Read, err := aliceBob.Read()
+	assert.NoError(err)
+	assert.Equal(msg2, msg2Read)
+}
+
+func TestContactInboxReject(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	inbox, err := NewContactInbox("receiver_alice", "provider_alice", spool)
+	assert.NoError(err)
+
+	malloryAlice := newTestRatchetChannel(t, "mallory", spool)
+	err = malloryAlice.SendContactRequest(inbox.Descriptor(), "Let me in.", time.Hour)
+	assert.NoError(err)
+
+	request, err := inbox.ReadRequest()
+	assert.NoError(err)
+	err = inbox.Reject(request.ID)
+	assert.NoError(err)
+	assert.Empty(inbox.PendingRequests)
+	err = inbox.Accept(request.ID, newTestRatchetChannel(t, "alice", spool))
+	assert.Error(err)
+
+	// Entries not encrypted to the inbox are not requests.
+	err = inbox.Descriptor().SpoolWriterChan.Write(spool, []byte("junk"))
+	assert.NoError(err)
+	_, err = inbox.ReadRequest()
+	assert.Error(err)
+	assert.Empty(inbox.PendingRequests)
+}
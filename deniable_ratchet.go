@@ -0,0 +1,375 @@
+// deniable_ratchet.go - Double Ratchet keyed by a deniable triple Diffie-Hellman
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/katzenpost/core/crypto/rand"
+	ratchet "github.com/katzenpost/doubleratchet"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// deniableRatchetHeaderLength is chosen so that the deniable
+	// ratchet has the same overhead as the signed ratchet and the
+	// ciphertexts of both modes are indistinguishable by length.
+	deniableRatchetHeaderLength = ratchet.DoubleRatchetOverhead - macLength
+
+	// deniableRatchetMaxSkip is the maximum number of message keys
+	// stored for messages which were skipped in a single chain.
+	deniableRatchetMaxSkip = 1000
+)
+
+var (
+	deniableRatchetInfo = []byte("katzenpost channels deniable ratchet")
+	deniableRootInfo    = []byte("katzenpost channels deniable ratchet root")
+)
+
+// DeniableKeyExchange is the key exchange of the deniable mode. Unlike
+// ratchet.SignedKeyExchange it is not signed, the parties authenticate
+// each other implicitly by a triple Diffie-Hellman between their
+// identity and ephemeral keys. Either party could therefore have
+// created the transcript of a conversation by itself.
+type DeniableKeyExchange struct {
+	IdentityKey  []byte
+	EphemeralKey []byte
+}
+
+// DeniableRatchet is a Double Ratchet whose root key is established with
+// a DeniableKeyExchange. The party with the lesser identity key takes
+// the initiator role.
+type DeniableRatchet struct {
+	IdentityPrivate  []byte
+	EphemeralPrivate []byte
+	RemoteIdentity   []byte
+
+	// AssociatedData is authenticated with every message.
+	AssociatedData []byte
+
+	RootKey       []byte
+	SendChainKey  []byte
+	RecvChainKey  []byte
+	SendPrivate   []byte
+	RemotePublic  []byte
+	SendCount     uint32
+	RecvCount     uint32
+	PrevSendCount uint32
+
+	// SkippedKeys holds the message keys of skipped messages.
+	SkippedKeys map[string][]byte
+}
+
+func newX25519Private() ([]byte, error) {
+	private := make([]byte, keyLength)
+	if _, err := io.ReadFull(rand.Reader, private); err != nil {
+		return nil, err
+	}
+	return private, nil
+}
+
+func x25519Public(private []byte) []byte {
+	var public, privateArr [keyLength]byte
+	copy(privateArr[:], private)
+	curve25519.ScalarBaseMult(&public, &privateArr)
+	return public[:]
+}
+
+func x25519(private, public []byte) ([]byte, error) {
+	if len(private) != keyLength || len(public) != keyLength {
+		return nil, errors.New("invalid X25519 key length")
+	}
+	var shared, privateArr, publicArr [keyLength]byte
+	copy(privateArr[:], private)
+	copy(publicArr[:], public)
+	curve25519.ScalarMult(&shared, &privateArr, &publicArr)
+	if shared == [keyLength]byte{} {
+		return nil, errors.New("low order X25519 public key")
+	}
+	return shared[:], nil
+}
+
+func kdfRootKey(rootKey, dh []byte) ([]byte, []byte) {
+	out := make([]byte, 2*keyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dh, rootKey, deniableRootInfo), out); err != nil {
+		panic("BUG: hkdf failed: " + err.Error())
+	}
+	return out[:keyLength], out[keyLength:]
+}
+
+func kdfChainKey(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{1})
+	messageKey := mac.Sum(nil)
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{2})
+	return messageKey, mac.Sum(nil)
+}
+
+// NewDeniableRatchet creates a new DeniableRatchet with
+// fresh identity and ephemeral keys.
+func NewDeniableRatchet() (*DeniableRatchet, error) {
+	identityPrivate, err := newX25519Private()
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPrivate, err := newX25519Private()
+	if err != nil {
+		return nil, err
+	}
+	return &DeniableRatchet{
+		IdentityPrivate:  identityPrivate,
+		EphemeralPrivate: ephemeralPrivate,
+		SkippedKeys:      make(map[string][]byte),
+	}, nil
+}
+
+// IdentityKey returns our public identity key.
+func (d *DeniableRatchet) IdentityKey() []byte {
+	return x25519Public(d.IdentityPrivate)
+}
+
+// KeyExchange returns our key exchange.
+func (d *DeniableRatchet) KeyExchange() (*DeniableKeyExchange, error) {
+	if d.EphemeralPrivate == nil {
+		return nil, errors.New("deniable ratchet: key exchange already processed")
+	}
+	return &DeniableKeyExchange{
+		IdentityKey:  d.IdentityKey(),
+		EphemeralKey: x25519Public(d.EphemeralPrivate),
+	}, nil
+}
+
+// ProcessKeyExchange processes the remote key exchange and
+// initializes the ratchet.
+func (d *DeniableRatchet) ProcessKeyExchange(kx *DeniableKeyExchange) error {
+	if d.EphemeralPrivate == nil {
+		return errors.New("deniable ratchet: key exchange already processed")
+	}
+	if kx == nil || len(kx.IdentityKey) != keyLength || len(kx.EphemeralKey) != keyLength {
+		return errors.New("deniable ratchet: invalid key exchange")
+	}
+	localIdentity := d.IdentityKey()
+	if bytes.Equal(localIdentity, kx.IdentityKey) {
+		return errors.New("deniable ratchet: reflected key exchange")
+	}
+	return d.agree(kx, bytes.Compare(localIdentity, kx.IdentityKey) < 0, nil)
+}
+
+// agree performs the triple Diffie-Hellman with the remote identity and
+// ephemeral keys given by kx and initializes the ratchet. The output of
+// an additional Diffie-Hellman, such as with a one-time prekey, may be
+// mixed into the shared secret.
+func (d *DeniableRatchet) agree(kx *DeniableKeyExchange, initiator bool, extraDH []byte) error {
+	localIdentity := d.IdentityKey()
+
+	// dh1 = DH(IK_A, EK_B), dh2 = DH(EK_A, IK_B), dh3 = DH(EK_A, EK_B)
+	var dh1, dh2, dh3 []byte
+	var err error
+	if initiator {
+		dh1, err = x25519(d.IdentityPrivate, kx.EphemeralKey)
+		if err != nil {
+			return err
+		}
+		dh2, err = x25519(d.EphemeralPrivate, kx.IdentityKey)
+	} else {
+		dh1, err = x25519(d.EphemeralPrivate, kx.IdentityKey)
+		if err != nil {
+			return err
+		}
+		dh2, err = x25519(d.IdentityPrivate, kx.EphemeralKey)
+	}
+	if err != nil {
+		return err
+	}
+	dh3, err = x25519(d.EphemeralPrivate, kx.EphemeralKey)
+	if err != nil {
+		return err
+	}
+	secret := make([]byte, keyLength)
+	ikm := append(append(append(append([]byte{}, dh1...), dh2...), dh3...), extraDH...)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, nil, deniableRatchetInfo), secret); err != nil {
+		return err
+	}
+
+	if initiator {
+		d.AssociatedData = append(append([]byte{}, localIdentity...), kx.IdentityKey...)
+		d.SendPrivate = d.EphemeralPrivate
+		d.RemotePublic = kx.EphemeralKey
+		d.RootKey, d.SendChainKey = kdfRootKey(secret, dh3)
+	} else {
+		// The responder knows the initiator's first ratchet key and
+		// performs it's first ratchet step right away so that either
+		// party may send the first message.
+		d.AssociatedData = append(append([]byte{}, kx.IdentityKey...), localIdentity...)
+		d.RemotePublic = kx.EphemeralKey
+		d.RootKey, d.RecvChainKey = kdfRootKey(secret, dh3)
+		d.SendPrivate, err = newX25519Private()
+		if err != nil {
+			return err
+		}
+		dh, err := x25519(d.SendPrivate, d.RemotePublic)
+		if err != nil {
+			return err
+		}
+		d.RootKey, d.SendChainKey = kdfRootKey(d.RootKey, dh)
+	}
+	d.RemoteIdentity = kx.IdentityKey
+	d.EphemeralPrivate = nil
+	return nil
+}
+
+// Encrypt encrypts the given payload.
+func (d *DeniableRatchet) Encrypt(payload []byte) ([]byte, error) {
+	if d.SendChainKey == nil {
+		return nil, errors.New("deniable ratchet: key exchange must be processed")
+	}
+	messageKey, chainKey := kdfChainKey(d.SendChainKey)
+	header := make([]byte, deniableRatchetHeaderLength)
+	copy(header, x25519Public(d.SendPrivate))
+	binary.BigEndian.PutUint32(header[keyLength:], d.PrevSendCount)
+	binary.BigEndian.PutUint32(header[keyLength+4:], d.SendCount)
+	aead, err := chacha20poly1305.New(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	ciphertext := aead.Seal(header, nonce, payload, append(append([]byte{}, d.AssociatedData...), header...))
+	d.SendChainKey = chainKey
+	d.SendCount++
+	return ciphertext, nil
+}
+
+func skippedKeyIndex(public []byte, n uint32) string {
+	return fmt.Sprintf("%s:%d", hex.EncodeToString(public), n)
+}
+
+func (d *DeniableRatchet) clone() *DeniableRatchet {
+	c := *d
+	c.SkippedKeys = make(map[string][]byte, len(d.SkippedKeys))
+	for k, v := range d.SkippedKeys {
+		c.SkippedKeys[k] = v
+	}
+	return &c
+}
+
+func (d *DeniableRatchet) skipMessageKeys(until uint32) error {
+	if d.RecvChainKey == nil {
+		return nil
+	}
+	if until > d.RecvCount+deniableRatchetMaxSkip {
+		return errors.New("deniable ratchet: too many skipped messages")
+	}
+	for d.RecvCount < until {
+		var messageKey []byte
+		messageKey, d.RecvChainKey = kdfChainKey(d.RecvChainKey)
+		d.SkippedKeys[skippedKeyIndex(d.RemotePublic, d.RecvCount)] = messageKey
+		d.RecvCount++
+	}
+	return nil
+}
+
+func (d *DeniableRatchet) ratchetStep(remotePublic []byte) error {
+	d.PrevSendCount = d.SendCount
+	d.SendCount = 0
+	d.RecvCount = 0
+	d.RemotePublic = remotePublic
+	dh, err := x25519(d.SendPrivate, d.RemotePublic)
+	if err != nil {
+		return err
+	}
+	d.RootKey, d.RecvChainKey = kdfRootKey(d.RootKey, dh)
+	d.SendPrivate, err = newX25519Private()
+	if err != nil {
+		return err
+	}
+	dh, err = x25519(d.SendPrivate, d.RemotePublic)
+	if err != nil {
+		return err
+	}
+	d.RootKey, d.SendChainKey = kdfRootKey(d.RootKey, dh)
+	return nil
+}
+
+func (d *DeniableRatchet) open(messageKey, header, ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Open(nil, nonce, ciphertext, append(append([]byte{}, d.AssociatedData...), header...))
+}
+
+// Decrypt decrypts the given ciphertext. The ratchet state
+// is left unchanged if decryption fails.
+func (d *DeniableRatchet) Decrypt(message []byte) ([]byte, error) {
+	if d.RootKey == nil {
+		return nil, errors.New("deniable ratchet: key exchange must be processed")
+	}
+	if len(message) < deniableRatchetHeaderLength+macLength {
+		return nil, errors.New("deniable ratchet: message is truncated")
+	}
+	header := message[:deniableRatchetHeaderLength]
+	ciphertext := message[deniableRatchetHeaderLength:]
+	remotePublic := header[:keyLength]
+	prevCount := binary.BigEndian.Uint32(header[keyLength:])
+	count := binary.BigEndian.Uint32(header[keyLength+4:])
+
+	index := skippedKeyIndex(remotePublic, count)
+	if messageKey, ok := d.SkippedKeys[index]; ok {
+		plaintext, err := d.open(messageKey, header, ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		delete(d.SkippedKeys, index)
+		return plaintext, nil
+	}
+
+	state := d.clone()
+	if !bytes.Equal(remotePublic, state.RemotePublic) {
+		if err := state.skipMessageKeys(prevCount); err != nil {
+			return nil, err
+		}
+		if err := state.ratchetStep(append([]byte{}, remotePublic...)); err != nil {
+			return nil, err
+		}
+	}
+	if err := state.skipMessageKeys(count); err != nil {
+		return nil, err
+	}
+	if count < state.RecvCount {
+		return nil, errors.New("deniable ratchet: duplicate message")
+	}
+	var messageKey []byte
+	messageKey, state.RecvChainKey = kdfChainKey(state.RecvChainKey)
+	state.RecvCount++
+	plaintext, err := state.open(messageKey, header, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	*d = *state
+	return plaintext, nil
+}
@@ -0,0 +1,153 @@
+// deniable_ratchet_test.go - deniable Double Ratchet tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDeniableRatchetPair(t *testing.T) (*UnreliableDoubleRatchetChannel, *UnreliableDoubleRatchetChannel) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestSpoolChannelPair(t)
+	chanA.writerChan = nil
+	chanB.writerChan = nil
+	ratchetChanA, err := NewUnreliableDoubleRatchetChannelWithMode(chanA, DeniableKeyExchangeMode)
+	assert.NoError(err)
+	ratchetChanB, err := NewUnreliableDoubleRatchetChannelWithMode(chanB, DeniableKeyExchangeMode)
+	assert.NoError(err)
+	return ratchetChanA, ratchetChanB
+}
+
+func TestDeniableDoubleRatchet(t *testing.T) {
+	assert := assert.New(t)
+
+	ratchetChanA, ratchetChanB := newTestDeniableRatchetPair(t)
+	exchangeA, err := ratchetChanA.ChannelExchange()
+	assert.NoError(err)
+	exchangeB, err := ratchetChanB.ChannelExchangeText()
+	assert.NoError(err)
+	err = ratchetChanB.ProcessChannelExchange(exchangeA, ratchetChanA.IdentityPrivateKey.PublicKey())
+	assert.NoError(err)
+	err = ratchetChanA.ProcessChannelExchangeText(exchangeB, ratchetChanB.IdentityPrivateKey.PublicKey())
+	assert.NoError(err)
+
+	_, err = ratchetChanA.KeyExchange()
+	assert.Error(err)
+
+	numberA, err := ratchetChanA.SafetyNumber()
+	assert.NoError(err)
+	numberB, err := ratchetChanB.SafetyNumber()
+	assert.NoError(err)
+	assert.Equal(numberA, numberB)
+
+	// Either party may write first, regardless of it's role.
+	for i, writer := range []*UnreliableDoubleRatchetChannel{ratchetChanA, ratchetChanB} {
+		reader := ratchetChanB
+		if i == 1 {
+			reader = ratchetChanA
+		}
+		msg := []byte("Plausibly deniable.")
+		err = writer.Write(msg)
+		assert.NoError(err)
+		msgRead, err := reader.Read()
+		assert.NoError(err)
+		assert.Equal(msg, msgRead)
+	}
+
+	// The mode and ratchet state survive Save and Load.
+	blob, err := ratchetChanA.Save()
+	assert.NoError(err)
+	ratchetChanA, err = LoadUnreliableDoubleRatchetChannel(blob, ratchetChanA.SpoolCh.spoolService)
+	assert.NoError(err)
+	assert.Equal(DeniableKeyExchangeMode, ratchetChanA.Mode)
+
+	for i := 0; i < 3; i++ {
+		msg := []byte{byte(i)}
+		err = ratchetChanA.Write(msg)
+		assert.NoError(err)
+		msgRead, err := ratchetChanB.Read()
+		assert.NoError(err)
+		assert.Equal(msg, msgRead)
+		err = ratchetChanB.Write(msg)
+		assert.NoError(err)
+		msgRead, err = ratchetChanA.Read()
+		assert.NoError(err)
+		assert.Equal(msg, msgRead)
+	}
+}
+
+func TestDeniableDoubleRatchetOutOfOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	ratchetA, err := NewDeniableRatchet()
+	assert.NoError(err)
+	ratchetB, err := NewDeniableRatchet()
+	assert.NoError(err)
+	kxA, err := ratchetA.KeyExchange()
+	assert.NoError(err)
+	kxB, err := ratchetB.KeyExchange()
+	assert.NoError(err)
+	assert.NoError(ratchetA.ProcessKeyExchange(kxB))
+	assert.NoError(ratchetB.ProcessKeyExchange(kxA))
+	assert.Error(ratchetA.ProcessKeyExchange(kxB))
+
+	payload := make([]byte, DoubleRatchetPayloadLength)
+	ciphertext1, err := ratchetA.Encrypt(payload)
+	assert.NoError(err)
+	assert.Len(ciphertext1, SpoolPayloadLength-identityMACLength)
+	ciphertext2, err := ratchetA.Encrypt(payload)
+	assert.NoError(err)
+
+	// A tampered message leaves the ratchet unchanged.
+	tampered := append([]byte{}, ciphertext2...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = ratchetB.Decrypt(tampered)
+	assert.Error(err)
+
+	plaintext, err := ratchetB.Decrypt(ciphertext2)
+	assert.NoError(err)
+	assert.Equal(payload, plaintext)
+	plaintext, err = ratchetB.Decrypt(ciphertext1)
+	assert.NoError(err)
+	assert.Equal(payload, plaintext)
+	_, err = ratchetB.Decrypt(ciphertext1)
+	assert.Error(err)
+}
+
+func TestDeniableDoubleRatchetModeMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestSpoolChannelPair(t)
+	chanA.writerChan = nil
+	chanB.writerChan = nil
+	ratchetChanA, err := NewUnreliableDoubleRatchetChannelWithMode(chanA, DeniableKeyExchangeMode)
+	assert.NoError(err)
+	ratchetChanB, err := NewUnreliableDoubleRatchetChannel(chanB)
+	assert.NoError(err)
+
+	exchangeA, err := ratchetChanA.ChannelExchange()
+	assert.NoError(err)
+	exchangeB, err := ratchetChanB.ChannelExchange()
+	assert.NoError(err)
+	err = ratchetChanB.ProcessChannelExchange(exchangeA, ratchetChanA.IdentityPrivateKey.PublicKey())
+	assert.Error(err)
+	err = ratchetChanA.ProcessChannelExchange(exchangeB, ratchetChanB.IdentityPrivateKey.PublicKey())
+	assert.Error(err)
+}
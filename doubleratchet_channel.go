@@ -17,31 +17,149 @@
 package channels
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 
+	"github.com/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/core/crypto/rand"
 	ratchet "github.com/katzenpost/doubleratchet"
 	"github.com/katzenpost/memspool/client"
 	"github.com/ugorji/go/codec"
+	"golang.org/x/crypto/hkdf"
 )
 
 const (
-	// DoubleRatchetPayloadLength is the length of the payload encrypted by the ratchet.
-	DoubleRatchetPayloadLength = SpoolPayloadLength - ratchet.DoubleRatchetOverhead
+	// DoubleRatchetPayloadLength is the length of the payload encrypted by
+	// the ratchet. It is shorter by InboxTagLength for the messages written
+	// to a SharedInbox, and by StampLength if the spool requires stamps.
+	DoubleRatchetPayloadLength = SpoolPayloadLength - ratchet.DoubleRatchetOverhead - identityMACLength
+
+	// doubleRatchetMessageOverhead is the length of the length prefix, the
+	// message type, the spool binding and the sequence number within the
+	// ratchet payload.
+	doubleRatchetMessageOverhead = 4 + 1 + spoolBindingLength + sequenceLength
+
+	doubleRatchetBindingLabel = "katzenpost channels double ratchet"
+
+	// identityMACLength is the length of the MAC appended to the
+	// ratchet ciphertexts, it tells the remote party's messages the
+	// ratchet fails to decrypt apart from garbage.
+	identityMACLength = 16
+	identityMACLabel  = "katzenpost channels double ratchet mac"
+)
+
+// The message types of the messages carried by the ratchet.
+const (
+	dataMessage byte = iota
+	introductionRequestMessage
+	introductionReplyMessage
+	introductionOfferMessage
+	inboxMessage
+	groupSenderKeyMessage
+	receiptMessage
+	transcriptMessage
+)
+
+// KeyExchangeMode selects how an UnreliableDoubleRatchetChannel
+// establishes it's ratchet.
+type KeyExchangeMode int
+
+const (
+	// SignedKeyExchangeMode authenticates the ratchet key exchange
+	// with signatures. It is the default mode.
+	SignedKeyExchangeMode KeyExchangeMode = iota
+
+	// DeniableKeyExchangeMode authenticates the parties with a triple
+	// Diffie-Hellman handshake which does not involve signatures, so
+	// that neither party can prove to a third party that the other
+	// took part in the conversation.
+	DeniableKeyExchangeMode
 )
 
 // UnreliableDoubleRatchetChannelExchange is exchanged between endpoints
 // to establish a bidirectional channel, the UnreliableDoubleRatchetChannel.
+// Exactly one of the key exchanges is set, depending on the channel's mode.
 type UnreliableDoubleRatchetChannelExchange struct {
-	SpoolWriter       *UnreliableSpoolWriterChannel
-	SignedKeyExchange *ratchet.SignedKeyExchange
+	SpoolWriter         *UnreliableSpoolWriterChannel
+	SignedKeyExchange   *ratchet.SignedKeyExchange
+	DeniableKeyExchange *DeniableKeyExchange
 }
 
 // UnreliableDoubleRatchetChannel is an unreliable channel which encrypts using the double ratchet.
 type UnreliableDoubleRatchetChannel struct {
 	SpoolCh *UnreliableSpoolChannel
-	Ratchet *ratchet.Ratchet
+	Mode    KeyExchangeMode
+
+	// Ratchet is used in SignedKeyExchangeMode and
+	// DeniableRatchet in DeniableKeyExchangeMode.
+	Ratchet         *ratchet.Ratchet
+	DeniableRatchet *DeniableRatchet
+
+	// LocalIdentity and RemoteIdentity are the public keys which
+	// authenticate our and the remote party's ratchet key exchange.
+	LocalIdentity  []byte
+	RemoteIdentity []byte
+
+	// Verified is set once the user has compared safety numbers
+	// with the remote party and is reset when the remote key changes.
+	Verified bool
+
+	// IdentityPrivateKey signs the spool writer of our channel
+	// exchange. RemoteIdentityKey is the pinned identity key of
+	// the remote party, which must sign it's spool writer.
+	IdentityPrivateKey *eddsa.PrivateKey
+	RemoteIdentityKey  *eddsa.PublicKey
+
+	// PendingInvitation is set while an invitation created
+	// by Invite awaits the invitee's reply.
+	PendingInvitation *PendingInvitation
+
+	// Introductions holds the introductions requested over
+	// this channel which have not yet been completed.
+	Introductions []*Introduction
+
+	// DecryptFailures counts the consecutive messages which failed
+	// to decrypt, a session reset is requested at DesyncThreshold.
+	DecryptFailures int
+
+	// PendingReset is set while our session reset request
+	// awaits the remote party's response.
+	PendingReset *PendingReset
+
+	// SkipGarbage makes Read skip spool entries which fail to
+	// authenticate rather than return an error, SkippedEntries
+	// counts the skipped entries. Entries which were not written
+	// by the remote party do not count towards DesyncThreshold.
+	SkipGarbage    bool
+	SkippedEntries uint64
+
+	// InboxTags is set once this channel was added to our SharedInbox
+	// and RemoteInbox once the remote party added it to theirs, our
+	// messages are then written to their SharedInbox.
+	InboxTags   *InboxTags
+	RemoteInbox *RemoteInbox
+
+	// GroupSenderKeys holds the group sender keys received over
+	// this channel until a GroupChannel processes them.
+	GroupSenderKeys []*GroupSenderKeyDistribution
+
+	// Receipts is set once receipts are enabled, by EnableReceipts
+	// or by reading a message of a remote party which enabled them.
+	Receipts *Receipts
+
+	// Sequence numbers our messages and detects the
+	// remote party's messages which went missing.
+	Sequence Sequence
+
+	// Transcript hash chains our messages and the remote party's,
+	// digests of both are exchanged to detect tampering.
+	Transcript Transcript
 }
 
 // LoadUnreliableDoubleRatchetChannel loads the channel given the saved blob and a SpoolService interface.
@@ -52,37 +170,185 @@ func LoadUnreliableDoubleRatchetChannel(data []byte, spoolService client.SpoolSe
 	if err != nil {
 		return nil, err
 	}
+	// The pending reset is allocated so that it's ratchet
+	// may be decoded, it is discarded unless a reset is pending.
+	s.PendingReset = new(PendingReset)
+	s.PendingReset.Ratchet, err = ratchet.New(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
 	err = codec.NewDecoderBytes(data, cborHandle).Decode(s)
 	if err != nil {
 		return nil, err
 	}
+	if s.PendingReset != nil && s.PendingReset.ID == nil {
+		s.PendingReset = nil
+	}
 	s.SpoolCh.SetSpoolService(spoolService)
 	return s, nil
 }
 
-// NewUnreliableDoubleRatchetChannel creates a new UnreliableDoubleRatchetChannel.
+// NewUnreliableDoubleRatchetChannel creates a new UnreliableDoubleRatchetChannel
+// in SignedKeyExchangeMode.
 func NewUnreliableDoubleRatchetChannel(spoolCh *UnreliableSpoolChannel) (*UnreliableDoubleRatchetChannel, error) {
-	ratchet, err := ratchet.New(rand.Reader)
+	return NewUnreliableDoubleRatchetChannelWithMode(spoolCh, SignedKeyExchangeMode)
+}
+
+// NewUnreliableDoubleRatchetChannelWithMode creates a new
+// UnreliableDoubleRatchetChannel using the given key exchange mode.
+// Both endpoints of a channel must use the same mode.
+func NewUnreliableDoubleRatchetChannelWithMode(spoolCh *UnreliableSpoolChannel, mode KeyExchangeMode) (*UnreliableDoubleRatchetChannel, error) {
+	identityPrivateKey, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewUnreliableDoubleRatchetChannelWithIdentity(spoolCh, mode, identityPrivateKey)
+}
+
+// NewUnreliableDoubleRatchetChannelWithIdentity creates a new
+// UnreliableDoubleRatchetChannel using the given key exchange mode,
+// whose spool writer is signed by the given long-term identity key.
+func NewUnreliableDoubleRatchetChannelWithIdentity(spoolCh *UnreliableSpoolChannel, mode KeyExchangeMode, identityPrivateKey *eddsa.PrivateKey) (*UnreliableDoubleRatchetChannel, error) {
+	r := &UnreliableDoubleRatchetChannel{
+		SpoolCh:            spoolCh,
+		Mode:               mode,
+		IdentityPrivateKey: identityPrivateKey,
+	}
+	err := r.newRatchet()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// newRatchet sets a new ratchet for our key exchange mode.
+func (r *UnreliableDoubleRatchetChannel) newRatchet() error {
+	var err error
+	switch r.Mode {
+	case SignedKeyExchangeMode:
+		r.Ratchet, err = ratchet.New(rand.Reader)
+	case DeniableKeyExchangeMode:
+		r.DeniableRatchet, err = NewDeniableRatchet()
+	default:
+		return errors.New("invalid key exchange mode")
+	}
+	return err
+}
+
+// keyExchangeIdentity returns the public key material which
+// authenticates the given signed key exchange.
+func keyExchangeIdentity(signedKeyExchange *ratchet.SignedKeyExchange) ([]byte, error) {
+	kx := new(ratchet.KeyExchange)
+	err := codec.NewDecoderBytes(signedKeyExchange.Signed, cborHandle).Decode(kx)
+	if err != nil {
+		return nil, err
+	}
+	identity := make([]byte, 0, len(kx.PublicKey)+len(kx.IdentityPublic))
+	identity = append(identity, kx.PublicKey...)
+	return append(identity, kx.IdentityPublic...), nil
+}
+
+func (r *UnreliableDoubleRatchetChannel) createKeyExchange() (*ratchet.SignedKeyExchange, error) {
+	if r.Mode != SignedKeyExchangeMode {
+		return nil, errors.New("channel does not use signed key exchanges")
+	}
+	signedKeyExchange, err := r.Ratchet.CreateKeyExchange()
+	if err != nil {
+		return nil, err
+	}
+	r.LocalIdentity, err = keyExchangeIdentity(signedKeyExchange)
+	if err != nil {
+		return nil, err
+	}
+	return signedKeyExchange, nil
+}
+
+func (r *UnreliableDoubleRatchetChannel) processKeyExchange(signedKeyExchange *ratchet.SignedKeyExchange) error {
+	if r.Mode != SignedKeyExchangeMode {
+		return errors.New("channel does not use signed key exchanges")
+	}
+	if signedKeyExchange == nil {
+		return errors.New("signed key exchange must not be nil")
+	}
+	err := r.Ratchet.ProcessKeyExchange(signedKeyExchange)
+	if err != nil {
+		return err
+	}
+	remoteIdentity, err := keyExchangeIdentity(signedKeyExchange)
+	if err != nil {
+		return err
+	}
+	r.setRemoteIdentity(remoteIdentity)
+	return nil
+}
+
+func (r *UnreliableDoubleRatchetChannel) setRemoteIdentity(remoteIdentity []byte) {
+	if !bytes.Equal(r.RemoteIdentity, remoteIdentity) {
+		r.Verified = false
+	}
+	r.RemoteIdentity = remoteIdentity
+}
+
+func (r *UnreliableDoubleRatchetChannel) processDeniableKeyExchange(kx *DeniableKeyExchange) error {
+	if kx == nil {
+		return errors.New("deniable key exchange must not be nil")
+	}
+	err := r.DeniableRatchet.ProcessKeyExchange(kx)
+	if err != nil {
+		return err
+	}
+	r.setRemoteIdentity(kx.IdentityKey)
+	return nil
+}
+
+// ratchetExchange returns the key exchange of our ratchet.
+func (r *UnreliableDoubleRatchetChannel) ratchetExchange() (*UnreliableDoubleRatchetChannelExchange, error) {
+	if r.Mode == DeniableKeyExchangeMode {
+		kx, err := r.DeniableRatchet.KeyExchange()
+		if err != nil {
+			return nil, err
+		}
+		r.LocalIdentity = kx.IdentityKey
+		return &UnreliableDoubleRatchetChannelExchange{
+			DeniableKeyExchange: kx,
+		}, nil
+	}
+	signedKeyExchange, err := r.createKeyExchange()
 	if err != nil {
 		return nil, err
 	}
-	return &UnreliableDoubleRatchetChannel{
-		SpoolCh: spoolCh,
-		Ratchet: ratchet,
+	return &UnreliableDoubleRatchetChannelExchange{
+		SignedKeyExchange: signedKeyExchange,
 	}, nil
 }
 
+// processRatchetExchange processes the key exchange of the given exchange.
+func (r *UnreliableDoubleRatchetChannel) processRatchetExchange(exchange *UnreliableDoubleRatchetChannelExchange) error {
+	if r.Mode == DeniableKeyExchangeMode {
+		return r.processDeniableKeyExchange(exchange.DeniableKeyExchange)
+	}
+	return r.processKeyExchange(exchange.SignedKeyExchange)
+}
+
+func (r *UnreliableDoubleRatchetChannel) channelExchange() (*UnreliableDoubleRatchetChannelExchange, error) {
+	exchange, err := r.ratchetExchange()
+	if err != nil {
+		return nil, err
+	}
+	exchange.SpoolWriter = r.SpoolCh.GetSpoolWriter()
+	if r.IdentityPrivateKey != nil {
+		exchange.SpoolWriter.Sign(r.IdentityPrivateKey, WriterDescriptorLifetime)
+	}
+	return exchange, nil
+}
+
 // ChannelExchange returns a serialized UnreliableDoubleRatchetChannelExchange
 // which is needed to connect channel endpoints.
 func (r *UnreliableDoubleRatchetChannel) ChannelExchange() ([]byte, error) {
-	signedKeyExchange, err := r.Ratchet.CreateKeyExchange()
+	exchange, err := r.channelExchange()
 	if err != nil {
 		return nil, err
 	}
-	exchange := UnreliableDoubleRatchetChannelExchange{
-		SpoolWriter:       r.SpoolCh.GetSpoolWriter(),
-		SignedKeyExchange: signedKeyExchange,
-	}
 	var serialized []byte
 	err = codec.NewEncoderBytes(&serialized, cborHandle).Encode(exchange)
 	if err != nil {
@@ -91,65 +357,487 @@ func (r *UnreliableDoubleRatchetChannel) ChannelExchange() ([]byte, error) {
 	return serialized, nil
 }
 
+// ChannelExchangeText returns the text encoding of an
+// UnreliableDoubleRatchetChannelExchange which users may
+// transfer by hand to connect channel endpoints.
+func (r *UnreliableDoubleRatchetChannel) ChannelExchangeText() (string, error) {
+	exchange, err := r.channelExchange()
+	if err != nil {
+		return "", err
+	}
+	return exchange.EncodeText()
+}
+
 // ProcessKeyExchange processes the given signed key exchange.
 func (r *UnreliableDoubleRatchetChannel) ProcessKeyExchange(kx *ratchet.SignedKeyExchange) error {
-	return r.Ratchet.ProcessKeyExchange(kx)
+	return r.processKeyExchange(kx)
 }
 
 // KeyExchange returns a signed key exchange or an error.
 func (r *UnreliableDoubleRatchetChannel) KeyExchange() (*ratchet.SignedKeyExchange, error) {
-	return r.Ratchet.CreateKeyExchange()
+	return r.createKeyExchange()
+}
+
+// SafetyNumber returns the safety number derived from the public
+// keys authenticating our and the remote party's key exchange.
+func (r *UnreliableDoubleRatchetChannel) SafetyNumber() (string, error) {
+	if r.LocalIdentity == nil || r.RemoteIdentity == nil {
+		return "", errors.New("key exchange must be completed")
+	}
+	return SafetyNumber(r.LocalIdentity, r.RemoteIdentity), nil
+}
+
+// MarkVerified records that the user has verified the safety number.
+func (r *UnreliableDoubleRatchetChannel) MarkVerified() error {
+	if r.RemoteIdentity == nil {
+		return errors.New("key exchange must be completed")
+	}
+	r.Verified = true
+	return nil
 }
 
 // ProcessChannelExchange consumes a serialized UnreliableDoubleRatchetChannelExchange
 // and uses it to connection spool channels and ratchet channels so that our
-// UnreliableDoubleRatchetChannel is fully connected.
-func (r *UnreliableDoubleRatchetChannel) ProcessChannelExchange(cborExchange []byte) error {
+// UnreliableDoubleRatchetChannel is fully connected. The spool writer must
+// be signed by the given identity key of the remote party, or by the pinned
+// RemoteIdentityKey if it is nil. The identity key is pinned afterwards.
+func (r *UnreliableDoubleRatchetChannel) ProcessChannelExchange(cborExchange []byte, identity *eddsa.PublicKey) error {
 	exchange := new(UnreliableDoubleRatchetChannelExchange)
 	err := codec.NewDecoderBytes(cborExchange, cborHandle).Decode(exchange)
 	if err != nil {
 		return err
 	}
-	err = r.SpoolCh.WithRemoteWriter(exchange.SpoolWriter)
+	return r.processChannelExchange(exchange, identity)
+}
+
+// ProcessChannelExchangeText is like ProcessChannelExchange except that
+// it consumes the text encoding returned by ChannelExchangeText.
+func (r *UnreliableDoubleRatchetChannel) ProcessChannelExchangeText(text string, identity *eddsa.PublicKey) error {
+	exchange := new(UnreliableDoubleRatchetChannelExchange)
+	err := exchange.DecodeText(text)
 	if err != nil {
 		return err
 	}
-	err = r.Ratchet.ProcessKeyExchange(exchange.SignedKeyExchange)
+	return r.processChannelExchange(exchange, identity)
+}
+
+func (r *UnreliableDoubleRatchetChannel) processChannelExchange(exchange *UnreliableDoubleRatchetChannelExchange, identity *eddsa.PublicKey) error {
+	identity, err := expectedIdentity(identity, r.RemoteIdentityKey)
+	if err != nil {
+		return err
+	}
+	// everything is checked before the ratchet processes the key
+	// exchange, so that a rejected exchange leaves the channel as it was
+	if exchange.SpoolWriter == nil {
+		return errors.New("writer must not be nil")
+	}
+	if r.SpoolCh.writerChan != nil {
+		return errors.New("writerChan must be nil")
+	}
+	err = exchange.SpoolWriter.Verify(identity)
 	if err != nil {
 		return err
 	}
+	err = r.processRatchetExchange(exchange)
+	if err != nil {
+		return err
+	}
+	r.SpoolCh.writerChan = exchange.SpoolWriter
+	r.RemoteIdentityKey = identity
 	return nil
 }
 
+// exchangeSigner returns the identity key which signed the spool
+// writer of the given exchange, for the exchanges authenticated
+// by other means than a known identity key.
+func exchangeSigner(exchange *UnreliableDoubleRatchetChannelExchange) (*eddsa.PublicKey, error) {
+	if exchange.SpoolWriter == nil || exchange.SpoolWriter.Signature == nil {
+		return nil, errors.New("writer descriptor is not signed")
+	}
+	return exchange.SpoolWriter.Signature.Identity, nil
+}
+
+// padPayload prefixes the message with it's length and pads
+// it with zeros to the given payload length.
+func padPayload(message []byte, payloadLength int) ([]byte, error) {
+	if len(message) > payloadLength-4 {
+		return nil, errors.New("exceeds payload maximum")
+	}
+	payload := make([]byte, payloadLength)
+	binary.BigEndian.PutUint32(payload[:4], uint32(len(message)))
+	copy(payload[4:], message)
+	return payload, nil
+}
+
+// unpadPayload returns the message contained in a payload
+// created by padPayload.
+func unpadPayload(payload []byte) ([]byte, error) {
+	if len(payload) < 4 {
+		return nil, errors.New("payload is truncated")
+	}
+	payloadLen := binary.BigEndian.Uint32(payload[:4])
+	if payloadLen > uint32(len(payload)-4) {
+		return nil, errors.New("invalid payload length")
+	}
+	return payload[4 : 4+payloadLen], nil
+}
+
 // Write writes a message, encrypting it with the double ratchet and
 // sending the ciphertext to the remote spool.
 func (r *UnreliableDoubleRatchetChannel) Write(message []byte) error {
+	if err := r.sendDueTranscriptDigest(); err != nil {
+		return err
+	}
+	if r.Receipts != nil {
+		_, err := r.writeReceipted(message, true, false)
+		return err
+	}
+	return r.writeMessage(dataMessage, message)
+}
+
+// EnableReceipts makes our messages carry an ID and the receipts we
+// owe, the remote party answers them with delivery receipts.
+func (r *UnreliableDoubleRatchetChannel) EnableReceipts() {
+	if r.Receipts == nil {
+		r.Receipts = new(Receipts)
+	}
+}
+
+// WriteTracked writes a message and returns it's ID, which the status
+// of the message is queried with. If requestRead is set the remote
+// party is asked for a read receipt. Receipts must be enabled.
+func (r *UnreliableDoubleRatchetChannel) WriteTracked(message []byte, requestRead bool) (uint64, error) {
+	if r.Receipts == nil {
+		return 0, errors.New("receipts are not enabled")
+	}
+	if err := r.sendDueTranscriptDigest(); err != nil {
+		return 0, err
+	}
+	return r.writeReceipted(message, true, requestRead)
+}
+
+// FlushReceipts writes the receipts we owe, if any, in a message
+// of their own rather than along with our next message.
+func (r *UnreliableDoubleRatchetChannel) FlushReceipts() error {
+	if r.Receipts == nil || !r.Receipts.pending() {
+		return nil
+	}
+	_, err := r.writeReceipted(nil, false, false)
+	return err
+}
+
+func (r *UnreliableDoubleRatchetChannel) writeReceipted(message []byte, track, requestRead bool) (uint64, error) {
+	envelope, err := r.Receipts.envelope(message, track, requestRead, r.payloadLength()-doubleRatchetMessageOverhead)
+	if err != nil {
+		return 0, err
+	}
+	err = r.writeMessage(receiptMessage, envelope.encode())
+	if err != nil {
+		return 0, err
+	}
+	r.Receipts.sent(envelope)
+	return envelope.ID, nil
+}
+
+// SendTranscriptDigest writes the digest of our transcripts, the
+// remote party's Read returns a *TranscriptAlert if they diverged
+// from it's own. Digests are also written every
+// TranscriptDigestInterval messages.
+func (r *UnreliableDoubleRatchetChannel) SendTranscriptDigest() error {
+	digest, err := r.Transcript.digest()
+	if err != nil {
+		return err
+	}
+	err = r.writeMessage(transcriptMessage, digest)
+	if err != nil {
+		return err
+	}
+	r.Transcript.SinceDigest = 0
+	return nil
+}
+
+func (r *UnreliableDoubleRatchetChannel) sendDueTranscriptDigest() error {
+	if !r.Transcript.due() {
+		return nil
+	}
+	return r.SendTranscriptDigest()
+}
+
+// ReadWithGaps is like Read except that it also returns the gaps in
+// the remote party's messages detected since the last call.
+func (r *UnreliableDoubleRatchetChannel) ReadWithGaps() ([]byte, []MessageGap, error) {
+	message, err := r.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	return message, r.Sequence.TakeGaps(), nil
+}
+
+// ReadTracked is like Read except that it also returns the ID of the
+// message, which is zero unless the remote party enabled receipts.
+func (r *UnreliableDoubleRatchetChannel) ReadTracked() (uint64, []byte, error) {
+	if r.Receipts != nil {
+		r.Receipts.lastID = 0
+	}
+	message, err := r.Read()
+	if err != nil || r.Receipts == nil {
+		return 0, message, err
+	}
+	return r.Receipts.lastID, message, nil
+}
+
+// spoolBinding returns the binding of a message written to the destination
+// spool by the party reading from the source spool. The ratchet does not
+// take associated data, the binding is therefore encrypted along with the
+// message.
+func (r *UnreliableDoubleRatchetChannel) spoolBinding(destination, source *UnreliableSpoolWriterChannel) ([]byte, error) {
+	if destination == nil || source == nil {
+		return nil, errors.New("channel spools are not set")
+	}
+	return spoolBinding(doubleRatchetBindingLabel, destination, source), nil
+}
+
+// destination returns the spool our messages are written to.
+func (r *UnreliableDoubleRatchetChannel) destination() *UnreliableSpoolWriterChannel {
+	if r.RemoteInbox != nil {
+		return r.RemoteInbox.SpoolWriter
+	}
+	return r.SpoolCh.writerChan
+}
+
+// payloadLength returns the length of the payloads we encrypt, room
+// is left for the tag if we write to the remote party's SharedInbox and
+// for the stamp if the spool written to requires one.
+func (r *UnreliableDoubleRatchetChannel) payloadLength() int {
+	length := DoubleRatchetPayloadLength
+	if destination := r.destination(); destination != nil {
+		length -= SpoolPayloadLength - destination.PayloadLength()
+	}
+	if r.RemoteInbox != nil {
+		length -= InboxTagLength
+	}
+	return length
+}
+
+// writeCiphertext writes to the remote spool, or to the
+// remote party's SharedInbox if our channel was added to it.
+func (r *UnreliableDoubleRatchetChannel) writeCiphertext(ciphertext []byte) error {
+	if r.RemoteInbox != nil {
+		return r.RemoteInbox.write(r.SpoolCh.spoolService, ciphertext)
+	}
+	return r.SpoolCh.Write(ciphertext)
+}
+
+// writeMessage writes a message of the given type. The type is
+// encrypted along with the message so that control messages are
+// indistinguishable from data messages.
+func (r *UnreliableDoubleRatchetChannel) writeMessage(messageType byte, message []byte) error {
 	if r.SpoolCh == nil {
 		panic("spool channel must not be nil")
 	}
-	if len(message) > DoubleRatchetPayloadLength {
-		return errors.New("exceeds payload maximum")
+	binding, err := r.spoolBinding(r.destination(), r.SpoolCh.GetSpoolWriter())
+	if err != nil {
+		return err
+	}
+	header := append([]byte{messageType}, binding...)
+	sequence := r.Sequence.next()
+	header = append(header, sequence...)
+	payload, err := padPayload(append(header, message...), r.payloadLength())
+	if err != nil {
+		return err
 	}
-	payload := [DoubleRatchetPayloadLength]byte{}
-	binary.BigEndian.PutUint32(payload[:4], uint32(len(message)))
-	copy(payload[4:], message)
-	ciphertext := r.Ratchet.Encrypt(nil, payload[:])
-	return r.SpoolCh.Write(ciphertext[:])
+	ciphertext, err := r.encrypt(payload)
+	if err != nil {
+		return err
+	}
+	mac, err := r.identityMAC(ciphertext, r.destination(), r.SpoolCh.GetSpoolWriter())
+	if err != nil {
+		return err
+	}
+	err = r.writeCiphertext(append(ciphertext, mac...))
+	if err != nil {
+		return err
+	}
+	r.Transcript.sent(sequence, messageType, message)
+	return nil
+}
+
+// identityKey derives a key of the given label for the messages written
+// from the source spool to the destination spool, from the
+// Diffie-Hellman of our ratchet identity key and the remote one. Unlike
+// the ratchet's keys it is known to both parties even if the ratchet is
+// desynchronized, and to nobody else.
+func (r *UnreliableDoubleRatchetChannel) identityKey(label string, destination, source *UnreliableSpoolWriterChannel) (*[32]byte, error) {
+	var dh []byte
+	var err error
+	switch r.Mode {
+	case SignedKeyExchangeMode:
+		if r.Ratchet == nil || r.RemoteIdentity == nil {
+			return nil, errors.New("ratchet is not established")
+		}
+		dh, err = x25519(r.Ratchet.MyIdentityPrivate[:], r.Ratchet.TheirIdentityPublic[:])
+	case DeniableKeyExchangeMode:
+		if r.DeniableRatchet == nil || r.RemoteIdentity == nil {
+			return nil, errors.New("ratchet is not established")
+		}
+		dh, err = x25519(r.DeniableRatchet.IdentityPrivate, r.RemoteIdentity)
+	default:
+		return nil, errors.New("invalid key exchange mode")
+	}
+	if err != nil {
+		return nil, err
+	}
+	binding, err := r.spoolBinding(destination, source)
+	if err != nil {
+		return nil, err
+	}
+	key := new([32]byte)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dh, binding, []byte(label)), key[:]); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// identityMAC returns the MAC of a ratchet ciphertext written from
+// the source spool to the destination spool.
+func (r *UnreliableDoubleRatchetChannel) identityMAC(ciphertext []byte, destination, source *UnreliableSpoolWriterChannel) ([]byte, error) {
+	key, err := r.identityKey(identityMACLabel, destination, source)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(ciphertext)
+	return mac.Sum(nil)[:identityMACLength], nil
+}
+
+// openIdentityMAC returns the ratchet ciphertext of an entry read
+// from the given spool if it's MAC shows the remote party wrote it.
+func (r *UnreliableDoubleRatchetChannel) openIdentityMAC(entry []byte, spool *UnreliableSpoolWriterChannel) ([]byte, bool) {
+	if len(entry) < identityMACLength {
+		return nil, false
+	}
+	ciphertext := entry[:len(entry)-identityMACLength]
+	mac, err := r.identityMAC(ciphertext, spool, r.SpoolCh.writerChan)
+	if err != nil || !hmac.Equal(mac, entry[len(ciphertext):]) {
+		return nil, false
+	}
+	return ciphertext, true
+}
+
+func (r *UnreliableDoubleRatchetChannel) encrypt(payload []byte) ([]byte, error) {
+	if r.Mode == DeniableKeyExchangeMode {
+		return r.DeniableRatchet.Encrypt(payload)
+	}
+	return r.Ratchet.Encrypt(nil, payload), nil
+}
+
+func (r *UnreliableDoubleRatchetChannel) decrypt(ciphertext []byte) ([]byte, error) {
+	if r.Mode == DeniableKeyExchangeMode {
+		return r.DeniableRatchet.Decrypt(ciphertext)
+	}
+	return r.Ratchet.Decrypt(ciphertext)
 }
 
 // Read reads ciphertext from a remote spool and decypts
-// it with the double ratchet.
+// it with the double ratchet. Control messages are processed
+// and the next message is read in their place. ErrSessionReset
+// is returned once the session was reset.
 func (r *UnreliableDoubleRatchetChannel) Read() ([]byte, error) {
-	ciphertext, err := r.SpoolCh.Read()
+	return skipGarbage(r.SkipGarbage, &r.SkippedEntries, r.readMessage)
+}
+
+func (r *UnreliableDoubleRatchetChannel) readMessage() ([]byte, error) {
+	if r.PendingInvitation != nil {
+		return r.readInvitationReply()
+	}
+	entry, err := r.SpoolCh.Read()
 	if err != nil {
 		return nil, err
 	}
-	plaintext, err := r.Ratchet.Decrypt(ciphertext)
+	ciphertext, ok := r.openIdentityMAC(entry, r.SpoolCh.GetSpoolWriter())
+	if !ok {
+		if reset, ok := r.openSessionReset(entry, r.SpoolCh.GetSpoolWriter()); ok {
+			if err := r.processSessionReset(reset); err != nil {
+				return nil, err
+			}
+			return r.Read()
+		}
+		return nil, &garbageError{errors.New("message failed to authenticate")}
+	}
+	plaintext, err := r.decrypt(ciphertext)
+	if err != nil {
+		if failErr := r.decryptFailed(err); failErr != err {
+			return nil, failErr
+		}
+		return nil, &garbageError{err}
+	}
+	r.DecryptFailures = 0
+	messageType, body, err := r.openPayload(plaintext, r.SpoolCh.GetSpoolWriter())
 	if err != nil {
 		return nil, err
 	}
-	payloadLen := binary.BigEndian.Uint32(plaintext[:4])
-	return plaintext[4 : 4+payloadLen], nil
+	message, isData, err := r.processMessage(messageType, body)
+	if err != nil || isData {
+		return message, err
+	}
+	return r.Read()
+}
+
+// processMessage returns the message carried by a payload of the given
+// type. Control messages are processed and false returned.
+func (r *UnreliableDoubleRatchetChannel) processMessage(messageType byte, body []byte) ([]byte, bool, error) {
+	switch messageType {
+	case dataMessage:
+		return body, true, nil
+	case receiptMessage:
+		if r.Receipts == nil {
+			r.Receipts = new(Receipts)
+		}
+		return r.Receipts.open(body)
+	}
+	return nil, false, r.processControlMessage(messageType, body)
+}
+
+// openPayload returns the message type and body of a decrypted
+// payload which must be bound to the given spool it was read from, and
+// records it's sequence number.
+func (r *UnreliableDoubleRatchetChannel) openPayload(plaintext []byte, spool *UnreliableSpoolWriterChannel) (byte, []byte, error) {
+	message, err := unpadPayload(plaintext)
+	if err != nil {
+		return 0, nil, err
+	}
+	headerLength := 1 + spoolBindingLength + sequenceLength
+	if len(message) < headerLength {
+		return 0, nil, errors.New("message header is truncated")
+	}
+	messageType, binding, body := message[0], message[1:1+spoolBindingLength], message[headerLength:]
+	expected, err := r.spoolBinding(spool, r.SpoolCh.writerChan)
+	if err != nil {
+		return 0, nil, err
+	}
+	if subtle.ConstantTimeCompare(binding, expected) != 1 {
+		return 0, nil, &garbageError{errors.New("message is bound to another spool")}
+	}
+	r.Sequence.received(message[1+spoolBindingLength : headerLength])
+	r.Transcript.received(message[1+spoolBindingLength:headerLength], messageType, body)
+	return messageType, body, nil
+}
+
+// processControlMessage processes a message of any type but dataMessage
+// and receiptMessage.
+func (r *UnreliableDoubleRatchetChannel) processControlMessage(messageType byte, body []byte) error {
+	switch messageType {
+	case introductionRequestMessage, introductionReplyMessage, introductionOfferMessage:
+		return r.processIntroductionMessage(messageType, body)
+	case inboxMessage:
+		return r.processInboxMessage(body)
+	case groupSenderKeyMessage:
+		return r.processGroupSenderKey(body)
+	case transcriptMessage:
+		return r.Transcript.processDigest(body)
+	default:
+		return fmt.Errorf("unknown message type: %d", messageType)
+	}
 }
 
 // Save returns the serialization of this channel suitable to
@@ -18,6 +18,7 @@ package channels
 
 import (
 	"testing"
+	"time"
 
 	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/memspool/common"
@@ -40,9 +41,9 @@ func TestSimpleDoubleExchangeRatchet(t *testing.T) {
 	exchangeB, err := ratchetChanB.ChannelExchange()
 	assert.NoError(err)
 
-	err = ratchetChanB.ProcessChannelExchange(exchangeA)
+	err = ratchetChanB.ProcessChannelExchange(exchangeA, ratchetChanA.IdentityPrivateKey.PublicKey())
 	assert.NoError(err)
-	err = ratchetChanA.ProcessChannelExchange(exchangeB)
+	err = ratchetChanA.ProcessChannelExchange(exchangeB, ratchetChanB.IdentityPrivateKey.PublicKey())
 	assert.NoError(err)
 
 	msg1 := []byte(`At best, cryptography might be a tool for creating possibilities within contours
@@ -221,3 +222,130 @@ func TestDoubleRatchetPadding(t *testing.T) {
 		t.Fatal("ciphertext length must not exceed Sphinx packet payload maximum")
 	}
 }
+
+func TestDoubleRatchetSpoolBinding(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	ratchetChanA, ratchetChanB := newTestConnectedRatchetPair(t, "alice", "bob", spool)
+
+	// ratchetChanOtherB holds the same ratchet as ratchetChanB but reads
+	// from another spool.
+	serialized, err := ratchetChanB.Save()
+	assert.NoError(err)
+	ratchetChanOtherB, err := LoadUnreliableDoubleRatchetChannel(serialized, spool)
+	assert.NoError(err)
+	spoolCh, err := NewUnreliableSpoolChannel("receiver_bob", "provider_bob", spool)
+	assert.NoError(err)
+	assert.NoError(spoolCh.WithRemoteWriter(ratchetChanA.SpoolCh.GetSpoolWriter()))
+	ratchetChanOtherB.SpoolCh = spoolCh
+
+	msg := []byte("the Provider must not move this message")
+	assert.NoError(ratchetChanA.Write(msg))
+	ciphertext, err := ratchetChanB.SpoolCh.readerChan.Read(spool)
+	assert.NoError(err)
+	ratchetChanB.SpoolCh.readerChan.ReadOffset--
+
+	// the Provider replays the ciphertext into the other spool, the
+	// identity MAC is bound to the spools just like the payload
+	assert.NoError(spoolCh.GetSpoolWriter().Write(spool, ciphertext))
+	_, err = ratchetChanOtherB.Read()
+	assert.EqualError(err, "message failed to authenticate")
+	assert.Equal(0, ratchetChanOtherB.DecryptFailures)
+
+	msgRead, err := ratchetChanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+}
+
+func TestDoubleRatchetSkipGarbage(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	ratchetChanA, ratchetChanB := newTestConnectedRatchetPair(t, "alice", "bob", spool)
+	ratchetChanB.SkipGarbage = true
+	spoolWriter := ratchetChanB.SpoolCh.GetSpoolWriter()
+
+	assert.NoError(spoolWriter.Write(spool, []byte("junk")))
+	msg := []byte("hidden among junk")
+	assert.NoError(ratchetChanA.Write(msg))
+	msgRead, err := ratchetChanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+	assert.Equal(uint64(1), ratchetChanB.SkippedEntries)
+	assert.Equal(0, ratchetChanB.DecryptFailures)
+}
+
+func TestDoubleRatchetGarbageIsNotDesync(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	ratchetChanA, ratchetChanB := newTestConnectedRatchetPair(t, "alice", "bob", spool)
+	ratchetChanB.SkipGarbage = true
+	spoolWriter := ratchetChanB.SpoolCh.GetSpoolWriter()
+
+	// Junk does not count as desynchronization, it can not
+	// make Bob request a session reset.
+	for i := 0; i < 2*DesyncThreshold; i++ {
+		assert.NoError(spoolWriter.Write(spool, make([]byte, SpoolPayloadLength)))
+	}
+	msg := []byte("still in sync")
+	assert.NoError(ratchetChanA.Write(msg))
+	msgRead, err := ratchetChanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+	assert.Equal(0, ratchetChanB.DecryptFailures)
+	assert.Nil(ratchetChanB.PendingReset)
+
+	// Nor does reading past the end of the spool skip entries.
+	_, err = ratchetChanB.Read()
+	assert.Error(err)
+	assert.Equal(uint64(2*DesyncThreshold), ratchetChanB.SkippedEntries)
+}
+
+func TestDoubleRatchetExchangeSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestSpoolChannelPair(t)
+	chanA.writerChan = nil
+	chanB.writerChan = nil
+	ratchetChanA, err := NewUnreliableDoubleRatchetChannel(chanA)
+	assert.NoError(err)
+	ratchetChanB, err := NewUnreliableDoubleRatchetChannel(chanB)
+	assert.NoError(err)
+
+	exchange, err := ratchetChanA.channelExchange()
+	assert.NoError(err)
+	assert.NoError(exchange.SpoolWriter.Verify(ratchetChanA.IdentityPrivateKey.PublicKey()))
+
+	identityA := ratchetChanA.IdentityPrivateKey.PublicKey()
+
+	// a spool writer swapped by an attacker is refused
+	spoolID := exchange.SpoolWriter.SpoolID
+	exchange.SpoolWriter.SpoolID = chanB.GetSpoolWriter().SpoolID
+	assert.Error(ratchetChanB.processChannelExchange(exchange, identityA))
+	exchange.SpoolWriter.SpoolID = spoolID
+
+	// so are a self-signed forgery, an unsigned writer
+	// and an exchange lacking the expected identity key
+	exchange.SpoolWriter.Sign(ratchetChanB.IdentityPrivateKey, time.Hour)
+	assert.Error(ratchetChanB.processChannelExchange(exchange, identityA))
+	exchange.SpoolWriter.Signature = nil
+	assert.Error(ratchetChanB.processChannelExchange(exchange, identityA))
+
+	// a rejected key exchange leaves the channel as it was
+	exchange, err = ratchetChanA.channelExchange()
+	assert.NoError(err)
+	exchange.SignedKeyExchange = nil
+	assert.Error(ratchetChanB.processChannelExchange(exchange, identityA))
+	assert.Nil(ratchetChanB.SpoolCh.writerChan)
+	assert.Nil(ratchetChanB.RemoteIdentityKey)
+
+	exchangeA, err := ratchetChanA.ChannelExchange()
+	assert.NoError(err)
+	assert.Error(ratchetChanB.ProcessChannelExchange(exchangeA, nil))
+	assert.Nil(ratchetChanB.RemoteIdentityKey)
+
+	assert.NoError(ratchetChanB.ProcessChannelExchange(exchangeA, identityA))
+	assert.True(ratchetChanB.RemoteIdentityKey.Equal(identityA))
+}
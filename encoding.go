@@ -0,0 +1,372 @@
+// encoding.go - human transferable encodings of channel descriptors
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	ratchet "github.com/katzenpost/doubleratchet"
+	"github.com/katzenpost/memspool/common"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// DoubleRatchetExchangeTextPrefix is the prefix of the text encoding
+	// of an UnreliableDoubleRatchetChannelExchange.
+	DoubleRatchetExchangeTextPrefix = "KPDR:"
+
+	// NoiseWriterDescriptorTextPrefix is the prefix of the text encoding
+	// of a NoiseWriterDescriptor.
+	NoiseWriterDescriptorTextPrefix = "KPNW:"
+
+	// EncodingVersion is the version of the compact and text encodings.
+	EncodingVersion = 0
+
+	encodingHeaderLength   = 2 // version, type
+	encodingChecksumLength = 4
+
+	doubleRatchetExchangeType         = 1
+	noiseWriterDescriptorType         = 2
+	deniableDoubleRatchetExchangeType = 3
+)
+
+// The text encoding only uses upper case letters, digits and ':' so
+// that it fits the QR code alphanumeric mode as well as a clipboard.
+var textEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// compactSpoolWriter is the array encoded form of an UnreliableSpoolWriterChannel.
+type compactSpoolWriter struct {
+	_struct struct{} `codec:",toarray"`
+
+	SpoolID         []byte
+	SpoolReceiver   string
+	SpoolProvider   string
+	StampDifficulty uint8
+	Signature       *compactWriterSignature
+}
+
+// compactWriterSignature is the array encoded form of a WriterSignature.
+type compactWriterSignature struct {
+	_struct struct{} `codec:",toarray"`
+
+	Identity  []byte
+	NotAfter  int64
+	Signature []byte
+}
+
+func newCompactWriterSignature(s *WriterSignature) *compactWriterSignature {
+	if s == nil {
+		return nil
+	}
+	return &compactWriterSignature{
+		Identity:  s.Identity.Bytes(),
+		NotAfter:  s.NotAfter.Unix(),
+		Signature: s.Signature,
+	}
+}
+
+func (c *compactWriterSignature) writerSignature() (*WriterSignature, error) {
+	if c == nil {
+		return nil, nil
+	}
+	identity := new(eddsa.PublicKey)
+	if err := identity.FromBytes(c.Identity); err != nil {
+		return nil, err
+	}
+	return &WriterSignature{
+		Identity:  identity,
+		NotAfter:  time.Unix(c.NotAfter, 0).UTC(),
+		Signature: c.Signature,
+	}, nil
+}
+
+func newCompactSpoolWriter(w *UnreliableSpoolWriterChannel) compactSpoolWriter {
+	return compactSpoolWriter{
+		SpoolID:         w.SpoolID,
+		SpoolReceiver:   w.SpoolReceiver,
+		SpoolProvider:   w.SpoolProvider,
+		StampDifficulty: w.StampDifficulty,
+		Signature:       newCompactWriterSignature(w.Signature),
+	}
+}
+
+func (c *compactSpoolWriter) spoolWriter() (*UnreliableSpoolWriterChannel, error) {
+	if len(c.SpoolID) != common.SpoolIDSize {
+		return nil, errors.New("invalid spool ID length")
+	}
+	if c.SpoolReceiver == "" || c.SpoolProvider == "" {
+		return nil, errors.New("spool receiver and provider must not be empty")
+	}
+	if c.StampDifficulty > MaxStampDifficulty {
+		return nil, errors.New("stamp difficulty exceeds maximum")
+	}
+	signature, err := c.Signature.writerSignature()
+	if err != nil {
+		return nil, err
+	}
+	return &UnreliableSpoolWriterChannel{
+		SpoolID:         c.SpoolID,
+		SpoolReceiver:   c.SpoolReceiver,
+		SpoolProvider:   c.SpoolProvider,
+		StampDifficulty: c.StampDifficulty,
+		Signature:       signature,
+	}, nil
+}
+
+// compactDoubleRatchetExchange is the array encoded form of an
+// UnreliableDoubleRatchetChannelExchange.
+type compactDoubleRatchetExchange struct {
+	_struct struct{} `codec:",toarray"`
+
+	SpoolWriter compactSpoolWriter
+	Signed      []byte
+	Signature   []byte
+}
+
+// compactDeniableDoubleRatchetExchange is the array encoded form of an
+// UnreliableDoubleRatchetChannelExchange in DeniableKeyExchangeMode.
+type compactDeniableDoubleRatchetExchange struct {
+	_struct struct{} `codec:",toarray"`
+
+	SpoolWriter  compactSpoolWriter
+	IdentityKey  []byte
+	EphemeralKey []byte
+}
+
+// compactNoiseWriterDescriptor is the array encoded form of a
+// NoiseWriterDescriptor. The signature of the descriptor is carried
+// by SpoolWriter, whose spool writer is never signed on it's own.
+type compactNoiseWriterDescriptor struct {
+	_struct struct{} `codec:",toarray"`
+
+	SpoolWriter    compactSpoolWriter
+	NoisePublicKey []byte
+}
+
+func encodingChecksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:encodingChecksumLength]
+}
+
+// encodeCompact CBOR encodes the given value and frames it with
+// a version, a type and a checksum.
+func encodeCompact(encodingType byte, v interface{}) ([]byte, error) {
+	var body []byte
+	if err := codec.NewEncoderBytes(&body, cborHandle).Encode(v); err != nil {
+		return nil, err
+	}
+	serialized := append([]byte{EncodingVersion, encodingType}, body...)
+	return append(serialized, encodingChecksum(serialized)...), nil
+}
+
+// decodeCompact checks the framing of the given compact encoding
+// and decodes it into v. Trailing data and non-canonical encodings
+// are rejected.
+func decodeCompact(encodingType byte, data []byte, v interface{}) error {
+	if len(data) < encodingHeaderLength+encodingChecksumLength+1 {
+		return errors.New("compact encoding is truncated")
+	}
+	framed := data[:len(data)-encodingChecksumLength]
+	checksum := data[len(data)-encodingChecksumLength:]
+	if subtle.ConstantTimeCompare(encodingChecksum(framed), checksum) != 1 {
+		return errors.New("compact encoding checksum mismatch")
+	}
+	if framed[0] != EncodingVersion {
+		return fmt.Errorf("unsupported encoding version: %d", framed[0])
+	}
+	if framed[1] != encodingType {
+		return fmt.Errorf("unexpected encoding type: %d", framed[1])
+	}
+	body := framed[encodingHeaderLength:]
+	if err := codec.NewDecoderBytes(body, cborHandle).Decode(v); err != nil {
+		return err
+	}
+	var reencoded []byte
+	if err := codec.NewEncoderBytes(&reencoded, cborHandle).Encode(v); err != nil {
+		return err
+	}
+	if !bytes.Equal(body, reencoded) {
+		return errors.New("compact encoding is not canonical")
+	}
+	return nil
+}
+
+func encodeText(prefix string, compact []byte) string {
+	return prefix + textEncoding.EncodeToString(compact)
+}
+
+func decodeText(prefix, text string) ([]byte, error) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, prefix) {
+		return nil, fmt.Errorf("text encoding must begin with %q", prefix)
+	}
+	compact, err := textEncoding.DecodeString(text[len(prefix):])
+	if err != nil {
+		return nil, err
+	}
+	// base32 ignores the unused bits of the last character
+	if textEncoding.EncodeToString(compact) != text[len(prefix):] {
+		return nil, errors.New("text encoding is not canonical")
+	}
+	return compact, nil
+}
+
+// EncodeCompact returns the compact binary encoding of this exchange,
+// suitable for use in QR codes.
+func (e *UnreliableDoubleRatchetChannelExchange) EncodeCompact() ([]byte, error) {
+	if e.SpoolWriter != nil && e.DeniableKeyExchange != nil && e.SignedKeyExchange == nil {
+		return encodeCompact(deniableDoubleRatchetExchangeType, &compactDeniableDoubleRatchetExchange{
+			SpoolWriter:  newCompactSpoolWriter(e.SpoolWriter),
+			IdentityKey:  e.DeniableKeyExchange.IdentityKey,
+			EphemeralKey: e.DeniableKeyExchange.EphemeralKey,
+		})
+	}
+	if e.SpoolWriter == nil || e.SignedKeyExchange == nil || e.DeniableKeyExchange != nil {
+		return nil, errors.New("incomplete channel exchange")
+	}
+	return encodeCompact(doubleRatchetExchangeType, &compactDoubleRatchetExchange{
+		SpoolWriter: newCompactSpoolWriter(e.SpoolWriter),
+		Signed:      e.SignedKeyExchange.Signed,
+		Signature:   e.SignedKeyExchange.Signature,
+	})
+}
+
+// DecodeCompact decodes the given compact binary encoding into this exchange.
+func (e *UnreliableDoubleRatchetChannelExchange) DecodeCompact(data []byte) error {
+	if len(data) > encodingHeaderLength && data[1] == deniableDoubleRatchetExchangeType {
+		return e.decodeCompactDeniable(data)
+	}
+	c := new(compactDoubleRatchetExchange)
+	if err := decodeCompact(doubleRatchetExchangeType, data, c); err != nil {
+		return err
+	}
+	if len(c.Signed) == 0 || len(c.Signature) == 0 {
+		return errors.New("incomplete signed key exchange")
+	}
+	spoolWriter, err := c.SpoolWriter.spoolWriter()
+	if err != nil {
+		return err
+	}
+	e.SpoolWriter = spoolWriter
+	e.SignedKeyExchange = &ratchet.SignedKeyExchange{
+		Signed:    c.Signed,
+		Signature: c.Signature,
+	}
+	return nil
+}
+
+func (e *UnreliableDoubleRatchetChannelExchange) decodeCompactDeniable(data []byte) error {
+	c := new(compactDeniableDoubleRatchetExchange)
+	if err := decodeCompact(deniableDoubleRatchetExchangeType, data, c); err != nil {
+		return err
+	}
+	if len(c.IdentityKey) != keyLength || len(c.EphemeralKey) != keyLength {
+		return errors.New("invalid deniable key exchange")
+	}
+	spoolWriter, err := c.SpoolWriter.spoolWriter()
+	if err != nil {
+		return err
+	}
+	e.SpoolWriter = spoolWriter
+	e.DeniableKeyExchange = &DeniableKeyExchange{
+		IdentityKey:  c.IdentityKey,
+		EphemeralKey: c.EphemeralKey,
+	}
+	return nil
+}
+
+// EncodeText returns the checksummed text encoding of this exchange
+// which users may copy and paste.
+func (e *UnreliableDoubleRatchetChannelExchange) EncodeText() (string, error) {
+	compact, err := e.EncodeCompact()
+	if err != nil {
+		return "", err
+	}
+	return encodeText(DoubleRatchetExchangeTextPrefix, compact), nil
+}
+
+// DecodeText decodes the given text encoding into this exchange.
+func (e *UnreliableDoubleRatchetChannelExchange) DecodeText(text string) error {
+	compact, err := decodeText(DoubleRatchetExchangeTextPrefix, text)
+	if err != nil {
+		return err
+	}
+	return e.DecodeCompact(compact)
+}
+
+// EncodeCompact returns the compact binary encoding of this descriptor,
+// suitable for use in QR codes.
+func (d *NoiseWriterDescriptor) EncodeCompact() ([]byte, error) {
+	if d.SpoolWriterChan == nil || d.RemoteNoisePublicKey == nil {
+		return nil, errors.New("incomplete noise writer descriptor")
+	}
+	spoolWriter := newCompactSpoolWriter(d.SpoolWriterChan)
+	spoolWriter.Signature = newCompactWriterSignature(d.Signature)
+	return encodeCompact(noiseWriterDescriptorType, &compactNoiseWriterDescriptor{
+		SpoolWriter:    spoolWriter,
+		NoisePublicKey: d.RemoteNoisePublicKey.Bytes(),
+	})
+}
+
+// DecodeCompact decodes the given compact binary encoding into this descriptor.
+func (d *NoiseWriterDescriptor) DecodeCompact(data []byte) error {
+	c := new(compactNoiseWriterDescriptor)
+	if err := decodeCompact(noiseWriterDescriptorType, data, c); err != nil {
+		return err
+	}
+	spoolWriter, err := c.SpoolWriter.spoolWriter()
+	if err != nil {
+		return err
+	}
+	noisePublicKey := new(ecdh.PublicKey)
+	if err := noisePublicKey.FromBytes(c.NoisePublicKey); err != nil {
+		return err
+	}
+	d.Signature = spoolWriter.Signature
+	spoolWriter.Signature = nil
+	d.SpoolWriterChan = spoolWriter
+	d.RemoteNoisePublicKey = noisePublicKey
+	return nil
+}
+
+// EncodeText returns the checksummed text encoding of this descriptor
+// which users may copy and paste.
+func (d *NoiseWriterDescriptor) EncodeText() (string, error) {
+	compact, err := d.EncodeCompact()
+	if err != nil {
+		return "", err
+	}
+	return encodeText(NoiseWriterDescriptorTextPrefix, compact), nil
+}
+
+// DecodeText decodes the given text encoding into this descriptor.
+func (d *NoiseWriterDescriptor) DecodeText(text string) error {
+	compact, err := decodeText(NoiseWriterDescriptorTextPrefix, text)
+	if err != nil {
+		return err
+	}
+	return d.DecodeCompact(compact)
+}
@@ -0,0 +1,170 @@
+// encoding_test.go - human transferable encoding tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoubleRatchetExchangeText(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestSpoolChannelPair(t)
+	chanA.writerChan = nil
+	chanB.writerChan = nil
+	ratchetChanA, err := NewUnreliableDoubleRatchetChannel(chanA)
+	assert.NoError(err)
+	ratchetChanB, err := NewUnreliableDoubleRatchetChannel(chanB)
+	assert.NoError(err)
+
+	exchangeA, err := ratchetChanA.ChannelExchangeText()
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(exchangeA, DoubleRatchetExchangeTextPrefix))
+	exchangeB, err := ratchetChanB.ChannelExchangeText()
+	assert.NoError(err)
+
+	err = ratchetChanB.ProcessChannelExchangeText(exchangeA, ratchetChanA.IdentityPrivateKey.PublicKey())
+	assert.NoError(err)
+	err = ratchetChanA.ProcessChannelExchangeText(" "+exchangeB+"\n", ratchetChanB.IdentityPrivateKey.PublicKey())
+	assert.NoError(err)
+
+	msg1 := []byte("We kill people based on metadata.")
+	err = ratchetChanA.Write(msg1)
+	assert.NoError(err)
+
+	msg1Read, err := ratchetChanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg1, msg1Read)
+}
+
+func TestDoubleRatchetExchangeCompact(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, _ := newTestSpoolChannelPair(t)
+	ratchetChanA, err := NewUnreliableDoubleRatchetChannel(chanA)
+	assert.NoError(err)
+
+	exchange, err := ratchetChanA.channelExchange()
+	assert.NoError(err)
+	compact, err := exchange.EncodeCompact()
+	assert.NoError(err)
+	cborExchange, err := ratchetChanA.ChannelExchange()
+	assert.NoError(err)
+	assert.True(len(compact) < len(cborExchange))
+
+	decoded := new(UnreliableDoubleRatchetChannelExchange)
+	err = decoded.DecodeCompact(compact)
+	assert.NoError(err)
+	assert.Equal(exchange.SpoolWriter, decoded.SpoolWriter)
+	assert.Equal(exchange.SignedKeyExchange.Signed, decoded.SignedKeyExchange.Signed)
+	assert.Equal(exchange.SignedKeyExchange.Signature, decoded.SignedKeyExchange.Signature)
+
+	// trailing data
+	err = decoded.DecodeCompact(append(compact, 0))
+	assert.Error(err)
+
+	// wrong type
+	descriptor := new(NoiseWriterDescriptor)
+	err = descriptor.DecodeCompact(compact)
+	assert.Error(err)
+
+	// another version
+	framed := append([]byte{EncodingVersion + 1}, compact[1:len(compact)-encodingChecksumLength]...)
+	err = decoded.DecodeCompact(append(framed, encodingChecksum(framed)...))
+	assert.EqualError(err, "unsupported encoding version: 1")
+}
+
+func TestNoiseWriterDescriptorText(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestNoiseChannelPair(t)
+
+	text, err := chanA.GetRemoteWriter().EncodeText()
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(text, NoiseWriterDescriptorTextPrefix))
+
+	descriptor := new(NoiseWriterDescriptor)
+	err = descriptor.DecodeText(text)
+	assert.NoError(err)
+	assert.Equal(chanA.GetRemoteWriter().SpoolWriterChan, descriptor.SpoolWriterChan)
+	assert.True(chanA.GetRemoteWriter().RemoteNoisePublicKey.Equal(descriptor.RemoteNoisePublicKey))
+
+	assert.NoError(chanB.WithRemoteWriter(descriptor, nil))
+	msg := []byte("Scientist or spy?")
+	err = chanB.Write(msg)
+	assert.NoError(err)
+	msgRead, err := chanA.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+}
+
+func TestSignedNoiseWriterDescriptorCompact(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, _ := newTestNoiseChannelPair(t)
+	identity, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	descriptor := chanA.GetRemoteWriter()
+	descriptor.Sign(identity, time.Hour)
+	compact, err := descriptor.EncodeCompact()
+	assert.NoError(err)
+
+	// the signature is carried once, by the descriptor
+	decoded := new(NoiseWriterDescriptor)
+	assert.NoError(decoded.DecodeCompact(compact))
+	assert.Nil(decoded.SpoolWriterChan.Signature)
+	assert.NoError(decoded.Verify(identity.PublicKey()))
+}
+
+func TestStrictTextDecoding(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, _ := newTestNoiseChannelPair(t)
+	text, err := chanA.GetRemoteWriter().EncodeText()
+	assert.NoError(err)
+
+	descriptor := new(NoiseWriterDescriptor)
+
+	// every single character substitution must be detected
+	body := []byte(text[len(NoiseWriterDescriptorTextPrefix):])
+	for i := range body {
+		tampered := make([]byte, len(body))
+		copy(tampered, body)
+		if tampered[i] == 'A' {
+			tampered[i] = 'B'
+		} else {
+			tampered[i] = 'A'
+		}
+		err = descriptor.DecodeText(NoiseWriterDescriptorTextPrefix + string(tampered))
+		assert.Error(err)
+	}
+
+	err = descriptor.DecodeText(DoubleRatchetExchangeTextPrefix + string(body))
+	assert.Error(err)
+	err = descriptor.DecodeText(NoiseWriterDescriptorTextPrefix + strings.ToLower(string(body)))
+	assert.Error(err)
+	err = descriptor.DecodeText(text[:len(text)-1])
+	assert.Error(err)
+	err = descriptor.DecodeText(NoiseWriterDescriptorTextPrefix)
+	assert.Error(err)
+}
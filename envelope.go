@@ -0,0 +1,256 @@
+// envelope.go - standard message envelope
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// EnvelopeIDLength is the length of the random message IDs.
+	EnvelopeIDLength = 16
+
+	// MaxContentTypeLength is the maximum length of a content type.
+	MaxContentTypeLength = 64
+
+	// EnvelopeOverhead is the maximum length of an encoded envelope
+	// besides it's body: the CBOR array header, the version, the ID,
+	// the timestamp, the content type, the reply-to ID and the body's
+	// length prefix.
+	EnvelopeOverhead = 1 + 1 + (1 + EnvelopeIDLength) + 9 + (2 + MaxContentTypeLength) + (1 + EnvelopeIDLength) + 5
+
+	// NoiseEnvelopeBodyLength is the maximum length of the body
+	// of an envelope written to an UnreliableNoiseChannel, less
+	// ReceiptHeaderLength if receipts are enabled and StampLength
+	// if the remote spool requires stamps. EnvelopeBodyLength
+	// returns the length for a given channel.
+	NoiseEnvelopeBodyLength = NoisePayloadLength - noiseMessageHeaderLength - EnvelopeOverhead
+
+	// DoubleRatchetEnvelopeBodyLength is the maximum length of the body
+	// of an envelope written to an UnreliableDoubleRatchetChannel, less
+	// ReceiptHeaderLength if receipts are enabled and InboxTagLength if
+	// it writes to the remote party's SharedInbox. EnvelopeBodyLength
+	// returns the length for a given channel.
+	DoubleRatchetEnvelopeBodyLength = DoubleRatchetPayloadLength - doubleRatchetMessageOverhead - EnvelopeOverhead
+
+	// ContentTypeText is the content type of UTF-8 text messages.
+	ContentTypeText = "text/plain"
+
+	envelopeVersion = 0
+)
+
+// Envelope is the standard envelope of the messages written to
+// channels, so that applications agree on how messages are identified,
+// dated, typed and replied to. It is encrypted along with the message.
+type Envelope struct {
+	// ID is a random message ID.
+	ID []byte
+
+	// Timestamp is the sender's clock when the envelope was
+	// created, it is encoded with millisecond precision.
+	Timestamp time.Time
+
+	// ContentType is a MIME type describing the body.
+	ContentType string
+
+	// ReplyTo is the ID of the message this message replies to, if any.
+	ReplyTo []byte
+
+	Body []byte
+
+	// ReceiptID is the ID the receipts of this envelope refer to, it is
+	// set by WriteEnvelope and ReadEnvelope if the channel uses receipts
+	// and is zero otherwise. It is local to the channel and not encoded.
+	ReceiptID uint64
+}
+
+// compactEnvelope is the array encoded form of an Envelope.
+type compactEnvelope struct {
+	_struct struct{} `codec:",toarray"`
+
+	Version     uint8
+	ID          []byte
+	Timestamp   int64
+	ContentType string
+	ReplyTo     []byte
+	Body        []byte
+}
+
+// NewEnvelope returns an envelope of the given body with a new ID.
+func NewEnvelope(contentType string, body []byte) (*Envelope, error) {
+	id, err := randomBytes(EnvelopeIDLength)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		ID:          id,
+		Timestamp:   time.Now().UTC().Truncate(time.Millisecond),
+		ContentType: contentType,
+		Body:        body,
+	}, nil
+}
+
+// NewReply returns an envelope replying to this envelope.
+func (e *Envelope) NewReply(contentType string, body []byte) (*Envelope, error) {
+	reply, err := NewEnvelope(contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	reply.ReplyTo = e.ID
+	return reply, nil
+}
+
+func (e *Envelope) validate() error {
+	if len(e.ID) != EnvelopeIDLength {
+		return errors.New("invalid envelope ID length")
+	}
+	if e.ReplyTo != nil && len(e.ReplyTo) != EnvelopeIDLength {
+		return errors.New("invalid reply-to ID length")
+	}
+	if len(e.ContentType) > MaxContentTypeLength {
+		return errors.New("content type exceeds maximum length")
+	}
+	if e.Timestamp.IsZero() {
+		return errors.New("envelope timestamp must be set")
+	}
+	return nil
+}
+
+// MarshalBinary returns the compact encoding of this envelope.
+func (e *Envelope) MarshalBinary() ([]byte, error) {
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+	var serialized []byte
+	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode(&compactEnvelope{
+		Version:     envelopeVersion,
+		ID:          e.ID,
+		Timestamp:   e.Timestamp.UnixNano() / int64(time.Millisecond),
+		ContentType: e.ContentType,
+		ReplyTo:     e.ReplyTo,
+		Body:        e.Body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+// UnmarshalBinary decodes the given compact encoding into this envelope.
+func (e *Envelope) UnmarshalBinary(data []byte) error {
+	c := new(compactEnvelope)
+	err := codec.NewDecoderBytes(data, cborHandle).Decode(c)
+	if err != nil {
+		return err
+	}
+	if c.Version != envelopeVersion {
+		return fmt.Errorf("unsupported envelope version: %d", c.Version)
+	}
+	e.ID = c.ID
+	e.Timestamp = time.Unix(0, c.Timestamp*int64(time.Millisecond)).UTC()
+	e.ContentType = c.ContentType
+	e.ReplyTo = c.ReplyTo
+	e.Body = c.Body
+	return e.validate()
+}
+
+// EnvelopeBodyLength returns the maximum length of the body of the
+// envelopes written to the remote party, which is shorter if receipts
+// are enabled or the remote spool requires stamps.
+func (n *UnreliableNoiseChannel) EnvelopeBodyLength() int {
+	length := n.maxMessageLength() - EnvelopeOverhead
+	if n.Receipts != nil {
+		length -= ReceiptHeaderLength
+	}
+	return length
+}
+
+// WriteEnvelope encodes and writes the given envelope and sets it's
+// ReceiptID if receipts are enabled.
+func (n *UnreliableNoiseChannel) WriteEnvelope(envelope *Envelope) error {
+	serialized, err := envelope.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if n.Receipts == nil {
+		envelope.ReceiptID = 0
+		return n.Write(serialized)
+	}
+	envelope.ReceiptID, err = n.WriteTracked(serialized, false)
+	return err
+}
+
+// ReadEnvelope reads and decodes an envelope, it's ReceiptID is
+// set if the remote party enabled receipts.
+func (n *UnreliableNoiseChannel) ReadEnvelope() (*Envelope, error) {
+	id, serialized, err := n.ReadTracked()
+	if err != nil {
+		return nil, err
+	}
+	envelope := new(Envelope)
+	if err := envelope.UnmarshalBinary(serialized); err != nil {
+		return nil, err
+	}
+	envelope.ReceiptID = id
+	return envelope, nil
+}
+
+// EnvelopeBodyLength returns the maximum length of the body of the
+// envelopes written to the remote party, which is shorter if receipts
+// are enabled, we write to the remote party's SharedInbox or the
+// remote spool requires stamps.
+func (r *UnreliableDoubleRatchetChannel) EnvelopeBodyLength() int {
+	length := r.payloadLength() - doubleRatchetMessageOverhead - EnvelopeOverhead
+	if r.Receipts != nil {
+		length -= ReceiptHeaderLength
+	}
+	return length
+}
+
+// WriteEnvelope encodes and writes the given envelope and sets it's
+// ReceiptID if receipts are enabled.
+func (r *UnreliableDoubleRatchetChannel) WriteEnvelope(envelope *Envelope) error {
+	serialized, err := envelope.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if r.Receipts == nil {
+		envelope.ReceiptID = 0
+		return r.Write(serialized)
+	}
+	envelope.ReceiptID, err = r.WriteTracked(serialized, false)
+	return err
+}
+
+// ReadEnvelope reads and decodes an envelope, it's ReceiptID is
+// set if the remote party enabled receipts.
+func (r *UnreliableDoubleRatchetChannel) ReadEnvelope() (*Envelope, error) {
+	id, serialized, err := r.ReadTracked()
+	if err != nil {
+		return nil, err
+	}
+	envelope := new(Envelope)
+	if err := envelope.UnmarshalBinary(serialized); err != nil {
+		return nil, err
+	}
+	envelope.ReceiptID = id
+	return envelope, nil
+}
@@ -0,0 +1,115 @@
+// envelope_test.go - message envelope tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelopeEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	envelope, err := NewEnvelope(ContentTypeText, []byte("hello"))
+	assert.NoError(err)
+	reply, err := envelope.NewReply(strings.Repeat("x", MaxContentTypeLength), make([]byte, 1000))
+	assert.NoError(err)
+	assert.Equal(envelope.ID, reply.ReplyTo)
+
+	serialized, err := reply.MarshalBinary()
+	assert.NoError(err)
+	assert.True(len(serialized) <= len(reply.Body)+EnvelopeOverhead)
+	decoded := new(Envelope)
+	assert.NoError(decoded.UnmarshalBinary(serialized))
+	assert.Equal(reply, decoded)
+
+	serialized, err = envelope.MarshalBinary()
+	assert.NoError(err)
+	decoded = new(Envelope)
+	assert.NoError(decoded.UnmarshalBinary(serialized))
+	assert.Equal(envelope, decoded)
+	assert.Nil(decoded.ReplyTo)
+
+	envelope.ContentType = strings.Repeat("x", MaxContentTypeLength+1)
+	_, err = envelope.MarshalBinary()
+	assert.Error(err)
+	envelope.ContentType = ContentTypeText
+	envelope.ReplyTo = []byte("short")
+	_, err = envelope.MarshalBinary()
+	assert.Error(err)
+	envelope.ReplyTo = nil
+	envelope.Timestamp = time.Time{}
+	_, err = envelope.MarshalBinary()
+	assert.EqualError(err, "envelope timestamp must be set")
+	assert.Error(decoded.UnmarshalBinary([]byte("not an envelope")))
+}
+
+func TestChannelEnvelopes(t *testing.T) {
+	assert := assert.New(t)
+
+	// envelopes of the maximum body length fit
+	chanA, chanB := newTestNoiseChannelPair(t)
+	assert.Equal(NoiseEnvelopeBodyLength, chanA.EnvelopeBodyLength())
+	envelope, err := NewEnvelope(strings.Repeat("x", MaxContentTypeLength), make([]byte, NoiseEnvelopeBodyLength))
+	assert.NoError(err)
+	envelope.ReplyTo = envelope.ID
+	assert.NoError(chanA.WriteEnvelope(envelope))
+	assert.Equal(uint64(0), envelope.ReceiptID)
+	read, err := chanB.ReadEnvelope()
+	assert.NoError(err)
+	assert.Equal(envelope, read)
+
+	// receipts take room from the body, the envelope
+	// carries the ID the receipts refer to
+	chanA.EnableReceipts()
+	assert.Error(chanA.WriteEnvelope(envelope))
+	envelope.Body = make([]byte, chanA.EnvelopeBodyLength())
+	assert.NoError(chanA.WriteEnvelope(envelope))
+	assert.NotEqual(uint64(0), envelope.ReceiptID)
+	read, err = chanB.ReadEnvelope()
+	assert.NoError(err)
+	assert.Equal(envelope, read)
+	assert.NoError(chanB.FlushReceipts())
+	_, err = chanA.Read()
+	assert.Equal(ErrNoMessage, err)
+	status, err := chanA.Receipts.Status(envelope.ReceiptID)
+	assert.NoError(err)
+	assert.Equal(MessageDelivered, status)
+
+	ratchetChanA, ratchetChanB := newTestConnectedRatchetPair(t, "alice", "bob", newMockRemoteSpool())
+	ratchetChanA.EnableReceipts()
+	assert.Equal(DoubleRatchetEnvelopeBodyLength-ReceiptHeaderLength, ratchetChanA.EnvelopeBodyLength())
+	envelope, err = NewEnvelope(strings.Repeat("x", MaxContentTypeLength), make([]byte, ratchetChanA.EnvelopeBodyLength()))
+	assert.NoError(err)
+	envelope.ReplyTo = envelope.ID
+	assert.NoError(ratchetChanA.WriteEnvelope(envelope))
+	assert.NotEqual(uint64(0), envelope.ReceiptID)
+	read, err = ratchetChanB.ReadEnvelope()
+	assert.NoError(err)
+	assert.Equal(envelope, read)
+
+	reply, err := read.NewReply(ContentTypeText, []byte("thanks"))
+	assert.NoError(err)
+	assert.NoError(ratchetChanB.WriteEnvelope(reply))
+	read, err = ratchetChanA.ReadEnvelope()
+	assert.NoError(err)
+	assert.Equal(envelope.ID, read.ReplyTo)
+	assert.Equal([]byte("thanks"), read.Body)
+}
@@ -0,0 +1,509 @@
+// feed.go - one-to-many feed channel with delegated read capabilities
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/memspool/client"
+	"github.com/ugorji/go/codec"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// FeedPostLength is the length of the padded posts, room is left
+	// for the header, nonce, tag and signature of the feed entries.
+	FeedPostLength = SpoolPayloadLength - feedEntryHeaderLength - chacha20poly1305.NonceSizeX -
+		chacha20poly1305.Overhead - eddsa.SignatureSize
+
+	// feedEntryHeaderLength is the length of the entry type,
+	// epoch and sequence number heading each feed entry.
+	feedEntryHeaderLength = 1 + 4 + 8
+
+	feedIDLength           = 16
+	feedSubscriberIDLength = 16
+	feedBindingLabel       = "katzenpost channels feed"
+)
+
+// ErrFeedRevoked is returned by FeedSubscription.Read once
+// the feed's owner revoked our read capability.
+var ErrFeedRevoked = errors.New("feed read capability was revoked")
+
+// FeedReadCapability lets a subscriber read a feed. It holds the read
+// key of the spool the owner created for this subscriber alone, so that
+// no subscriber can purge the entries of another, and the content key.
+type FeedReadCapability struct {
+	Spool            *UnreliableSpoolReaderChannel
+	SigningPublicKey *eddsa.PublicKey
+	FeedID           []byte
+	ContentKey       []byte
+	Epoch            uint32
+
+	// SubscriberID identifies the subscriber to the feed's owner, the
+	// content key updates are encrypted with SubscriberKey.
+	SubscriberID  []byte
+	SubscriberKey []byte
+}
+
+// serializedFeedReadCapability has no methods so that encoding
+// it does not recurse into MarshalBinary.
+type serializedFeedReadCapability FeedReadCapability
+
+// MarshalBinary serializes this capability.
+func (c *FeedReadCapability) MarshalBinary() ([]byte, error) {
+	var serialized []byte
+	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode((*serializedFeedReadCapability)(c))
+	if err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+// UnmarshalBinary deserializes this capability.
+func (c *FeedReadCapability) UnmarshalBinary(data []byte) error {
+	err := codec.NewDecoderBytes(data, cborHandle).Decode((*serializedFeedReadCapability)(c))
+	if err != nil {
+		return err
+	}
+	if c.Spool == nil || c.SigningPublicKey == nil || len(c.FeedID) != feedIDLength ||
+		len(c.ContentKey) != chacha20poly1305.KeySize || len(c.SubscriberID) != feedSubscriberIDLength ||
+		len(c.SubscriberKey) != chacha20poly1305.KeySize {
+		return errors.New("incomplete feed read capability")
+	}
+	return nil
+}
+
+// FeedSubscriber is a subscriber a read capability was issued to, the
+// entries are written to it's spool. Epoch is the epoch of the last
+// content key written to the subscriber and Sequence the sequence
+// number of the last entry written to it.
+type FeedSubscriber struct {
+	ID          []byte
+	Key         []byte
+	SpoolWriter *UnreliableSpoolWriterChannel
+	Epoch       uint32
+	Sequence    uint64
+}
+
+// The feed entry types. A content key update has a ciphertext as long
+// as the one of a post, a revocation tells a subscriber that no more
+// entries will be written to it.
+const (
+	feedPostEntry byte = iota
+	feedKeyUpdateEntry
+	feedRevokedEntry
+)
+
+// feedEntry is a feed entry, it is encoded as the entry type, epoch
+// and sequence number followed by the ciphertext and the signature.
+type feedEntry struct {
+	Type       byte
+	Epoch      uint32
+	Sequence   uint64
+	Ciphertext []byte
+}
+
+// feedSignedData binds the signature of an entry to the spool of the
+// subscriber it was written to, so that it can not be copied into the
+// spool of another subscriber.
+func feedSignedData(spool *UnreliableSpoolWriterChannel, signed []byte) []byte {
+	return append(spoolBinding(feedBindingLabel, spool), signed...)
+}
+
+// feedAssociatedData binds the feed entries to the feed and epoch.
+func feedAssociatedData(feedID []byte, epoch uint32) []byte {
+	ad := append([]byte(feedBindingLabel), feedID...)
+	var rawEpoch [4]byte
+	binary.BigEndian.PutUint32(rawEpoch[:], epoch)
+	return append(ad, rawEpoch[:]...)
+}
+
+// feedSeal encrypts using a random nonce as keys encrypt many entries.
+func feedSeal(key, plaintext, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+func feedOpen(key, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("feed ciphertext is truncated")
+	}
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], ad)
+}
+
+// FeedChannel is the owner's end of a feed. The owner issues read
+// capabilities to the subscribers, each of which reads a spool of it's
+// own, and writes signed, encrypted posts to all of them. Revoking a
+// subscriber stops the writes to it's spool and rotates the content key.
+type FeedChannel struct {
+	spoolService client.SpoolService
+
+	FeedID            []byte
+	SpoolReceiver     string
+	SpoolProvider     string
+	SigningPrivateKey *eddsa.PrivateKey
+	ContentKey        []byte
+	Epoch             uint32
+	Subscribers       []*FeedSubscriber
+}
+
+// NewFeedChannel creates a new feed whose subscribers' spools
+// are created on the given Provider.
+func NewFeedChannel(spoolReceiver, spoolProvider string, spool client.SpoolService) (*FeedChannel, error) {
+	feedID, err := randomBytes(feedIDLength)
+	if err != nil {
+		return nil, err
+	}
+	signingPrivateKey, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	contentKey, err := randomBytes(chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return &FeedChannel{
+		spoolService:      spool,
+		FeedID:            feedID,
+		SpoolReceiver:     spoolReceiver,
+		SpoolProvider:     spoolProvider,
+		SigningPrivateKey: signingPrivateKey,
+		ContentKey:        contentKey,
+	}, nil
+}
+
+// LoadFeedChannel loads a saved FeedChannel and sets it's spoolService.
+func LoadFeedChannel(data []byte, spoolService client.SpoolService) (*FeedChannel, error) {
+	f := new(FeedChannel)
+	err := codec.NewDecoderBytes(data, cborHandle).Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	f.SetSpoolService(spoolService)
+	return f, nil
+}
+
+// SetSpoolService sets this feed's spoolService.
+func (f *FeedChannel) SetSpoolService(spoolService client.SpoolService) {
+	f.spoolService = spoolService
+}
+
+// Save returns the serialization of this feed.
+func (f *FeedChannel) Save() ([]byte, error) {
+	var serialized []byte
+	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode(f)
+	if err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+// IssueReadCapability creates a spool for a new subscriber and issues
+// a read capability for it, the subscriber reads the entries written
+// from now on.
+func (f *FeedChannel) IssueReadCapability() (*FeedReadCapability, error) {
+	id, err := randomBytes(feedSubscriberIDLength)
+	if err != nil {
+		return nil, err
+	}
+	key, err := randomBytes(chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	spoolReader, err := NewUnreliableSpoolReaderChannel(f.SpoolReceiver, f.SpoolProvider, f.spoolService)
+	if err != nil {
+		return nil, err
+	}
+	f.Subscribers = append(f.Subscribers, &FeedSubscriber{
+		ID:          id,
+		Key:         key,
+		SpoolWriter: spoolReader.GetSpoolWriter(),
+		Epoch:       f.Epoch,
+	})
+	return &FeedReadCapability{
+		Spool:            spoolReader,
+		SigningPublicKey: f.SigningPrivateKey.PublicKey(),
+		FeedID:           f.FeedID,
+		ContentKey:       f.ContentKey,
+		Epoch:            f.Epoch,
+		SubscriberID:     id,
+		SubscriberKey:    key,
+	}, nil
+}
+
+// Revoke stops writing to the subscriber with the given ID, tells it
+// so and rotates the content key. The subscriber is removed even if
+// writing to the remaining subscribers fails, the content key updates
+// they missed are written again by the next Write.
+func (f *FeedChannel) Revoke(subscriberID []byte) error {
+	for i, subscriber := range f.Subscribers {
+		if !bytes.Equal(subscriber.ID, subscriberID) {
+			continue
+		}
+		contentKey, err := randomBytes(chacha20poly1305.KeySize)
+		if err != nil {
+			return err
+		}
+		f.Subscribers = append(f.Subscribers[:i], f.Subscribers[i+1:]...)
+		f.ContentKey = contentKey
+		f.Epoch++
+		revokeErr := f.writeEntry(subscriber, &feedEntry{
+			Type:  feedRevokedEntry,
+			Epoch: f.Epoch,
+		})
+		if err := subscriberFailures(f.writeKeyUpdates(), len(f.Subscribers)); err != nil {
+			return err
+		}
+		return revokeErr
+	}
+	return errors.New("no such subscriber")
+}
+
+// RotateContentKey writes a new content key to each subscriber and
+// encrypts the following posts with it. The content key updates
+// which failed to be written are written again by the next Write.
+func (f *FeedChannel) RotateContentKey() error {
+	contentKey, err := randomBytes(chacha20poly1305.KeySize)
+	if err != nil {
+		return err
+	}
+	f.ContentKey = contentKey
+	f.Epoch++
+	return subscriberFailures(f.writeKeyUpdates(), len(f.Subscribers))
+}
+
+// writeKeyUpdates writes the current content key to the subscribers
+// which lack it and returns the errors of those it failed to write to.
+// The key is padded as a post so that the updates can not be told from
+// the posts.
+func (f *FeedChannel) writeKeyUpdates() []error {
+	var failures []error
+	ad := feedAssociatedData(f.FeedID, f.Epoch)
+	for _, subscriber := range f.Subscribers {
+		if subscriber.Epoch == f.Epoch {
+			continue
+		}
+		err := f.writeKeyUpdate(subscriber, ad)
+		if err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		subscriber.Epoch = f.Epoch
+	}
+	return failures
+}
+
+func (f *FeedChannel) writeKeyUpdate(subscriber *FeedSubscriber, ad []byte) error {
+	payload, err := padPayload(f.ContentKey, FeedPostLength)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := feedSeal(subscriber.Key, payload, ad)
+	if err != nil {
+		return err
+	}
+	return f.writeEntry(subscriber, &feedEntry{
+		Type:       feedKeyUpdateEntry,
+		Epoch:      f.Epoch,
+		Ciphertext: ciphertext,
+	})
+}
+
+func subscriberFailures(failures []error, subscribers int) error {
+	if failures == nil {
+		return nil
+	}
+	return fmt.Errorf("failed to write to %d of %d subscribers: %s", len(failures), subscribers, failures[0])
+}
+
+// Write encrypts and writes a post to each subscriber's spool, after
+// the content key updates they missed. The subscribers still lacking
+// the current content key are skipped.
+func (f *FeedChannel) Write(message []byte) error {
+	payload, err := padPayload(message, FeedPostLength)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := feedSeal(f.ContentKey, payload, feedAssociatedData(f.FeedID, f.Epoch))
+	if err != nil {
+		return err
+	}
+	failures := f.writeKeyUpdates()
+	for _, subscriber := range f.Subscribers {
+		if subscriber.Epoch != f.Epoch {
+			continue
+		}
+		err := f.writeEntry(subscriber, &feedEntry{
+			Type:       feedPostEntry,
+			Epoch:      f.Epoch,
+			Ciphertext: ciphertext,
+		})
+		if err != nil {
+			failures = append(failures, err)
+		}
+	}
+	return subscriberFailures(failures, len(f.Subscribers))
+}
+
+// writeEntry signs and writes an entry with the subscriber's next
+// sequence number. The sequence number is used up even if the write
+// fails, the subscriber only requires them to increase.
+func (f *FeedChannel) writeEntry(subscriber *FeedSubscriber, entry *feedEntry) error {
+	subscriber.Sequence++
+	entry.Sequence = subscriber.Sequence
+	serialized := make([]byte, feedEntryHeaderLength, feedEntryHeaderLength+len(entry.Ciphertext)+eddsa.SignatureSize)
+	serialized[0] = entry.Type
+	binary.BigEndian.PutUint32(serialized[1:5], entry.Epoch)
+	binary.BigEndian.PutUint64(serialized[5:feedEntryHeaderLength], entry.Sequence)
+	serialized = append(serialized, entry.Ciphertext...)
+	serialized = append(serialized, f.SigningPrivateKey.Sign(feedSignedData(subscriber.SpoolWriter, serialized))...)
+	if len(serialized) > subscriber.SpoolWriter.PayloadLength() {
+		return errors.New("feed entry exceeds payload maximum")
+	}
+	return subscriber.SpoolWriter.Write(f.spoolService, serialized)
+}
+
+// FeedSubscription is a subscriber's end of a feed.
+type FeedSubscription struct {
+	spoolService client.SpoolService
+
+	Capability *FeedReadCapability
+
+	// Sequence is the sequence number of the last entry read, the
+	// entries which do not exceed it are replays.
+	Sequence uint64
+
+	// SkipGarbage makes Read skip spool entries which fail to
+	// authenticate rather than return an error.
+	SkipGarbage    bool
+	SkippedEntries uint64
+}
+
+// NewFeedSubscription creates a subscription using the given capability.
+func NewFeedSubscription(capability *FeedReadCapability, spool client.SpoolService) *FeedSubscription {
+	return &FeedSubscription{
+		spoolService: spool,
+		Capability:   capability,
+	}
+}
+
+// LoadFeedSubscription loads a saved FeedSubscription and sets it's spoolService.
+func LoadFeedSubscription(data []byte, spoolService client.SpoolService) (*FeedSubscription, error) {
+	s := new(FeedSubscription)
+	err := codec.NewDecoderBytes(data, cborHandle).Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	s.SetSpoolService(spoolService)
+	return s, nil
+}
+
+// SetSpoolService sets this subscription's spoolService.
+func (s *FeedSubscription) SetSpoolService(spoolService client.SpoolService) {
+	s.spoolService = spoolService
+}
+
+// Save returns the serialization of this subscription.
+func (s *FeedSubscription) Save() ([]byte, error) {
+	var serialized []byte
+	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode(s)
+	if err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+// Read reads the next post of the feed. Content key updates are
+// processed and the next post is read in their place.
+func (s *FeedSubscription) Read() ([]byte, error) {
+	return skipGarbage(s.SkipGarbage, &s.SkippedEntries, s.readPost)
+}
+
+func (s *FeedSubscription) readPost() ([]byte, error) {
+	c := s.Capability
+	for {
+		serialized, err := c.Spool.Read(s.spoolService)
+		if err != nil {
+			return nil, err
+		}
+		if len(serialized) < feedEntryHeaderLength+eddsa.SignatureSize {
+			return nil, &garbageError{errors.New("feed entry is truncated")}
+		}
+		signed, signature := serialized[:len(serialized)-eddsa.SignatureSize], serialized[len(serialized)-eddsa.SignatureSize:]
+		if !c.SigningPublicKey.Verify(signature, feedSignedData(c.Spool.GetSpoolWriter(), signed)) {
+			return nil, &garbageError{errors.New("invalid feed entry signature")}
+		}
+		entry := &feedEntry{
+			Type:       signed[0],
+			Epoch:      binary.BigEndian.Uint32(signed[1:5]),
+			Sequence:   binary.BigEndian.Uint64(signed[5:feedEntryHeaderLength]),
+			Ciphertext: signed[feedEntryHeaderLength:],
+		}
+		if entry.Sequence <= s.Sequence {
+			return nil, &garbageError{errors.New("replayed feed entry")}
+		}
+		s.Sequence = entry.Sequence
+		ad := feedAssociatedData(c.FeedID, entry.Epoch)
+		switch entry.Type {
+		case feedRevokedEntry:
+			return nil, ErrFeedRevoked
+		case feedKeyUpdateEntry:
+			if entry.Epoch <= c.Epoch {
+				// an update we already know of
+				continue
+			}
+			payload, err := feedOpen(c.SubscriberKey, entry.Ciphertext, ad)
+			if err != nil {
+				return nil, err
+			}
+			contentKey, err := unpadPayload(payload)
+			if err != nil || len(contentKey) != chacha20poly1305.KeySize {
+				return nil, errors.New("invalid feed content key update")
+			}
+			c.ContentKey = contentKey
+			c.Epoch = entry.Epoch
+			continue
+		case feedPostEntry:
+		default:
+			return nil, errors.New("unknown feed entry type")
+		}
+		if entry.Epoch != c.Epoch {
+			return nil, errors.New("feed post of another epoch")
+		}
+		payload, err := feedOpen(c.ContentKey, entry.Ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+		return unpadPayload(payload)
+	}
+}
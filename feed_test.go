@@ -0,0 +1,191 @@
+// feed_test.go - feed channel tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"testing"
+
+	"github.com/katzenpost/memspool/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeedChannel(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	feed, err := NewFeedChannel("receiver_feed", "provider_feed", spool)
+	assert.NoError(err)
+	assert.NoError(feed.Write([]byte("before anyone subscribed")))
+
+	capabilityA, err := feed.IssueReadCapability()
+	assert.NoError(err)
+	serialized, err := capabilityA.MarshalBinary()
+	assert.NoError(err)
+	capabilityA = new(FeedReadCapability)
+	assert.NoError(capabilityA.UnmarshalBinary(serialized))
+	capabilityB, err := feed.IssueReadCapability()
+	assert.NoError(err)
+	subscriberA := NewFeedSubscription(capabilityA, spool)
+	subscriberB := NewFeedSubscription(capabilityB, spool)
+
+	post1 := []byte("first post")
+	assert.NoError(feed.Write(post1))
+	msg, err := subscriberA.Read()
+	assert.NoError(err)
+	assert.Equal(post1, msg)
+	msg, err = subscriberB.Read()
+	assert.NoError(err)
+	assert.Equal(post1, msg)
+
+	// revoking B rotates the content key
+	assert.NoError(feed.Revoke(capabilityB.SubscriberID))
+	assert.Error(feed.Revoke(capabilityB.SubscriberID))
+	post2 := []byte("second post")
+	assert.NoError(feed.Write(post2))
+
+	serialized, err = subscriberA.Save()
+	assert.NoError(err)
+	subscriberA, err = LoadFeedSubscription(serialized, spool)
+	assert.NoError(err)
+	msg, err = subscriberA.Read()
+	assert.NoError(err)
+	assert.Equal(post2, msg)
+	assert.Equal(uint32(1), subscriberA.Capability.Epoch)
+
+	_, err = subscriberB.Read()
+	assert.Equal(ErrFeedRevoked, err)
+
+	serialized, err = feed.Save()
+	assert.NoError(err)
+	feed, err = LoadFeedChannel(serialized, spool)
+	assert.NoError(err)
+	post3 := []byte("third post")
+	assert.NoError(feed.Write(post3))
+	msg, err = subscriberA.Read()
+	assert.NoError(err)
+	assert.Equal(post3, msg)
+
+	// entries not signed by the owner are garbage
+	subscriberA.SkipGarbage = true
+	assert.NoError(capabilityA.Spool.GetSpoolWriter().Write(spool, []byte("junk")))
+	assert.NoError(feed.Write(post1))
+	msg, err = subscriberA.Read()
+	assert.NoError(err)
+	assert.Equal(post1, msg)
+	assert.Equal(uint64(1), subscriberA.SkippedEntries)
+
+	// each subscriber reads a spool of it's own
+	assert.NotEqual(capabilityA.Spool.SpoolID, capabilityB.Spool.SpoolID)
+}
+
+func TestFeedChannelManySubscribers(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	feed, err := NewFeedChannel("receiver_feed", "provider_feed", spool)
+	assert.NoError(err)
+	var subscribers []*FeedSubscription
+	for i := 0; i < 100; i++ {
+		capability, err := feed.IssueReadCapability()
+		assert.NoError(err)
+		subscribers = append(subscribers, NewFeedSubscription(capability, spool))
+	}
+	revoked := subscribers[0]
+	assert.NoError(feed.Revoke(revoked.Capability.SubscriberID))
+	assert.Len(feed.Subscribers, 99)
+	post := []byte("still small enough")
+	assert.NoError(feed.Write(post))
+
+	// the content key updates are as long as the posts
+	mock := spool.(*mockRemoteSpool)
+	spoolID := [common.SpoolIDSize]byte{}
+	copy(spoolID[:], subscribers[1].Capability.Spool.SpoolID)
+	assert.Len(mock.spool[spoolID], 2)
+	assert.Equal(len(mock.spool[spoolID][1]), len(mock.spool[spoolID][2]))
+
+	for _, subscriber := range subscribers[1:] {
+		msg, err := subscriber.Read()
+		assert.NoError(err)
+		assert.Equal(post, msg)
+	}
+	_, err = revoked.Read()
+	assert.Equal(ErrFeedRevoked, err)
+}
+
+func TestFeedChannelReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	feed, err := NewFeedChannel("receiver_feed", "provider_feed", spool)
+	assert.NoError(err)
+	capabilityA, err := feed.IssueReadCapability()
+	assert.NoError(err)
+	capabilityB, err := feed.IssueReadCapability()
+	assert.NoError(err)
+	subscriberA := NewFeedSubscription(capabilityA, spool)
+	subscriberB := NewFeedSubscription(capabilityB, spool)
+	subscriberA.SkipGarbage = true
+	subscriberB.SkipGarbage = true
+
+	// the longest post fills the spool payload
+	post1 := make([]byte, FeedPostLength-4)
+	assert.NoError(feed.Write(post1))
+	mock := spool.(*mockRemoteSpool)
+	spoolA := [common.SpoolIDSize]byte{}
+	copy(spoolA[:], capabilityA.Spool.SpoolID)
+	assert.Len(mock.spool[spoolA][1], SpoolPayloadLength)
+	msg, err := subscriberA.Read()
+	assert.NoError(err)
+	assert.Equal(post1, msg)
+
+	// polling at the end keeps the next entry
+	_, err = subscriberA.Read()
+	assert.Equal(ErrNoMessage, err)
+	post2 := []byte("second post")
+	assert.NoError(feed.Write(post2))
+	msg, err = subscriberA.Read()
+	assert.NoError(err)
+	assert.Equal(post2, msg)
+
+	// a replayed post is skipped
+	writerA := capabilityA.Spool.GetSpoolWriter()
+	assert.NoError(writerA.Write(spool, mock.spool[spoolA][1]))
+	_, err = subscriberA.Read()
+	assert.Equal(ErrNoMessage, err)
+	assert.Equal(uint64(1), subscriberA.SkippedEntries)
+
+	// the revocation of B can not be copied into the spool of A
+	assert.NoError(feed.Revoke(capabilityB.SubscriberID))
+	spoolB := [common.SpoolIDSize]byte{}
+	copy(spoolB[:], capabilityB.Spool.SpoolID)
+	revocation := mock.spool[spoolB][uint32(len(mock.spool[spoolB]))]
+	assert.NoError(writerA.Write(spool, revocation))
+	post3 := []byte("third post")
+	assert.NoError(feed.Write(post3))
+	msg, err = subscriberA.Read()
+	assert.NoError(err)
+	assert.Equal(post3, msg)
+	assert.Equal(uint64(2), subscriberA.SkippedEntries)
+
+	msg, err = subscriberB.Read()
+	assert.NoError(err)
+	assert.Equal(post1, msg)
+	_, err = subscriberB.Read()
+	assert.NoError(err)
+	_, err = subscriberB.Read()
+	assert.Equal(ErrFeedRevoked, err)
+}
@@ -0,0 +1,67 @@
+// fingerprint.go - safety numbers for verifying channel partners
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	// fingerprintIterations is the number of hash iterations used to
+	// make brute forcing a colliding fingerprint expensive.
+	fingerprintIterations = 5200
+	fingerprintChunks     = 6
+	fingerprintChunkLen   = 5
+	fingerprintVersion    = 0
+)
+
+// Fingerprint returns a stable thirty digit fingerprint of the
+// given public key material.
+func Fingerprint(publicKey []byte) string {
+	h := sha512.New()
+	h.Write([]byte{0, fingerprintVersion})
+	h.Write(publicKey)
+	digest := h.Sum(nil)
+	for i := 0; i < fingerprintIterations; i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(publicKey)
+		digest = h.Sum(digest[:0])
+	}
+	chunks := make([]string, fingerprintChunks)
+	for i := 0; i < fingerprintChunks; i++ {
+		chunk := make([]byte, 8)
+		copy(chunk[3:], digest[i*fingerprintChunkLen:(i+1)*fingerprintChunkLen])
+		chunks[i] = fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk)%100000)
+	}
+	return strings.Join(chunks, " ")
+}
+
+// SafetyNumber returns a sixty digit code derived from the public key
+// material of both channel partners. Both partners compute the same
+// safety number and may compare them out of band to verify each other.
+func SafetyNumber(localPublicKey, remotePublicKey []byte) string {
+	local := Fingerprint(localPublicKey)
+	remote := Fingerprint(remotePublicKey)
+	if local < remote {
+		return local + " " + remote
+	}
+	return remote + " " + local
+}
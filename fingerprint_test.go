@@ -0,0 +1,129 @@
+// fingerprint_test.go - safety number tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafetyNumber(t *testing.T) {
+	assert := assert.New(t)
+
+	keyA := []byte("alice public key")
+	keyB := []byte("bob public key")
+
+	number := SafetyNumber(keyA, keyB)
+	assert.Equal(number, SafetyNumber(keyB, keyA))
+	assert.Equal(number, SafetyNumber(keyA, keyB))
+	assert.NotEqual(number, SafetyNumber(keyA, []byte("mallory public key")))
+
+	groups := strings.Split(number, " ")
+	assert.Equal(12, len(groups))
+	for _, group := range groups {
+		assert.Equal(5, len(group))
+	}
+}
+
+func TestNoiseChannelSafetyNumber(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestNoiseChannelPair(t)
+
+	numberA, err := chanA.SafetyNumber()
+	assert.NoError(err)
+	numberB, err := chanB.SafetyNumber()
+	assert.NoError(err)
+	assert.Equal(numberA, numberB)
+
+	err = chanA.MarkVerified()
+	assert.NoError(err)
+
+	// verification persists across Save and Load
+	blob, err := chanA.Save()
+	assert.NoError(err)
+	chanC, err := LoadUnreliableNoiseChannel(blob, chanA.spoolService)
+	assert.NoError(err)
+	assert.True(chanC.Verified)
+
+	// setting the same remote writer again keeps the verification
+	assert.NoError(chanC.WithRemoteWriter(chanB.GetRemoteWriter(), nil))
+	assert.True(chanC.Verified)
+
+	// a changed remote key resets it
+	newKey, err := ecdh.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	descriptor := &NoiseWriterDescriptor{
+		SpoolWriterChan:      chanB.SpoolReaderChan.GetSpoolWriter(),
+		RemoteNoisePublicKey: newKey.PublicKey(),
+	}
+	descriptor.Sign(chanB.IdentityPrivateKey, time.Hour)
+	assert.NoError(chanC.WithRemoteWriter(descriptor, nil))
+	assert.False(chanC.Verified)
+	numberC, err := chanC.SafetyNumber()
+	assert.NoError(err)
+	assert.NotEqual(numberA, numberC)
+}
+
+func TestDoubleRatchetSafetyNumber(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestSpoolChannelPair(t)
+	chanA.writerChan = nil
+	chanB.writerChan = nil
+	ratchetChanA, err := NewUnreliableDoubleRatchetChannel(chanA)
+	assert.NoError(err)
+	ratchetChanB, err := NewUnreliableDoubleRatchetChannel(chanB)
+	assert.NoError(err)
+
+	_, err = ratchetChanA.SafetyNumber()
+	assert.Error(err)
+	err = ratchetChanA.MarkVerified()
+	assert.Error(err)
+
+	exchangeA, err := ratchetChanA.ChannelExchange()
+	assert.NoError(err)
+	exchangeB, err := ratchetChanB.ChannelExchange()
+	assert.NoError(err)
+	err = ratchetChanB.ProcessChannelExchange(exchangeA, ratchetChanA.IdentityPrivateKey.PublicKey())
+	assert.NoError(err)
+	err = ratchetChanA.ProcessChannelExchange(exchangeB, ratchetChanB.IdentityPrivateKey.PublicKey())
+	assert.NoError(err)
+
+	numberA, err := ratchetChanA.SafetyNumber()
+	assert.NoError(err)
+	numberB, err := ratchetChanB.SafetyNumber()
+	assert.NoError(err)
+	assert.Equal(numberA, numberB)
+
+	err = ratchetChanA.MarkVerified()
+	assert.NoError(err)
+
+	blob, err := ratchetChanA.Save()
+	assert.NoError(err)
+	ratchetChanC, err := LoadUnreliableDoubleRatchetChannel(blob, chanA.spoolService)
+	assert.NoError(err)
+	assert.True(ratchetChanC.Verified)
+	numberC, err := ratchetChanC.SafetyNumber()
+	assert.NoError(err)
+	assert.Equal(numberA, numberC)
+}
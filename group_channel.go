@@ -0,0 +1,803 @@
+// group_channel.go - sender key group channel
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/memspool/client"
+	"github.com/ugorji/go/codec"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	groupIDLength       = 16
+	groupMemberIDLength = 16
+	groupHeaderLength   = groupMemberIDLength + 4 // member ID, iteration
+	groupMaxSkip        = 1000
+	groupBindingLabel   = "katzenpost channels group"
+
+	// GroupPayloadLength is the length of the payload encrypted
+	// by the sender keys of a GroupChannel.
+	GroupPayloadLength = SpoolPayloadLength - groupHeaderLength - macLength - eddsa.SignatureSize
+
+	// GroupSenderKeyGracePeriod is how long the replaced sender keys
+	// of the members are accepted for messages which were in flight.
+	GroupSenderKeyGracePeriod = 7 * 24 * time.Hour
+)
+
+// ErrRemovedFromGroup is returned when the group's creator announced our removal.
+var ErrRemovedFromGroup = errors.New("we were removed from the group")
+
+// errSenderKeyPending is returned for the sender keys of members
+// we do not know of yet, which are processed later.
+var errSenderKeyPending = errors.New("sender key of an unknown member")
+
+// GroupSenderKeyDistribution is sent over the pairwise
+// UnreliableDoubleRatchetChannels to distribute a member's sender key.
+type GroupSenderKeyDistribution struct {
+	GroupID          []byte
+	MemberID         []byte
+	ChainKey         []byte
+	Iteration        uint32
+	SigningPublicKey *eddsa.PublicKey
+
+	// Spool is the group spool, it's read key is shared by the members.
+	Spool *UnreliableSpoolReaderChannel
+
+	// Removed holds the IDs of the members removed by the sender,
+	// only the group's creator removes members.
+	Removed [][]byte
+
+	// Relayed is set when the group's creator forwards the sender
+	// key of the member MemberID to the other members.
+	Relayed bool
+}
+
+// OwnSenderKey is the sender key we encrypt and sign our messages with.
+type OwnSenderKey struct {
+	ChainKey          []byte
+	Iteration         uint32
+	SigningPrivateKey *eddsa.PrivateKey
+}
+
+// GroupSenderKey is a member's sender key.
+type GroupSenderKey struct {
+	ChainKey         []byte
+	Iteration        uint32
+	SigningPublicKey *eddsa.PublicKey
+
+	// SkippedKeys holds the message keys of messages not
+	// yet read, keyed by their decimal iteration.
+	SkippedKeys map[string][]byte
+}
+
+// GroupMember is a member of a GroupChannel. It's ID and SenderKey
+// are nil until we received the member's sender key. The Name is the
+// one of our pairwise channel with the member, it is empty for the
+// members we only know of through the group's creator.
+type GroupMember struct {
+	Name      string
+	ID        []byte
+	SenderKey *GroupSenderKey
+
+	// PreviousSenderKey is the sender key replaced by the last
+	// rotation, it is accepted until PreviousSenderKeyExpiration.
+	PreviousSenderKey           *GroupSenderKey
+	PreviousSenderKeyExpiration time.Time
+}
+
+// GroupChannel is an unreliable channel shared by a small group. Each
+// member distributes a sender key over it's pairwise channels and writes
+// a single signed ciphertext to the group spool for all members.
+//
+// Only the group's creator adds and removes members, it therefore has a
+// pairwise channel with every member and relays to each member the
+// sender keys of the others. Removing a member moves the group to a new
+// spool and makes every member rotate it's sender key.
+type GroupChannel struct {
+	spoolService client.SpoolService
+
+	GroupID         []byte
+	MemberID        []byte
+	AdminID         []byte
+	SpoolReaderChan *UnreliableSpoolReaderChannel
+	SenderKey       *OwnSenderKey
+	Members         []*GroupMember
+
+	// PreviousSpoolReaderChan is the spool the group moved away
+	// from, it is read until no message is left.
+	PreviousSpoolReaderChan *UnreliableSpoolReaderChannel
+
+	// RemovedMembers holds the IDs of the removed members, whose
+	// sender keys are no longer accepted.
+	RemovedMembers [][]byte
+
+	// SkipGarbage makes Read skip spool entries which fail to
+	// authenticate rather than return an error.
+	SkipGarbage    bool
+	SkippedEntries uint64
+}
+
+func randomBytes(length int) ([]byte, error) {
+	b := make([]byte, length)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func newOwnSenderKey() (*OwnSenderKey, error) {
+	chainKey, err := randomBytes(keyLength)
+	if err != nil {
+		return nil, err
+	}
+	signingPrivateKey, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &OwnSenderKey{
+		ChainKey:          chainKey,
+		SigningPrivateKey: signingPrivateKey,
+	}, nil
+}
+
+// NewGroupChannel creates a new group with a new group spool, we are
+// the group's creator. Members are then added with AddMember.
+func NewGroupChannel(spoolReceiver, spoolProvider string, spool client.SpoolService) (*GroupChannel, error) {
+	spoolReader, err := NewUnreliableSpoolReaderChannel(spoolReceiver, spoolProvider, spool)
+	if err != nil {
+		return nil, err
+	}
+	g, err := newGroupChannel(spool, spoolReader, nil)
+	if err != nil {
+		return nil, err
+	}
+	g.AdminID = g.MemberID
+	return g, nil
+}
+
+func newGroupChannel(spool client.SpoolService, spoolReader *UnreliableSpoolReaderChannel, groupID []byte) (*GroupChannel, error) {
+	var err error
+	if groupID == nil {
+		if groupID, err = randomBytes(groupIDLength); err != nil {
+			return nil, err
+		}
+	}
+	memberID, err := randomBytes(groupMemberIDLength)
+	if err != nil {
+		return nil, err
+	}
+	senderKey, err := newOwnSenderKey()
+	if err != nil {
+		return nil, err
+	}
+	return &GroupChannel{
+		spoolService:    spool,
+		GroupID:         groupID,
+		MemberID:        memberID,
+		SpoolReaderChan: spoolReader,
+		SenderKey:       senderKey,
+	}, nil
+}
+
+// JoinGroupChannel joins the group whose creator, the named member, added
+// us over the given pairwise channel. The sender keys of the other members
+// are relayed to us by the creator, to which we distribute our sender key.
+func JoinGroupChannel(groupID []byte, name string, ch *UnreliableDoubleRatchetChannel, spool client.SpoolService) (*GroupChannel, error) {
+	var distribution *GroupSenderKeyDistribution
+	for _, d := range ch.GroupSenderKeys {
+		if bytes.Equal(d.GroupID, groupID) && !d.Relayed {
+			distribution = d
+		}
+	}
+	if distribution == nil {
+		return nil, errors.New("no sender key received for this group")
+	}
+	spoolReader := *distribution.Spool
+	g, err := newGroupChannel(spool, &spoolReader, groupID)
+	if err != nil {
+		return nil, err
+	}
+	g.AdminID = distribution.MemberID
+	g.Members = []*GroupMember{{Name: name, ID: distribution.MemberID}}
+	channels := map[string]*UnreliableDoubleRatchetChannel{name: ch}
+	err = g.ProcessSenderKeys(channels)
+	if err != nil {
+		return nil, err
+	}
+	err = g.Rotate(channels)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// LoadGroupChannel loads a saved GroupChannel and sets it's spoolService.
+func LoadGroupChannel(data []byte, spoolService client.SpoolService) (*GroupChannel, error) {
+	g := new(GroupChannel)
+	err := codec.NewDecoderBytes(data, cborHandle).Decode(g)
+	if err != nil {
+		return nil, err
+	}
+	g.SetSpoolService(spoolService)
+	return g, nil
+}
+
+// SetSpoolService sets this group's spoolService.
+func (g *GroupChannel) SetSpoolService(spoolService client.SpoolService) {
+	g.spoolService = spoolService
+}
+
+// Save returns the serialization of this group.
+func (g *GroupChannel) Save() ([]byte, error) {
+	var serialized []byte
+	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode(g)
+	if err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+func (g *GroupChannel) isAdmin() bool {
+	return bytes.Equal(g.MemberID, g.AdminID)
+}
+
+// AddMember adds the named member, rotates our sender key and relays
+// the sender keys of the other members to the new one. Only the group's
+// creator adds members. The channels are our pairwise channels with each
+// member, keyed by name.
+func (g *GroupChannel) AddMember(name string, channels map[string]*UnreliableDoubleRatchetChannel) error {
+	if !g.isAdmin() {
+		return errors.New("only the group's creator adds members")
+	}
+	if name == "" {
+		return errors.New("member name must not be empty")
+	}
+	if g.Member(name) != nil {
+		return errors.New("member already added")
+	}
+	g.Members = append(g.Members, &GroupMember{Name: name})
+	if err := g.rotate(channels, nil); err != nil {
+		g.removeMember(name)
+		return err
+	}
+	for _, member := range g.Members {
+		if member.SenderKey == nil {
+			continue
+		}
+		if err := g.relay(channels[name], member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveMember removes the named member, moves the group to a new spool
+// and rotates our sender key. The remaining members learn of the removal
+// along with our sender key and rotate theirs. Only the group's creator
+// removes members.
+func (g *GroupChannel) RemoveMember(name string, channels map[string]*UnreliableDoubleRatchetChannel) error {
+	if !g.isAdmin() {
+		return errors.New("only the group's creator removes members")
+	}
+	member := g.Member(name)
+	if member == nil {
+		return errors.New("no such member")
+	}
+	g.removeMember(name)
+	if err := g.checkChannels(channels); err != nil {
+		g.Members = append(g.Members, member)
+		return err
+	}
+	spoolReader, err := NewUnreliableSpoolReaderChannel(g.SpoolReaderChan.SpoolReceiver, g.SpoolReaderChan.SpoolProvider, g.spoolService)
+	if err != nil {
+		g.Members = append(g.Members, member)
+		return err
+	}
+	g.moveSpool(spoolReader)
+	var removed [][]byte
+	if member.ID != nil {
+		removed = append(removed, member.ID)
+		g.RemovedMembers = append(g.RemovedMembers, member.ID)
+	}
+	return g.rotate(channels, removed)
+}
+
+// moveSpool makes the given spool the group spool, the
+// current one is read until no message is left.
+func (g *GroupChannel) moveSpool(spoolReader *UnreliableSpoolReaderChannel) {
+	g.PreviousSpoolReaderChan = g.SpoolReaderChan
+	g.SpoolReaderChan = spoolReader
+}
+
+// Rotate replaces our sender key and distributes it to all
+// members we share a pairwise channel with.
+func (g *GroupChannel) Rotate(channels map[string]*UnreliableDoubleRatchetChannel) error {
+	return g.rotate(channels, nil)
+}
+
+// checkChannels returns an error unless the channels
+// hold our pairwise channel with every named member.
+func (g *GroupChannel) checkChannels(channels map[string]*UnreliableDoubleRatchetChannel) error {
+	for _, member := range g.Members {
+		if member.Name != "" && channels[member.Name] == nil {
+			return fmt.Errorf("missing channel of member %s", member.Name)
+		}
+	}
+	return nil
+}
+
+// writeDistribution writes a sender key distribution
+// to the given pairwise channel.
+func (g *GroupChannel) writeDistribution(ch *UnreliableDoubleRatchetChannel, d *GroupSenderKeyDistribution) error {
+	spool := *g.SpoolReaderChan
+	d.GroupID = g.GroupID
+	d.Spool = &spool
+	var serialized []byte
+	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode(d)
+	if err != nil {
+		return err
+	}
+	return ch.writeMessage(groupSenderKeyMessage, serialized)
+}
+
+func (g *GroupChannel) rotate(channels map[string]*UnreliableDoubleRatchetChannel, removed [][]byte) error {
+	if err := g.checkChannels(channels); err != nil {
+		return err
+	}
+	senderKey, err := newOwnSenderKey()
+	if err != nil {
+		return err
+	}
+	for _, member := range g.Members {
+		if member.Name == "" {
+			continue
+		}
+		err := g.writeDistribution(channels[member.Name], &GroupSenderKeyDistribution{
+			MemberID:         g.MemberID,
+			ChainKey:         senderKey.ChainKey,
+			SigningPublicKey: senderKey.SigningPrivateKey.PublicKey(),
+			Removed:          removed,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	g.SenderKey = senderKey
+	return nil
+}
+
+// relay forwards the sender key of the given member over the pairwise
+// channel of another member, as we currently know it.
+func (g *GroupChannel) relay(ch *UnreliableDoubleRatchetChannel, member *GroupMember) error {
+	return g.writeDistribution(ch, &GroupSenderKeyDistribution{
+		MemberID:         member.ID,
+		ChainKey:         member.SenderKey.ChainKey,
+		Iteration:        member.SenderKey.Iteration,
+		SigningPublicKey: member.SenderKey.SigningPublicKey,
+		Relayed:          true,
+	})
+}
+
+// ProcessSenderKeys processes the sender keys of this group received
+// over our pairwise channels with the members, keyed by name. The group's
+// creator relays the new sender keys to the other members. Once the
+// creator announced the removal of a member, we rotate our sender key.
+// Sender keys of members we do not know of yet are kept in their channel
+// until the creator relayed theirs.
+func (g *GroupChannel) ProcessSenderKeys(channels map[string]*UnreliableDoubleRatchetChannel) error {
+	var firstErr error
+	var relayed []*GroupMember
+	removal := false
+	for name, ch := range channels {
+		var remaining []*GroupSenderKeyDistribution
+		for _, d := range ch.GroupSenderKeys {
+			if !bytes.Equal(d.GroupID, g.GroupID) {
+				remaining = append(remaining, d)
+				continue
+			}
+			member, removed, err := g.processSenderKey(name, d)
+			switch {
+			case err == ErrRemovedFromGroup:
+				// the sender keys of our other groups are kept
+				var others []*GroupSenderKeyDistribution
+				for _, other := range ch.GroupSenderKeys {
+					if !bytes.Equal(other.GroupID, g.GroupID) {
+						others = append(others, other)
+					}
+				}
+				ch.GroupSenderKeys = others
+				return err
+			case err == errSenderKeyPending:
+				remaining = append(remaining, d)
+			case err != nil && firstErr == nil:
+				firstErr = err
+			}
+			if member != nil && g.isAdmin() {
+				relayed = append(relayed, member)
+			}
+			removal = removal || removed
+		}
+		ch.GroupSenderKeys = remaining
+	}
+	for _, member := range relayed {
+		for _, other := range g.Members {
+			if other == member || other.Name == "" {
+				continue
+			}
+			if channels[other.Name] == nil {
+				return fmt.Errorf("missing channel of member %s", other.Name)
+			}
+			if err := g.relay(channels[other.Name], member); err != nil {
+				return err
+			}
+		}
+	}
+	if removal {
+		if err := g.rotate(channels, nil); err != nil {
+			return err
+		}
+	}
+	return firstErr
+}
+
+// processSenderKey processes a sender key received over our pairwise
+// channel with the named member. It returns the member whose sender key
+// was replaced, nil if the sender key is not new, and whether the group's
+// creator announced a removal.
+func (g *GroupChannel) processSenderKey(name string, d *GroupSenderKeyDistribution) (*GroupMember, bool, error) {
+	if bytes.Equal(d.MemberID, g.MemberID) {
+		return nil, false, errors.New("unexpected group sender key")
+	}
+	if g.isRemoved(d.MemberID) {
+		return nil, false, nil
+	}
+	if d.Relayed {
+		admin := g.memberByID(g.AdminID)
+		if g.isAdmin() || admin == nil || admin.Name != name {
+			return nil, false, errors.New("group sender key relayed by a member other than the group's creator")
+		}
+		member := g.memberByID(d.MemberID)
+		if member == nil {
+			member = &GroupMember{ID: d.MemberID}
+			g.Members = append(g.Members, member)
+		}
+		if !member.setSenderKey(d) {
+			return nil, false, nil
+		}
+		return member, false, nil
+	}
+
+	member := g.Member(name)
+	if member == nil {
+		member = g.memberByID(d.MemberID)
+		if member == nil || member.Name != "" {
+			return nil, false, errSenderKeyPending
+		}
+		member.Name = name
+	}
+	if member.ID != nil && !bytes.Equal(member.ID, d.MemberID) {
+		return nil, false, errors.New("member ID changed")
+	}
+	if member.ID == nil && g.memberByID(d.MemberID) != nil {
+		return nil, false, errors.New("member ID already in use")
+	}
+	member.ID = d.MemberID
+	if !member.setSenderKey(d) {
+		return nil, false, nil
+	}
+	if !bytes.Equal(d.MemberID, g.AdminID) {
+		return member, false, nil
+	}
+
+	if !bytes.Equal(d.Spool.SpoolID, g.SpoolReaderChan.SpoolID) {
+		spoolReader := *d.Spool
+		g.moveSpool(&spoolReader)
+	}
+	removal := false
+	for _, id := range d.Removed {
+		if bytes.Equal(id, g.MemberID) {
+			return nil, false, ErrRemovedFromGroup
+		}
+		g.RemovedMembers = append(g.RemovedMembers, id)
+		if g.memberByID(id) != nil {
+			g.removeMemberID(id)
+			removal = true
+		}
+	}
+	return member, removal, nil
+}
+
+// setSenderKey replaces the member's sender key with the distributed one
+// unless it is not new, the replaced one is kept for the grace period.
+func (m *GroupMember) setSenderKey(d *GroupSenderKeyDistribution) bool {
+	for _, senderKey := range []*GroupSenderKey{m.SenderKey, m.PreviousSenderKey} {
+		if senderKey != nil && bytes.Equal(senderKey.SigningPublicKey.Bytes(), d.SigningPublicKey.Bytes()) {
+			return false
+		}
+	}
+	if m.SenderKey != nil {
+		m.PreviousSenderKey = m.SenderKey
+		m.PreviousSenderKeyExpiration = time.Now().Add(GroupSenderKeyGracePeriod)
+	}
+	m.SenderKey = &GroupSenderKey{
+		ChainKey:         d.ChainKey,
+		Iteration:        d.Iteration,
+		SigningPublicKey: d.SigningPublicKey,
+		SkippedKeys:      make(map[string][]byte),
+	}
+	return true
+}
+
+// Member returns the named member or nil.
+func (g *GroupChannel) Member(name string) *GroupMember {
+	if name == "" {
+		return nil
+	}
+	for _, member := range g.Members {
+		if member.Name == name {
+			return member
+		}
+	}
+	return nil
+}
+
+// memberByID returns the member with the given ID or nil.
+func (g *GroupChannel) memberByID(id []byte) *GroupMember {
+	for _, member := range g.Members {
+		if member.ID != nil && bytes.Equal(member.ID, id) {
+			return member
+		}
+	}
+	return nil
+}
+
+func (g *GroupChannel) isRemoved(id []byte) bool {
+	for _, removed := range g.RemovedMembers {
+		if bytes.Equal(removed, id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GroupChannel) removeMember(name string) {
+	for i, member := range g.Members {
+		if member.Name == name {
+			g.Members = append(g.Members[:i], g.Members[i+1:]...)
+			return
+		}
+	}
+}
+
+func (g *GroupChannel) removeMemberID(id []byte) {
+	for i, member := range g.Members {
+		if bytes.Equal(member.ID, id) {
+			g.Members = append(g.Members[:i], g.Members[i+1:]...)
+			return
+		}
+	}
+}
+
+// processGroupSenderKey keeps a sender key received over
+// this channel until a GroupChannel processes it.
+func (r *UnreliableDoubleRatchetChannel) processGroupSenderKey(body []byte) error {
+	d := new(GroupSenderKeyDistribution)
+	err := codec.NewDecoderBytes(body, cborHandle).Decode(d)
+	if err != nil {
+		return err
+	}
+	if len(d.GroupID) != groupIDLength || len(d.MemberID) != groupMemberIDLength ||
+		len(d.ChainKey) != keyLength || d.SigningPublicKey == nil || d.Spool == nil {
+		return errors.New("invalid group sender key")
+	}
+	r.GroupSenderKeys = append(r.GroupSenderKeys, d)
+	return nil
+}
+
+// associatedData binds the group messages to the group and it's spool.
+func (g *GroupChannel) associatedData(spool *UnreliableSpoolReaderChannel, header []byte) []byte {
+	ad := append([]byte{}, g.GroupID...)
+	ad = append(ad, spoolBinding(groupBindingLabel, spool.GetSpoolWriter())...)
+	return append(ad, header...)
+}
+
+func sealGroupMessage(messageKey, payload, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), payload, ad), nil
+}
+
+func openGroupMessage(messageKey, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext, ad)
+}
+
+// Write encrypts the message with our sender key and writes
+// it to the group spool.
+func (g *GroupChannel) Write(message []byte) error {
+	payload, err := padPayload(message, GroupPayloadLength)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, groupHeaderLength)
+	copy(header, g.MemberID)
+	binary.BigEndian.PutUint32(header[groupMemberIDLength:], g.SenderKey.Iteration)
+	messageKey, chainKey := kdfChainKey(g.SenderKey.ChainKey)
+	ciphertext, err := sealGroupMessage(messageKey, payload, g.associatedData(g.SpoolReaderChan, header))
+	if err != nil {
+		return err
+	}
+	entry := append(header, ciphertext...)
+	entry = append(entry, g.SenderKey.SigningPrivateKey.Sign(entry)...)
+	g.SenderKey.ChainKey = chainKey
+	g.SenderKey.Iteration++
+	return g.SpoolReaderChan.GetSpoolWriter().Write(g.spoolService, entry)
+}
+
+// Read reads the next message of another member from the group spool
+// and returns it along with the member's name. The members we share no
+// pairwise channel with are named by their hex encoded ID.
+func (g *GroupChannel) Read() (string, []byte, error) {
+	var name string
+	message, err := skipGarbage(g.SkipGarbage, &g.SkippedEntries, func() ([]byte, error) {
+		var err error
+		var message []byte
+		name, message, err = g.readMessage()
+		return message, err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return name, message, nil
+}
+
+func (g *GroupChannel) readMessage() (string, []byte, error) {
+	for {
+		spool := g.SpoolReaderChan
+		if g.PreviousSpoolReaderChan != nil {
+			spool = g.PreviousSpoolReaderChan
+		}
+		entry, err := spool.Read(g.spoolService)
+		if err == ErrNoMessage && spool == g.PreviousSpoolReaderChan {
+			g.PreviousSpoolReaderChan = nil
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if len(entry) < groupHeaderLength+macLength+eddsa.SignatureSize {
+			return "", nil, &garbageError{errors.New("group message is truncated")}
+		}
+		memberID := entry[:groupMemberIDLength]
+		if bytes.Equal(memberID, g.MemberID) {
+			// our own message
+			continue
+		}
+		name, member := g.member(memberID)
+		if member == nil {
+			return "", nil, &garbageError{errors.New("group message of an unknown member")}
+		}
+		signed, signature := entry[:len(entry)-eddsa.SignatureSize], entry[len(entry)-eddsa.SignatureSize:]
+		senderKey := member.signingSenderKey(signature, signed)
+		if senderKey == nil {
+			return "", nil, &garbageError{errors.New("invalid group message signature")}
+		}
+		header, ciphertext := signed[:groupHeaderLength], signed[groupHeaderLength:]
+		payload, err := g.decrypt(senderKey, g.associatedData(spool, header), header, ciphertext)
+		if err != nil {
+			return "", nil, &garbageError{err}
+		}
+		message, err := unpadPayload(payload)
+		if err != nil {
+			return "", nil, err
+		}
+		return name, message, nil
+	}
+}
+
+// member returns the name of the member with the given ID whose sender
+// key we know, or it's hex encoded ID if we share no channel with it.
+func (g *GroupChannel) member(id []byte) (string, *GroupMember) {
+	for _, member := range g.Members {
+		if member.SenderKey != nil && bytes.Equal(member.ID, id) {
+			if member.Name == "" {
+				return hex.EncodeToString(member.ID), member
+			}
+			return member.Name, member
+		}
+	}
+	return "", nil
+}
+
+// signingSenderKey returns the sender key of the member which signed
+// the message, the previous one is accepted until it expires.
+func (m *GroupMember) signingSenderKey(signature, message []byte) *GroupSenderKey {
+	if m.SenderKey.SigningPublicKey.Verify(signature, message) {
+		return m.SenderKey
+	}
+	if m.PreviousSenderKey == nil {
+		return nil
+	}
+	if time.Now().After(m.PreviousSenderKeyExpiration) {
+		m.PreviousSenderKey = nil
+		return nil
+	}
+	if m.PreviousSenderKey.SigningPublicKey.Verify(signature, message) {
+		return m.PreviousSenderKey
+	}
+	return nil
+}
+
+// decrypt decrypts a member's message, the sender key is
+// left unchanged if decryption fails.
+func (g *GroupChannel) decrypt(senderKey *GroupSenderKey, ad, header, ciphertext []byte) ([]byte, error) {
+	iteration := binary.BigEndian.Uint32(header[groupMemberIDLength:])
+	if iteration < senderKey.Iteration {
+		messageKey, ok := senderKey.SkippedKeys[strconv.FormatUint(uint64(iteration), 10)]
+		if !ok {
+			return nil, errors.New("duplicate group message")
+		}
+		payload, err := openGroupMessage(messageKey, ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+		delete(senderKey.SkippedKeys, strconv.FormatUint(uint64(iteration), 10))
+		return payload, nil
+	}
+	if iteration-senderKey.Iteration > groupMaxSkip {
+		return nil, errors.New("too many skipped group messages")
+	}
+	skipped := make(map[string][]byte)
+	chainKey := senderKey.ChainKey
+	var messageKey []byte
+	for i := senderKey.Iteration; ; i++ {
+		messageKey, chainKey = kdfChainKey(chainKey)
+		if i == iteration {
+			break
+		}
+		skipped[strconv.FormatUint(uint64(i), 10)] = messageKey
+	}
+	payload, err := openGroupMessage(messageKey, ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+	if senderKey.SkippedKeys == nil {
+		senderKey.SkippedKeys = make(map[string][]byte)
+	}
+	for i, key := range skipped {
+		senderKey.SkippedKeys[i] = key
+	}
+	senderKey.ChainKey = chainKey
+	senderKey.Iteration = iteration + 1
+	return payload, nil
+}
@@ -0,0 +1,185 @@
+// group_channel_test.go - sender key group channel tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+)
+
+// flushPairwise makes the reader process the control messages
+// written to it by reading a data message written after them.
+func flushPairwise(t *testing.T, writer, reader *UnreliableDoubleRatchetChannel) {
+	assert := assert.New(t)
+
+	assert.NoError(writer.Write([]byte("flush")))
+	msg, err := reader.Read()
+	assert.NoError(err)
+	assert.Equal([]byte("flush"), msg)
+}
+
+func TestGroupChannel(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	aliceBob, bobAlice := newTestConnectedRatchetPair(t, "alice", "bob", spool)
+	aliceCarol, carolAlice := newTestConnectedRatchetPair(t, "alice", "carol", spool)
+	aliceChannels := map[string]*UnreliableDoubleRatchetChannel{"bob": aliceBob, "carol": aliceCarol}
+	bobChannels := map[string]*UnreliableDoubleRatchetChannel{"alice": bobAlice}
+	carolChannels := map[string]*UnreliableDoubleRatchetChannel{"alice": carolAlice}
+
+	// Alice creates the group and adds Bob and Carol.
+	alice, err := NewGroupChannel("receiver_group", "provider_group", spool)
+	assert.NoError(err)
+	assert.Error(alice.AddMember("bob", nil))
+	assert.Empty(alice.Members)
+	assert.NoError(alice.AddMember("bob", map[string]*UnreliableDoubleRatchetChannel{"bob": aliceBob}))
+	assert.NoError(alice.AddMember("carol", aliceChannels))
+	flushPairwise(t, aliceBob, bobAlice)
+	flushPairwise(t, aliceCarol, carolAlice)
+
+	// Bob and Carol join, Alice relays their sender keys to each other.
+	bob, err := JoinGroupChannel(alice.GroupID, "alice", bobAlice, spool)
+	assert.NoError(err)
+	carol, err := JoinGroupChannel(alice.GroupID, "alice", carolAlice, spool)
+	assert.NoError(err)
+	assert.Error(bob.AddMember("dave", bobChannels))
+	flushPairwise(t, bobAlice, aliceBob)
+	flushPairwise(t, carolAlice, aliceCarol)
+	assert.NoError(alice.ProcessSenderKeys(aliceChannels))
+	assert.Empty(aliceBob.GroupSenderKeys)
+	flushPairwise(t, aliceBob, bobAlice)
+	flushPairwise(t, aliceCarol, carolAlice)
+	assert.NoError(bob.ProcessSenderKeys(bobChannels))
+	assert.NoError(carol.ProcessSenderKeys(carolChannels))
+	assert.Len(bob.Members, 2)
+	assert.Len(carol.Members, 2)
+
+	// A single ciphertext reaches every member.
+	fromAlice := []byte("hello group")
+	fromBob := []byte("hello from bob")
+	assert.NoError(alice.Write(fromAlice))
+	assert.NoError(bob.Write(fromBob))
+
+	name, msg, err := alice.Read()
+	assert.NoError(err)
+	assert.Equal("bob", name)
+	assert.Equal(fromBob, msg)
+	name, msg, err = bob.Read()
+	assert.NoError(err)
+	assert.Equal("alice", name)
+	assert.Equal(fromAlice, msg)
+
+	serialized, err := carol.Save()
+	assert.NoError(err)
+	carol, err = LoadGroupChannel(serialized, spool)
+	assert.NoError(err)
+	name, msg, err = carol.Read()
+	assert.NoError(err)
+	assert.Equal("alice", name)
+	assert.Equal(fromAlice, msg)
+	name, msg, err = carol.Read()
+	assert.NoError(err)
+	assert.Equal(hex.EncodeToString(bob.MemberID), name)
+	assert.Equal(fromBob, msg)
+
+	// Messages written before a rotation are read during the grace period.
+	inFlight := []byte("written before the rotation")
+	assert.NoError(bob.Write(inFlight))
+	assert.NoError(bob.Rotate(bobChannels))
+	flushPairwise(t, bobAlice, aliceBob)
+	assert.NoError(alice.ProcessSenderKeys(aliceChannels))
+	assert.NotNil(alice.Member("bob").PreviousSenderKey)
+	name, msg, err = alice.Read()
+	assert.NoError(err)
+	assert.Equal("bob", name)
+	assert.Equal(inFlight, msg)
+
+	// Only the group's creator removes members.
+	assert.Error(bob.RemoveMember("alice", bobChannels))
+	var forged []byte
+	assert.NoError(codec.NewEncoderBytes(&forged, cborHandle).Encode(&GroupSenderKeyDistribution{
+		GroupID:          carol.GroupID,
+		MemberID:         carol.MemberID,
+		ChainKey:         carol.SenderKey.ChainKey,
+		SigningPublicKey: carol.SenderKey.SigningPrivateKey.PublicKey(),
+		Spool:            carol.SpoolReaderChan,
+		Removed:          [][]byte{bob.MemberID},
+		Relayed:          true,
+	}))
+	assert.NoError(carolAlice.writeMessage(groupSenderKeyMessage, forged))
+	flushPairwise(t, carolAlice, aliceCarol)
+	assert.Error(alice.ProcessSenderKeys(aliceChannels))
+	assert.NotNil(alice.Member("bob"))
+
+	// Removing Carol moves the group to a new spool and
+	// rotates the sender keys of the remaining members.
+	oldSpoolID := alice.SpoolReaderChan.SpoolID
+	assert.NoError(alice.RemoveMember("carol", aliceChannels))
+	assert.NotEqual(oldSpoolID, alice.SpoolReaderChan.SpoolID)
+	flushPairwise(t, aliceBob, bobAlice)
+	assert.NoError(bob.ProcessSenderKeys(bobChannels))
+	assert.Len(bob.Members, 1)
+	assert.Equal(alice.SpoolReaderChan.SpoolID, bob.SpoolReaderChan.SpoolID)
+	bobKey := bob.SenderKey.SigningPrivateKey.PublicKey().Bytes()
+	flushPairwise(t, bobAlice, aliceBob)
+	assert.NoError(alice.ProcessSenderKeys(aliceChannels))
+	assert.Equal(bobKey, alice.Member("bob").SenderKey.SigningPublicKey.Bytes())
+
+	secret := []byte("carol must not read this")
+	assert.NoError(alice.Write(secret))
+	name, msg, err = bob.Read()
+	assert.NoError(err)
+	assert.Equal("alice", name)
+	assert.Equal(secret, msg)
+	assert.Nil(bob.PreviousSpoolReaderChan)
+
+	// Carol reads what was written before her removal, but
+	// nothing written to the new spool.
+	_, msg, err = carol.Read()
+	assert.NoError(err)
+	assert.Equal(inFlight, msg)
+	_, _, err = carol.Read()
+	assert.Equal(ErrNoMessage, err)
+
+	// polling at the end of the spool does not lose the next message
+	_, _, err = bob.Read()
+	assert.Equal(ErrNoMessage, err)
+	afterPoll := []byte("written after polling")
+	assert.NoError(alice.Write(afterPoll))
+	name, msg, err = bob.Read()
+	assert.NoError(err)
+	assert.Equal("alice", name)
+	assert.Equal(afterPoll, msg)
+
+	// Carol's removal only discards the sender keys of this group.
+	otherGroup := &GroupSenderKeyDistribution{GroupID: []byte("another group")}
+	carolAlice.GroupSenderKeys = []*GroupSenderKeyDistribution{{
+		GroupID:          carol.GroupID,
+		MemberID:         alice.MemberID,
+		ChainKey:         alice.SenderKey.ChainKey,
+		Iteration:        alice.SenderKey.Iteration,
+		SigningPublicKey: alice.SenderKey.SigningPrivateKey.PublicKey(),
+		Spool:            alice.SpoolReaderChan,
+		Removed:          [][]byte{carol.MemberID},
+	}, otherGroup}
+	assert.Equal(ErrRemovedFromGroup, carol.ProcessSenderKeys(carolChannels))
+	assert.Equal([]*GroupSenderKeyDistribution{otherGroup}, carolAlice.GroupSenderKeys)
+}
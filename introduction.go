@@ -0,0 +1,239 @@
+// introduction.go - contact introductions over Double Ratchet channels
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/ugorji/go/codec"
+)
+
+// IntroductionState is the state of an Introduction.
+type IntroductionState int
+
+const (
+	// IntroductionRequested is the state of an introduction we
+	// requested from the remote party who has not yet replied.
+	IntroductionRequested IntroductionState = iota
+
+	// IntroductionReplied is the state of an introduction we
+	// requested and for which the remote party sent an invitation.
+	// The invitation is to be relayed with RelayIntroduction.
+	IntroductionReplied
+
+	// IntroductionRequestReceived is the state of an introduction
+	// the remote party asks us to accept by inviting the contact.
+	IntroductionRequestReceived
+
+	// IntroductionOfferReceived is the state of an introduction
+	// for which the remote party relayed the contact's invitation.
+	IntroductionOfferReceived
+)
+
+// Introduction is a contact introduction in which the introducer,
+// sharing a channel with each of two contacts, relays an invitation
+// from one contact to the other. The introducer sees the invitation
+// and could substitute it's own, the introduced contacts should
+// therefore compare their safety numbers. Once they did so the
+// introducer can not impersonate either of them.
+type Introduction struct {
+	ID    []byte
+	State IntroductionState
+
+	// Name is the name of the introduced contact as given by the introducer.
+	Name string
+
+	// Invitation is the serialized UnreliableDoubleRatchetChannelInvitation
+	// of the contact being introduced.
+	Invitation []byte
+}
+
+// introductionMessage is carried by the ratchet.
+type introductionMessage struct {
+	ID         []byte
+	Name       string
+	Invitation []byte
+}
+
+func (r *UnreliableDoubleRatchetChannel) writeIntroductionMessage(messageType byte, message *introductionMessage) error {
+	var serialized []byte
+	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode(message)
+	if err != nil {
+		return err
+	}
+	return r.writeMessage(messageType, serialized)
+}
+
+// GetIntroduction returns the introduction with the given ID or nil.
+func (r *UnreliableDoubleRatchetChannel) GetIntroduction(id []byte) *Introduction {
+	for _, introduction := range r.Introductions {
+		if bytes.Equal(introduction.ID, id) {
+			return introduction
+		}
+	}
+	return nil
+}
+
+func (r *UnreliableDoubleRatchetChannel) removeIntroduction(id []byte) {
+	for i, introduction := range r.Introductions {
+		if bytes.Equal(introduction.ID, id) {
+			r.Introductions = append(r.Introductions[:i], r.Introductions[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *UnreliableDoubleRatchetChannel) introductionInState(id []byte, state IntroductionState) (*Introduction, error) {
+	introduction := r.GetIntroduction(id)
+	if introduction == nil {
+		return nil, errors.New("no such introduction")
+	}
+	if introduction.State != state {
+		return nil, errors.New("introduction is in the wrong state")
+	}
+	return introduction, nil
+}
+
+// RequestIntroduction asks the remote party to invite the contact
+// with the given name. It returns the ID of the new introduction.
+func (r *UnreliableDoubleRatchetChannel) RequestIntroduction(name string) ([]byte, error) {
+	id := make([]byte, invitationIDLength)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+	err := r.writeIntroductionMessage(introductionRequestMessage, &introductionMessage{
+		ID:   id,
+		Name: name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.Introductions = append(r.Introductions, &Introduction{
+		ID:    id,
+		State: IntroductionRequested,
+		Name:  name,
+	})
+	return id, nil
+}
+
+// RelayIntroduction relays the invitation of a replied introduction
+// to the contact reachable over the given channel, who is told that
+// the invitation comes from the contact with the given name.
+func (r *UnreliableDoubleRatchetChannel) RelayIntroduction(id []byte, contact *UnreliableDoubleRatchetChannel, name string) error {
+	introduction, err := r.introductionInState(id, IntroductionReplied)
+	if err != nil {
+		return err
+	}
+	err = contact.writeIntroductionMessage(introductionOfferMessage, &introductionMessage{
+		ID:         id,
+		Name:       name,
+		Invitation: introduction.Invitation,
+	})
+	if err != nil {
+		return err
+	}
+	r.removeIntroduction(id)
+	return nil
+}
+
+// AcceptIntroductionRequest accepts a received introduction request by
+// inviting the introduced contact to the given new channel. The invitation
+// is sent to the introducer who relays it to the contact.
+func (r *UnreliableDoubleRatchetChannel) AcceptIntroductionRequest(id []byte, contact *UnreliableDoubleRatchetChannel, lifetime time.Duration) error {
+	_, err := r.introductionInState(id, IntroductionRequestReceived)
+	if err != nil {
+		return err
+	}
+	invitation, err := contact.Invite(lifetime)
+	if err != nil {
+		return err
+	}
+	err = r.writeIntroductionMessage(introductionReplyMessage, &introductionMessage{
+		ID:         id,
+		Invitation: invitation,
+	})
+	if err != nil {
+		return err
+	}
+	r.removeIntroduction(id)
+	return nil
+}
+
+// AcceptIntroductionOffer accepts a received introduction offer by
+// accepting the relayed invitation with the given new channel.
+func (r *UnreliableDoubleRatchetChannel) AcceptIntroductionOffer(id []byte, contact *UnreliableDoubleRatchetChannel) error {
+	introduction, err := r.introductionInState(id, IntroductionOfferReceived)
+	if err != nil {
+		return err
+	}
+	err = contact.AcceptInvitation(introduction.Invitation)
+	if err != nil {
+		return err
+	}
+	r.removeIntroduction(id)
+	return nil
+}
+
+// RejectIntroduction discards the introduction with the given ID.
+func (r *UnreliableDoubleRatchetChannel) RejectIntroduction(id []byte) error {
+	if r.GetIntroduction(id) == nil {
+		return errors.New("no such introduction")
+	}
+	r.removeIntroduction(id)
+	return nil
+}
+
+func (r *UnreliableDoubleRatchetChannel) processIntroductionMessage(messageType byte, serialized []byte) error {
+	message := new(introductionMessage)
+	err := codec.NewDecoderBytes(serialized, cborHandle).Decode(message)
+	if err != nil {
+		return err
+	}
+	if len(message.ID) != invitationIDLength {
+		return errors.New("invalid introduction ID")
+	}
+	if messageType != introductionRequestMessage && len(message.Invitation) == 0 {
+		return errors.New("introduction invitation is missing")
+	}
+	if messageType == introductionReplyMessage {
+		introduction, err := r.introductionInState(message.ID, IntroductionRequested)
+		if err != nil {
+			return err
+		}
+		introduction.State = IntroductionReplied
+		introduction.Invitation = message.Invitation
+		return nil
+	}
+	if r.GetIntroduction(message.ID) != nil {
+		return errors.New("duplicate introduction")
+	}
+	introduction := &Introduction{
+		ID:         message.ID,
+		State:      IntroductionRequestReceived,
+		Name:       message.Name,
+		Invitation: message.Invitation,
+	}
+	if messageType == introductionOfferMessage {
+		introduction.State = IntroductionOfferReceived
+	}
+	r.Introductions = append(r.Introductions, introduction)
+	return nil
+}
@@ -0,0 +1,162 @@
+// introduction_test.go - contact introduction tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/memspool/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRatchetChannel(t *testing.T, name string, spool client.SpoolService) *UnreliableDoubleRatchetChannel {
+	assert := assert.New(t)
+
+	spoolCh, err := NewUnreliableSpoolChannel("receiver_"+name, "provider_"+name, spool)
+	assert.NoError(err)
+	ratchetCh, err := NewUnreliableDoubleRatchetChannel(spoolCh)
+	assert.NoError(err)
+	return ratchetCh
+}
+
+func newTestConnectedRatchetPair(t *testing.T, nameA, nameB string, spool client.SpoolService) (*UnreliableDoubleRatchetChannel, *UnreliableDoubleRatchetChannel) {
+	assert := assert.New(t)
+
+	ratchetChanA := newTestRatchetChannel(t, nameA, spool)
+	ratchetChanB := newTestRatchetChannel(t, nameB, spool)
+	exchangeA, err := ratchetChanA.ChannelExchange()
+	assert.NoError(err)
+	exchangeB, err := ratchetChanB.ChannelExchange()
+	assert.NoError(err)
+	err = ratchetChanB.ProcessChannelExchange(exchangeA, ratchetChanA.IdentityPrivateKey.PublicKey())
+	assert.NoError(err)
+	err = ratchetChanA.ProcessChannelExchange(exchangeB, ratchetChanB.IdentityPrivateKey.PublicKey())
+	assert.NoError(err)
+	return ratchetChanA, ratchetChanB
+}
+
+func TestIntroduction(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	aliceBob, bobAlice := newTestConnectedRatchetPair(t, "alice", "bob", spool)
+	aliceCarol, carolAlice := newTestConnectedRatchetPair(t, "alice", "carol", spool)
+
+	// Alice asks Bob to invite Carol.
+	id, err := aliceBob.RequestIntroduction("Carol")
+	assert.NoError(err)
+	msg := []byte("Bob, meet Carol.")
+	err = aliceBob.Write(msg)
+	assert.NoError(err)
+
+	// Bob's Read handles the request and returns the next message.
+	msgRead, err := bobAlice.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+	introduction := bobAlice.GetIntroduction(id)
+	assert.NotNil(introduction)
+	assert.Equal(IntroductionRequestReceived, introduction.State)
+	assert.Equal("Carol", introduction.Name)
+
+	// Bob's introduction state survives Save and Load.
+	blob, err := bobAlice.Save()
+	assert.NoError(err)
+	bobAlice, err = LoadUnreliableDoubleRatchetChannel(blob, spool)
+	assert.NoError(err)
+
+	bobCarol := newTestRatchetChannel(t, "bob", spool)
+	err = bobAlice.AcceptIntroductionRequest(id, bobCarol, time.Hour)
+	assert.NoError(err)
+	assert.Nil(bobAlice.GetIntroduction(id))
+
+	// Alice relays Bob's invitation to Carol.
+	_, err = aliceBob.Read()
+	assert.Error(err) // nothing left to read after the reply
+	assert.Equal(IntroductionReplied, aliceBob.GetIntroduction(id).State)
+	err = aliceBob.RelayIntroduction(id, aliceCarol, "Bob")
+	assert.NoError(err)
+	assert.Nil(aliceBob.GetIntroduction(id))
+
+	_, err = carolAlice.Read()
+	assert.Error(err)
+	introduction = carolAlice.GetIntroduction(id)
+	assert.NotNil(introduction)
+	assert.Equal(IntroductionOfferReceived, introduction.State)
+	assert.Equal("Bob", introduction.Name)
+
+	carolBob := newTestRatchetChannel(t, "carol", spool)
+	err = carolAlice.AcceptIntroductionOffer(id, carolBob)
+	assert.NoError(err)
+
+	// Bob and Carol now share a channel of their own.
+	msg = []byte("Hi Bob, Carol here.")
+	err = carolBob.Write(msg)
+	assert.NoError(err)
+	msgRead, err = bobCarol.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+
+	msg = []byte("Hi Carol.")
+	err = bobCarol.Write(msg)
+	assert.NoError(err)
+	msgRead, err = carolBob.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+
+	// The introducer holds none of their keys.
+	numberBob, err := bobCarol.SafetyNumber()
+	assert.NoError(err)
+	numberCarol, err := carolBob.SafetyNumber()
+	assert.NoError(err)
+	assert.Equal(numberBob, numberCarol)
+	numberAliceBob, err := aliceBob.SafetyNumber()
+	assert.NoError(err)
+	assert.NotEqual(numberAliceBob, numberBob)
+}
+
+func TestRejectIntroduction(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	aliceBob, bobAlice := newTestConnectedRatchetPair(t, "alice", "bob", spool)
+
+	id, err := aliceBob.RequestIntroduction("Mallory")
+	assert.NoError(err)
+	_, err = bobAlice.Read()
+	assert.Error(err)
+	assert.NotNil(bobAlice.GetIntroduction(id))
+
+	err = bobAlice.AcceptIntroductionOffer(id, newTestRatchetChannel(t, "bob", spool))
+	assert.Error(err)
+	err = bobAlice.RejectIntroduction(id)
+	assert.NoError(err)
+	assert.Nil(bobAlice.GetIntroduction(id))
+	err = bobAlice.RejectIntroduction(id)
+	assert.Error(err)
+
+	// an unsolicited reply is rejected
+	err = bobAlice.writeIntroductionMessage(introductionReplyMessage, &introductionMessage{
+		ID:         id,
+		Invitation: []byte("invitation"),
+	})
+	assert.NoError(err)
+	aliceBob.removeIntroduction(id)
+	_, err = aliceBob.Read()
+	assert.Error(err)
+	assert.Empty(aliceBob.Introductions)
+}
@@ -0,0 +1,214 @@
+// invitation.go - single message invitations for Double Ratchet channels
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	ratchet "github.com/katzenpost/doubleratchet"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// InvitationReplyOverhead is the amount of bytes overhead from
+	// the Noise N encryption of an invitation reply.
+	InvitationReplyOverhead = NoiseNOverhead
+
+	// InvitationReplyPayloadLength is the length of the padded
+	// invitation reply payload.
+	InvitationReplyPayloadLength = SpoolPayloadLength - InvitationReplyOverhead
+
+	invitationIDLength = 16
+)
+
+// ErrInvitationExpired is returned by Read once our pending invitation
+// expired without a reply, the invitation is then forgotten.
+var ErrInvitationExpired = errors.New("invitation expired")
+
+// UnreliableDoubleRatchetChannelInvitation is sent by the inviting
+// party to the invitee. Unlike UnreliableDoubleRatchetChannelExchange
+// it is the only message which has to be transferred out of band, the
+// invitee's exchange is returned through the inviting party's spool.
+type UnreliableDoubleRatchetChannelInvitation struct {
+	ID                  []byte
+	Expiration          time.Time
+	SpoolWriter         *UnreliableSpoolWriterChannel
+	SignedKeyExchange   *ratchet.SignedKeyExchange
+	DeniableKeyExchange *DeniableKeyExchange
+
+	// ReplyPublicKey is the Noise N key the invitee encrypts it's
+	// reply with so that the Provider does not learn it's spool.
+	ReplyPublicKey *ecdh.PublicKey
+}
+
+// PendingInvitation is the state kept by the inviting party
+// until the invitee's reply is read.
+type PendingInvitation struct {
+	ID              []byte
+	Expiration      time.Time
+	ReplyPrivateKey *ecdh.PrivateKey
+}
+
+// invitationReply is written to the inviting party's spool by the invitee.
+type invitationReply struct {
+	ID       []byte
+	Exchange *UnreliableDoubleRatchetChannelExchange
+}
+
+// Invite returns a serialized UnreliableDoubleRatchetChannelInvitation
+// which expires after the given lifetime. The channel completes on the
+// first Read after the invitee accepted the invitation. Only the first
+// reply is accepted, an invitation can not be used twice.
+func (r *UnreliableDoubleRatchetChannel) Invite(lifetime time.Duration) ([]byte, error) {
+	if r.PendingInvitation != nil {
+		return nil, errors.New("an invitation is already pending")
+	}
+	exchange, err := r.channelExchange()
+	if err != nil {
+		return nil, err
+	}
+	replyPrivateKey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, invitationIDLength)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+	invitation := UnreliableDoubleRatchetChannelInvitation{
+		ID:                  id,
+		Expiration:          time.Now().Add(lifetime).UTC(),
+		SpoolWriter:         exchange.SpoolWriter,
+		SignedKeyExchange:   exchange.SignedKeyExchange,
+		DeniableKeyExchange: exchange.DeniableKeyExchange,
+		ReplyPublicKey:      replyPrivateKey.PublicKey(),
+	}
+	var serialized []byte
+	err = codec.NewEncoderBytes(&serialized, cborHandle).Encode(invitation)
+	if err != nil {
+		return nil, err
+	}
+	r.PendingInvitation = &PendingInvitation{
+		ID:              id,
+		Expiration:      invitation.Expiration,
+		ReplyPrivateKey: replyPrivateKey,
+	}
+	return serialized, nil
+}
+
+// AcceptInvitation consumes a serialized UnreliableDoubleRatchetChannelInvitation,
+// connects our channel to the inviting party and writes our exchange to
+// their spool. The channel may be written to immediately afterwards.
+func (r *UnreliableDoubleRatchetChannel) AcceptInvitation(cborInvitation []byte) error {
+	invitation := new(UnreliableDoubleRatchetChannelInvitation)
+	err := codec.NewDecoderBytes(cborInvitation, cborHandle).Decode(invitation)
+	if err != nil {
+		return err
+	}
+	if invitation.SpoolWriter == nil || invitation.ReplyPublicKey == nil {
+		return errors.New("incomplete invitation")
+	}
+	if time.Now().After(invitation.Expiration) {
+		return errors.New("invitation expired")
+	}
+
+	// Our key exchange must be created before the remote one is processed.
+	exchange, err := r.channelExchange()
+	if err != nil {
+		return err
+	}
+	remoteExchange := &UnreliableDoubleRatchetChannelExchange{
+		SpoolWriter:         invitation.SpoolWriter,
+		SignedKeyExchange:   invitation.SignedKeyExchange,
+		DeniableKeyExchange: invitation.DeniableKeyExchange,
+	}
+	// The invitation is trusted like an identity key handed over
+	// out of band, it's signer is pinned.
+	identity, err := exchangeSigner(remoteExchange)
+	if err != nil {
+		return err
+	}
+	err = r.processChannelExchange(remoteExchange, identity)
+	if err != nil {
+		return err
+	}
+
+	var serialized []byte
+	err = codec.NewEncoderBytes(&serialized, cborHandle).Encode(&invitationReply{
+		ID:       invitation.ID,
+		Exchange: exchange,
+	})
+	if err != nil {
+		return err
+	}
+	payload, err := padPayload(serialized, InvitationReplyPayloadLength)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := noiseNEncrypt(invitation.ReplyPublicKey, invitation.SpoolWriter, payload)
+	if err != nil {
+		return err
+	}
+	return r.SpoolCh.Write(ciphertext)
+}
+
+// readInvitationReply reads the invitee's reply to our pending
+// invitation, completes the channel and then reads the next message.
+func (r *UnreliableDoubleRatchetChannel) readInvitationReply() ([]byte, error) {
+	if time.Now().After(r.PendingInvitation.Expiration) {
+		r.PendingInvitation = nil
+		return nil, ErrInvitationExpired
+	}
+	ciphertext, err := r.SpoolCh.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := noiseNDecrypt(r.PendingInvitation.ReplyPrivateKey, r.SpoolCh.GetSpoolWriter(), ciphertext)
+	if err != nil {
+		return nil, &garbageError{err}
+	}
+	serialized, err := unpadPayload(payload)
+	if err != nil {
+		return nil, &garbageError{err}
+	}
+	reply := new(invitationReply)
+	err = codec.NewDecoderBytes(serialized, cborHandle).Decode(reply)
+	if err != nil {
+		return nil, &garbageError{err}
+	}
+	if !bytes.Equal(reply.ID, r.PendingInvitation.ID) || reply.Exchange == nil {
+		return nil, &garbageError{errors.New("invalid invitation reply")}
+	}
+	// Only the invitee can encrypt to our reply key,
+	// the signer of it's exchange is pinned.
+	identity, err := exchangeSigner(reply.Exchange)
+	if err != nil {
+		return nil, err
+	}
+	err = r.processChannelExchange(reply.Exchange, identity)
+	if err != nil {
+		return nil, err
+	}
+	r.PendingInvitation = nil
+	return r.Read()
+}
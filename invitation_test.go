@@ -0,0 +1,145 @@
+// invitation_test.go - Double Ratchet channel invitation tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvitation(t *testing.T) {
+	assert := assert.New(t)
+
+	ratchetChanA, ratchetChanB := newTestUnexchangedRatchetPair(t)
+
+	invitation, err := ratchetChanA.Invite(time.Hour)
+	assert.NoError(err)
+	_, err = ratchetChanA.Invite(time.Hour)
+	assert.Error(err)
+
+	// Alice's pending invitation survives Save and Load.
+	blob, err := ratchetChanA.Save()
+	assert.NoError(err)
+	ratchetChanA, err = LoadUnreliableDoubleRatchetChannel(blob, ratchetChanA.SpoolCh.spoolService)
+	assert.NoError(err)
+	assert.NotNil(ratchetChanA.PendingInvitation)
+
+	// polling before the reply arrived does not lose it
+	_, err = ratchetChanA.Read()
+	assert.Equal(ErrNoMessage, err)
+
+	err = ratchetChanB.AcceptInvitation(invitation)
+	assert.NoError(err)
+
+	msg1 := []byte("Bob can write right away.")
+	err = ratchetChanB.Write(msg1)
+	assert.NoError(err)
+
+	msg1Read, err := ratchetChanA.Read()
+	assert.NoError(err)
+	assert.Equal(msg1, msg1Read)
+	assert.Nil(ratchetChanA.PendingInvitation)
+
+	_, err = ratchetChanB.Read()
+	assert.Equal(ErrNoMessage, err)
+	msg2 := []byte("Alice can reply.")
+	err = ratchetChanA.Write(msg2)
+	assert.NoError(err)
+	msg2Read, err := ratchetChanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg2, msg2Read)
+
+	numberA, err := ratchetChanA.SafetyNumber()
+	assert.NoError(err)
+	numberB, err := ratchetChanB.SafetyNumber()
+	assert.NoError(err)
+	assert.Equal(numberA, numberB)
+}
+
+func TestInvitationSingleUse(t *testing.T) {
+	assert := assert.New(t)
+
+	ratchetChanA, ratchetChanB := newTestUnexchangedRatchetPair(t)
+	spoolC, err := NewUnreliableSpoolChannel("receiver_C", "provider_C", ratchetChanA.SpoolCh.spoolService)
+	assert.NoError(err)
+	ratchetChanC, err := NewUnreliableDoubleRatchetChannel(spoolC)
+	assert.NoError(err)
+
+	invitation, err := ratchetChanA.Invite(time.Hour)
+	assert.NoError(err)
+	err = ratchetChanB.AcceptInvitation(invitation)
+	assert.NoError(err)
+	err = ratchetChanC.AcceptInvitation(invitation)
+	assert.NoError(err)
+
+	msg := []byte("Only Bob got in.")
+	err = ratchetChanB.Write(msg)
+	assert.NoError(err)
+
+	// Bob's reply completes the channel, Carol's is then
+	// no more than an undecryptable ratchet message.
+	_, err = ratchetChanA.Read()
+	assert.Error(err)
+	assert.Nil(ratchetChanA.PendingInvitation)
+	msgRead, err := ratchetChanA.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+}
+
+func TestInvitationExpiration(t *testing.T) {
+	assert := assert.New(t)
+
+	ratchetChanA, ratchetChanB := newTestUnexchangedRatchetPair(t)
+
+	invitation, err := ratchetChanA.Invite(-time.Minute)
+	assert.NoError(err)
+	err = ratchetChanB.AcceptInvitation(invitation)
+	assert.Error(err)
+
+	ratchetChanA, ratchetChanB = newTestUnexchangedRatchetPair(t)
+	invitation, err = ratchetChanA.Invite(time.Hour)
+	assert.NoError(err)
+	err = ratchetChanB.AcceptInvitation(invitation)
+	assert.NoError(err)
+
+	// The reply arrives after the invitation expired.
+	ratchetChanA.PendingInvitation.Expiration = time.Now().Add(-time.Minute)
+	_, err = ratchetChanA.Read()
+	assert.Equal(ErrInvitationExpired, err)
+	assert.Nil(ratchetChanA.PendingInvitation)
+}
+
+func TestInvitationSkipGarbage(t *testing.T) {
+	assert := assert.New(t)
+
+	ratchetChanA, ratchetChanB := newTestUnexchangedRatchetPair(t)
+	ratchetChanA.SkipGarbage = true
+	invitation, err := ratchetChanA.Invite(time.Hour)
+	assert.NoError(err)
+
+	// Anyone may append to the inviting party's spool.
+	assert.NoError(ratchetChanA.SpoolCh.GetSpoolWriter().Write(ratchetChanA.SpoolCh.spoolService, []byte("junk")))
+	assert.NoError(ratchetChanB.AcceptInvitation(invitation))
+	msg := []byte("hello")
+	assert.NoError(ratchetChanB.Write(msg))
+	msgRead, err := ratchetChanA.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+	assert.Equal(uint64(1), ratchetChanA.SkippedEntries)
+}
@@ -17,10 +17,14 @@
 package channels
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/memspool/client"
 	"github.com/katzenpost/noise"
@@ -35,6 +39,38 @@ const (
 
 	// NoisePayloadLength is the length of the noise payload.
 	NoisePayloadLength = SpoolPayloadLength - NoiseOverhead
+
+	// NoiseNOverhead is amount of bytes overhead from the Noise N
+	// encryption used for messages from anonymous senders.
+	NoiseNOverhead = keyLength + macLength // e, es
+
+	// NoiseRekeyGracePeriod is how long replaced Noise static keys
+	// are accepted for messages which were in flight.
+	NoiseRekeyGracePeriod = 7 * 24 * time.Hour
+
+	// NoiseReplayCacheSize is the number of nonces of WriteMulti kept
+	// to detect replayed messages. The nonces are random and can not be
+	// ordered, so a message replayed after NoiseReplayCacheSize newer
+	// messages of WriteMulti were read is accepted again.
+	NoiseReplayCacheSize = 1000
+
+	noiseMessageHeaderLength = 1 + sequenceLength // type, sequence number or nonce
+)
+
+// The message types of the messages carried by the Noise channel.
+const (
+	noiseDataMessage byte = iota
+	noiseRekeyMessage
+	noiseRekeyAckMessage
+	noiseReceiptMessage
+	noiseTranscriptMessage
+	noiseMulticastMessage
+)
+
+// The labels of the spool bindings used as Noise prologues.
+const (
+	noiseXBindingLabel = "katzenpost channels noise X"
+	noiseNBindingLabel = "katzenpost channels noise N"
 )
 
 // NoiseWriterDescriptor contains the information necessary
@@ -42,6 +78,29 @@ const (
 type NoiseWriterDescriptor struct {
 	SpoolWriterChan      *UnreliableSpoolWriterChannel
 	RemoteNoisePublicKey *ecdh.PublicKey
+
+	// Signature is set if the spool's owner signed this descriptor.
+	Signature *WriterSignature
+}
+
+// signedData returns the data covered by the signature of this descriptor.
+func (d *NoiseWriterDescriptor) signedData() []byte {
+	return append(d.SpoolWriterChan.signedData(), d.RemoteNoisePublicKey.Bytes()...)
+}
+
+// Sign signs this descriptor with the identity key of the spool's
+// owner, the signature expires after the given lifetime.
+func (d *NoiseWriterDescriptor) Sign(identity *eddsa.PrivateKey, lifetime time.Duration) {
+	d.Signature = signWriter(identity, lifetime, d.signedData())
+}
+
+// Verify returns an error unless this descriptor carries an
+// unexpired signature by the given identity key.
+func (d *NoiseWriterDescriptor) Verify(identity *eddsa.PublicKey) error {
+	if d == nil || d.SpoolWriterChan == nil || d.RemoteNoisePublicKey == nil {
+		return errors.New("incomplete noise writer descriptor")
+	}
+	return verifyWriter(d.Signature, identity, d.signedData())
 }
 
 // UnreliableNoiseChannel is an unreliable channel which encrypts using
@@ -55,10 +114,68 @@ type UnreliableNoiseChannel struct {
 	SpoolReaderChan *UnreliableSpoolReaderChannel
 	NoisePrivateKey *ecdh.PrivateKey
 	ReadOffset      uint32
+
+	// IdentityPrivateKey signs the descriptors returned by
+	// GetRemoteWriter. RemoteIdentityKey is the pinned identity
+	// key of the remote party, which must sign it's descriptors.
+	IdentityPrivateKey *eddsa.PrivateKey
+	RemoteIdentityKey  *eddsa.PublicKey
+
+	// Verified is set once the user has compared safety numbers
+	// with the remote party and is reset when the remote key changes.
+	// The safety number is derived from the Noise static keys, it is
+	// therefore also reset when either key is rotated in band.
+	Verified bool
+
+	// PendingNoisePrivateKey is our announced new static key which
+	// replaces NoisePrivateKey once the remote party acknowledged it.
+	PendingNoisePrivateKey *ecdh.PrivateKey
+
+	// PreviousNoisePrivateKey and PreviousRemoteNoisePublicKey are
+	// the rotated static keys, they are accepted for messages in
+	// flight until their expiration.
+	PreviousNoisePrivateKey      *ecdh.PrivateKey
+	PreviousNoiseKeyExpiration   time.Time
+	PreviousRemoteNoisePublicKey *ecdh.PublicKey
+	PreviousRemoteKeyExpiration  time.Time
+
+	// ReceivedNonces holds the nonces of the last messages of
+	// WriteMulti read, which are unsequenced.
+	ReceivedNonces []uint64
+
+	// SkipGarbage makes Read skip spool entries which fail to
+	// authenticate rather than return an error, SkippedEntries
+	// counts the skipped entries.
+	SkipGarbage    bool
+	SkippedEntries uint64
+
+	// Receipts is set once receipts are enabled, by EnableReceipts
+	// or by reading a message of a remote party which enabled them.
+	Receipts *Receipts
+
+	// Sequence numbers our messages and detects the remote party's
+	// messages which went missing or were appended to our spool again.
+	Sequence Sequence
+
+	// Transcript hash chains our messages and the remote party's,
+	// digests of both are exchanged to detect tampering.
+	Transcript Transcript
 }
 
-// NewUnreliableNoiseChannel creates and returns a new UnreliableNoiseChannel or an error.
+// NewUnreliableNoiseChannel creates and returns a new UnreliableNoiseChannel
+// with a new identity key, or an error.
 func NewUnreliableNoiseChannel(spoolReceiver, spoolProvider string, spool client.SpoolService) (*UnreliableNoiseChannel, error) {
+	identityPrivateKey, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewUnreliableNoiseChannelWithIdentity(spoolReceiver, spoolProvider, identityPrivateKey, spool)
+}
+
+// NewUnreliableNoiseChannelWithIdentity creates and returns a new
+// UnreliableNoiseChannel whose descriptors are signed by the given
+// long-term identity key, or an error.
+func NewUnreliableNoiseChannelWithIdentity(spoolReceiver, spoolProvider string, identityPrivateKey *eddsa.PrivateKey, spool client.SpoolService) (*UnreliableNoiseChannel, error) {
 	noisePrivateKey, err := ecdh.NewKeypair(rand.Reader)
 	if err != nil {
 		return nil, err
@@ -74,79 +191,350 @@ func NewUnreliableNoiseChannel(spoolReceiver, spoolProvider string, spool client
 		SpoolReaderChan:      spoolReader,
 		NoisePrivateKey:      noisePrivateKey,
 		ReadOffset:           1,
+		IdentityPrivateKey:   identityPrivateKey,
 	}, nil
 }
 
+// expectedIdentity returns the identity key a remote party's writer
+// must be signed by, the given key or else the pinned one.
+func expectedIdentity(identity, pinned *eddsa.PublicKey) (*eddsa.PublicKey, error) {
+	switch {
+	case identity == nil && pinned == nil:
+		return nil, errors.New("remote identity key must be given")
+	case identity == nil:
+		return pinned, nil
+	case pinned != nil && !pinned.Equal(identity):
+		return nil, errors.New("remote identity key differs from the pinned one")
+	}
+	return identity, nil
+}
+
 // WithRemoteWriter allows this channel to write to a remote spool.
-func (n *UnreliableNoiseChannel) WithRemoteWriter(writerDesc *NoiseWriterDescriptor) {
-	if writerDesc.SpoolWriterChan == nil || writerDesc.RemoteNoisePublicKey == nil {
-		panic("writer channel must not be nil")
+// The descriptor must be signed by the given identity key of the
+// remote party, or by the pinned RemoteIdentityKey if it is nil.
+// The identity key is pinned afterwards.
+func (n *UnreliableNoiseChannel) WithRemoteWriter(writerDesc *NoiseWriterDescriptor, identity *eddsa.PublicKey) error {
+	identity, err := expectedIdentity(identity, n.RemoteIdentityKey)
+	if err != nil {
+		return err
+	}
+	if err := writerDesc.Verify(identity); err != nil {
+		return err
+	}
+	n.RemoteIdentityKey = identity
+	if n.RemoteNoisePublicKey == nil || !n.RemoteNoisePublicKey.Equal(writerDesc.RemoteNoisePublicKey) {
+		n.Verified = false
 	}
 	n.SpoolWriterChan = writerDesc.SpoolWriterChan
 	n.RemoteNoisePublicKey = writerDesc.RemoteNoisePublicKey
+	return nil
+}
+
+// SafetyNumber returns the safety number derived from our and
+// the remote party's Noise static keys.
+func (n *UnreliableNoiseChannel) SafetyNumber() (string, error) {
+	if n.RemoteNoisePublicKey == nil {
+		return "", errors.New("remote Noise key must not be nil")
+	}
+	return SafetyNumber(n.NoisePrivateKey.PublicKey().Bytes(), n.RemoteNoisePublicKey.Bytes()), nil
+}
+
+// MarkVerified records that the user has verified the safety number.
+func (n *UnreliableNoiseChannel) MarkVerified() error {
+	if n.RemoteNoisePublicKey == nil {
+		return errors.New("remote Noise key must not be nil")
+	}
+	n.Verified = true
+	return nil
 }
 
 // GetRemoteWriter returns a NoiseWriterDescriptor which describes how
-// a writer can write to the spool we are reading.
+// a writer can write to the spool we are reading. It is signed by our
+// identity key and expires after WriterDescriptorLifetime.
 func (n *UnreliableNoiseChannel) GetRemoteWriter() *NoiseWriterDescriptor {
-	return &NoiseWriterDescriptor{
+	desc := &NoiseWriterDescriptor{
 		SpoolWriterChan:      n.SpoolReaderChan.GetSpoolWriter(),
 		RemoteNoisePublicKey: n.NoisePrivateKey.PublicKey(),
 	}
+	if n.IdentityPrivateKey != nil {
+		desc.Sign(n.IdentityPrivateKey, WriterDescriptorLifetime)
+	}
+	return desc
+}
+
+// recipientKeys returns our static keys which messages may be encrypted to.
+func (n *UnreliableNoiseChannel) recipientKeys() []*ecdh.PrivateKey {
+	keys := []*ecdh.PrivateKey{n.NoisePrivateKey}
+	if n.PendingNoisePrivateKey != nil {
+		keys = append(keys, n.PendingNoisePrivateKey)
+	}
+	if n.PreviousNoisePrivateKey != nil && time.Now().Before(n.PreviousNoiseKeyExpiration) {
+		keys = append(keys, n.PreviousNoisePrivateKey)
+	}
+	return keys
 }
 
-// Read reads from a remote spool and decrypts.
+// decrypt decrypts a ciphertext encrypted to any of our static
+// keys and returns the plaintext and the sender's static key.
+func (n *UnreliableNoiseChannel) decrypt(ciphertext []byte) ([]byte, *ecdh.PublicKey, error) {
+	prologue := spoolBinding(noiseXBindingLabel, n.SpoolReaderChan.GetSpoolWriter())
+	var err error
+	for _, key := range n.recipientKeys() {
+		cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+		recipientDH := noise.DHKey{
+			Private: key.Bytes(),
+			Public:  key.PublicKey().Bytes(),
+		}
+		var hs *noise.HandshakeState
+		hs, err = noise.NewHandshakeState(noise.Config{
+			CipherSuite:   cs,
+			Random:        rand.Reader,
+			Pattern:       noise.HandshakeX,
+			Initiator:     false,
+			StaticKeypair: recipientDH,
+			PeerStatic:    nil,
+			Prologue:      prologue,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		var plaintext []byte
+		plaintext, _, _, err = hs.ReadMessage(nil, ciphertext)
+		if err != nil {
+			continue
+		}
+		senderPk := new(ecdh.PublicKey)
+		if err = senderPk.FromBytes(hs.PeerStatic()); err != nil {
+			panic("BUG: block: Failed to de-serialize peer static key: " + err.Error())
+		}
+		return plaintext, senderPk, nil
+	}
+	return nil, nil, err
+}
+
+// Read reads from a remote spool and decrypts. Control messages
+// are processed and the next message is read in their place.
 func (n *UnreliableNoiseChannel) Read() ([]byte, error) {
+	return skipGarbage(n.SkipGarbage, &n.SkippedEntries, n.readMessage)
+}
+
+func (n *UnreliableNoiseChannel) readMessage() ([]byte, error) {
 	ciphertext, err := n.SpoolReaderChan.Read(n.spoolService)
 	if err != nil {
 		return nil, err
 	}
+	plaintext, senderPk, err := n.decrypt(ciphertext)
+	if err != nil {
+		return nil, &garbageError{err}
+	}
 
-	// Decrypt the ciphertext into a plaintext.
-	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
-	recipientDH := noise.DHKey{
-		Private: n.NoisePrivateKey.Bytes(),
-		Public:  n.NoisePrivateKey.PublicKey().Bytes(),
+	// Check that the sender's static Noise X key is the key we expected.
+	current := n.RemoteNoisePublicKey.Equal(senderPk)
+	previous := n.PreviousRemoteNoisePublicKey != nil && n.PreviousRemoteNoisePublicKey.Equal(senderPk) &&
+		time.Now().Before(n.PreviousRemoteKeyExpiration)
+	if !current && !previous {
+		return nil, &garbageError{errors.New("wtf, wrong partner Noise X key")}
+	}
+
+	if len(plaintext) < noiseMessageHeaderLength {
+		return nil, errors.New("message header is truncated")
+	}
+	messageType, counter, body := plaintext[0], plaintext[1:noiseMessageHeaderLength], plaintext[noiseMessageHeaderLength:]
+	if messageType == noiseMulticastMessage {
+		if err := n.receivedNonce(binary.BigEndian.Uint64(counter)); err != nil {
+			return nil, &garbageError{err}
+		}
+		return body, nil
+	}
+	if decodeSequence(counter) == 0 || !n.Sequence.received(counter) {
+		return nil, &garbageError{errors.New("replayed message")}
+	}
+	n.Transcript.received(counter, messageType, body)
+	switch messageType {
+	case noiseDataMessage:
+		return body, nil
+	case noiseReceiptMessage:
+		if n.Receipts == nil {
+			n.Receipts = new(Receipts)
+		}
+		message, isData, err := n.Receipts.open(body)
+		if err != nil || isData {
+			return message, err
+		}
+	case noiseRekeyMessage:
+		if !current {
+			return nil, errors.New("rekey must be authenticated by the current key")
+		}
+		err = n.processRekey(body)
+	case noiseRekeyAckMessage:
+		err = n.processRekeyAck(body)
+	case noiseTranscriptMessage:
+		err = n.Transcript.processDigest(body)
+	default:
+		err = fmt.Errorf("unknown message type: %d", messageType)
 	}
-	hs, err := noise.NewHandshakeState(noise.Config{
-		CipherSuite:   cs,
-		Random:        rand.Reader,
-		Pattern:       noise.HandshakeX,
-		Initiator:     false,
-		StaticKeypair: recipientDH,
-		PeerStatic:    nil,
-	})
 	if err != nil {
 		return nil, err
 	}
-	plaintext, _, _, err := hs.ReadMessage(nil, ciphertext)
+	return n.Read()
+}
+
+// Write encrypts and write to a remote spool.
+func (n *UnreliableNoiseChannel) Write(message []byte) error {
+	if err := n.sendDueTranscriptDigest(); err != nil {
+		return err
+	}
+	if n.Receipts != nil {
+		_, err := n.writeReceipted(message, true, false)
+		return err
+	}
+	return n.writeMessage(noiseDataMessage, message)
+}
+
+// EnableReceipts makes our messages carry an ID and the receipts we
+// owe, the remote party answers them with delivery receipts.
+func (n *UnreliableNoiseChannel) EnableReceipts() {
+	if n.Receipts == nil {
+		n.Receipts = new(Receipts)
+	}
+}
+
+// WriteTracked writes a message and returns it's ID, which the status
+// of the message is queried with. If requestRead is set the remote
+// party is asked for a read receipt. Receipts must be enabled.
+func (n *UnreliableNoiseChannel) WriteTracked(message []byte, requestRead bool) (uint64, error) {
+	if n.Receipts == nil {
+		return 0, errors.New("receipts are not enabled")
+	}
+	if err := n.sendDueTranscriptDigest(); err != nil {
+		return 0, err
+	}
+	return n.writeReceipted(message, true, requestRead)
+}
+
+// FlushReceipts writes the receipts we owe, if any, in a message
+// of their own rather than along with our next message.
+func (n *UnreliableNoiseChannel) FlushReceipts() error {
+	if n.Receipts == nil || !n.Receipts.pending() {
+		return nil
+	}
+	_, err := n.writeReceipted(nil, false, false)
+	return err
+}
+
+func (n *UnreliableNoiseChannel) writeReceipted(message []byte, track, requestRead bool) (uint64, error) {
+	envelope, err := n.Receipts.envelope(message, track, requestRead, n.maxMessageLength())
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	err = n.writeMessage(noiseReceiptMessage, envelope.encode())
+	if err != nil {
+		return 0, err
+	}
+	n.Receipts.sent(envelope)
+	return envelope.ID, nil
+}
 
-	// Check that the sender's static Noise X key is the key we expected.
-	senderPk := new(ecdh.PublicKey)
-	if err = senderPk.FromBytes(hs.PeerStatic()); err != nil {
-		panic("BUG: block: Failed to de-serialize peer static key: " + err.Error())
+// SendTranscriptDigest writes the digest of our transcripts, the
+// remote party's Read returns a *TranscriptAlert if they diverged
+// from it's own. Digests are also written every
+// TranscriptDigestInterval messages.
+func (n *UnreliableNoiseChannel) SendTranscriptDigest() error {
+	digest, err := n.Transcript.digest()
+	if err != nil {
+		return err
 	}
-	if !n.RemoteNoisePublicKey.Equal(senderPk) {
-		return nil, errors.New("wtf, wrong partner Noise X key")
+	err = n.writeMessage(noiseTranscriptMessage, digest)
+	if err != nil {
+		return err
 	}
+	n.Transcript.SinceDigest = 0
+	return nil
+}
 
-	return plaintext, nil
+func (n *UnreliableNoiseChannel) sendDueTranscriptDigest() error {
+	if !n.Transcript.due() {
+		return nil
+	}
+	return n.SendTranscriptDigest()
 }
 
-// Write encrypts and write to a remote spool.
-func (n *UnreliableNoiseChannel) Write(message []byte) error {
-	if len(message) > NoisePayloadLength {
-		return fmt.Errorf("exceeds noise channel payload maximum: %d > %d", len(message), NoisePayloadLength)
-		//return errors.New("exceeds noise channel payload maximum")
+// ReadWithGaps is like Read except that it also returns the gaps in
+// the remote party's messages detected since the last call.
+func (n *UnreliableNoiseChannel) ReadWithGaps() ([]byte, []MessageGap, error) {
+	message, err := n.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	return message, n.Sequence.TakeGaps(), nil
+}
+
+// ReadTracked is like Read except that it also returns the ID of the
+// message, which is zero unless the remote party enabled receipts.
+func (n *UnreliableNoiseChannel) ReadTracked() (uint64, []byte, error) {
+	if n.Receipts != nil {
+		n.Receipts.lastID = 0
+	}
+	message, err := n.Read()
+	if err != nil || n.Receipts == nil {
+		return 0, message, err
+	}
+	return n.Receipts.lastID, message, nil
+}
+
+// receivedNonce records the nonce of a message of WriteMulti read
+// and rejects replayed messages, only the last NoiseReplayCacheSize
+// nonces are remembered.
+func (n *UnreliableNoiseChannel) receivedNonce(nonce uint64) error {
+	for _, received := range n.ReceivedNonces {
+		if received == nonce {
+			return errors.New("replayed message")
+		}
 	}
+	n.ReceivedNonces = append(n.ReceivedNonces, nonce)
+	if len(n.ReceivedNonces) > NoiseReplayCacheSize {
+		n.ReceivedNonces = n.ReceivedNonces[len(n.ReceivedNonces)-NoiseReplayCacheSize:]
+	}
+	return nil
+}
+
+// maxMessageLength returns the maximum length of the messages written
+// to the remote party, which is shorter if their spool requires stamps.
+func (n *UnreliableNoiseChannel) maxMessageLength() int {
+	if n.SpoolWriterChan == nil {
+		return NoisePayloadLength - noiseMessageHeaderLength
+	}
+	return n.SpoolWriterChan.PayloadLength() - NoiseOverhead - noiseMessageHeaderLength
+}
+
+func (n *UnreliableNoiseChannel) writeMessage(messageType byte, message []byte) error {
+	if len(message) > n.maxMessageLength() {
+		return fmt.Errorf("exceeds noise channel payload maximum: %d > %d", len(message), n.maxMessageLength())
+	}
+	// the sequence number is never reused, even if the write fails
+	sequence := n.Sequence.next()
+	err := n.writeTo(n.NoisePrivateKey, &NoiseWriterDescriptor{
+		SpoolWriterChan:      n.SpoolWriterChan,
+		RemoteNoisePublicKey: n.RemoteNoisePublicKey,
+	}, messageType, sequence, message)
+	if err != nil {
+		return err
+	}
+	n.Transcript.sent(sequence, messageType, message)
+	return nil
+}
 
+// writeTo encrypts the message with the given static key of ours to
+// the given recipient, it's header carries the given sequence
+// number or nonce.
+func (n *UnreliableNoiseChannel) writeTo(senderKey *ecdh.PrivateKey, recipient *NoiseWriterDescriptor, messageType byte, counter, message []byte) error {
+	if recipient.SpoolWriterChan == nil || recipient.RemoteNoisePublicKey == nil {
+		return errors.New("incomplete noise writer descriptor")
+	}
 	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
 	senderDH := noise.DHKey{
-		Private: n.NoisePrivateKey.Bytes(),
-		Public:  n.NoisePrivateKey.PublicKey().Bytes(),
+		Private: senderKey.Bytes(),
+		Public:  senderKey.PublicKey().Bytes(),
 	}
 	hs, err := noise.NewHandshakeState(noise.Config{
 		CipherSuite:   cs,
@@ -154,16 +542,211 @@ func (n *UnreliableNoiseChannel) Write(message []byte) error {
 		Pattern:       noise.HandshakeX,
 		Initiator:     true,
 		StaticKeypair: senderDH,
-		PeerStatic:    n.RemoteNoisePublicKey.Bytes(),
+		PeerStatic:    recipient.RemoteNoisePublicKey.Bytes(),
+		Prologue:      spoolBinding(noiseXBindingLabel, recipient.SpoolWriterChan),
 	})
 	if err != nil {
 		return err
 	}
-	ciphertext, _, _, err := hs.WriteMessage(nil, message)
+	header := append([]byte{messageType}, counter...)
+	ciphertext, _, _, err := hs.WriteMessage(nil, append(header, message...))
 	if err != nil {
 		return err
 	}
-	return n.SpoolWriterChan.Write(n.spoolService, ciphertext)
+	return recipient.SpoolWriterChan.Write(n.spoolService, ciphertext)
+}
+
+// NoiseRecipient is a recipient of WriteMulti, it's descriptor
+// must be signed by the given identity key. SenderKey is the static
+// key the recipient knows us by, such as the NoisePrivateKey of the
+// channel we share with them, this channel's NoisePrivateKey if nil.
+type NoiseRecipient struct {
+	Descriptor  *NoiseWriterDescriptor
+	IdentityKey *eddsa.PublicKey
+	SenderKey   *ecdh.PrivateKey
+}
+
+// write encrypts the message to this recipient and writes it to their
+// spool, after verifying their descriptor and checking that the message
+// fits their spool.
+func (r *NoiseRecipient) write(n *UnreliableNoiseChannel, message []byte) error {
+	if r.Descriptor == nil || r.Descriptor.SpoolWriterChan == nil {
+		return errors.New("incomplete noise writer descriptor")
+	}
+	if r.IdentityKey == nil {
+		return errors.New("recipient identity key must not be nil")
+	}
+	if err := r.Descriptor.Verify(r.IdentityKey); err != nil {
+		return err
+	}
+	maxLength := r.Descriptor.SpoolWriterChan.PayloadLength() - NoiseOverhead - noiseMessageHeaderLength
+	if len(message) > maxLength {
+		return fmt.Errorf("exceeds noise channel payload maximum: %d > %d", len(message), maxLength)
+	}
+	senderKey := r.SenderKey
+	if senderKey == nil {
+		senderKey = n.NoisePrivateKey
+	}
+	nonce, err := randomBytes(sequenceLength)
+	if err != nil {
+		return err
+	}
+	return n.writeTo(senderKey, r.Descriptor, noiseMulticastMessage, nonce, message)
+}
+
+// RecipientError is the error of writing to one of the recipients of WriteMulti.
+type RecipientError struct {
+	Recipient *NoiseRecipient
+	Err       error
+}
+
+// MultiWriteError is returned by WriteMulti when writing to some of the
+// recipients failed, the message was written to all others.
+type MultiWriteError struct {
+	Recipients int
+	Failures   []*RecipientError
+}
+
+func (e *MultiWriteError) Error() string {
+	return fmt.Sprintf("failed to write to %d of %d recipients: %s", len(e.Failures), e.Recipients, e.Failures[0].Err)
+}
+
+// WriteMulti encrypts the message to each of the given recipients with
+// the static key they know us by and writes it to their spools. Each
+// recipient's descriptor is verified against it's identity key first
+// and the message must fit each recipient's spool, which is shorter if
+// it requires stamps. Keys rotated with RotateKey are only announced to
+// this channel's remote party, the recipients sharing this channel's
+// NoisePrivateKey must be given the current one.
+//
+// The messages are unsequenced, they carry a random nonce rather than
+// a counter as the recipients do not share a sequence. The recipients
+// reject a replayed nonce among the last NoiseReplayCacheSize they read,
+// an older message replayed by their spool's Provider is read again.
+// Their Sequence and Transcript do not track these messages: a
+// message of WriteMulti which is lost or withheld goes undetected,
+// unlike a message of Write.
+//
+// A *MultiWriteError reports the recipients writing to failed.
+func (n *UnreliableNoiseChannel) WriteMulti(recipients []*NoiseRecipient, message []byte) error {
+	var failures []*RecipientError
+	for _, recipient := range recipients {
+		if err := recipient.write(n, message); err != nil {
+			failures = append(failures, &RecipientError{
+				Recipient: recipient,
+				Err:       err,
+			})
+		}
+	}
+	if failures != nil {
+		return &MultiWriteError{
+			Recipients: len(recipients),
+			Failures:   failures,
+		}
+	}
+	return nil
+}
+
+// RotateKey announces a new static key to the remote party, authenticated
+// by our current one. We switch to the new key once the remote party
+// acknowledged it, the old key is kept for NoiseRekeyGracePeriod. The
+// safety number changes and both parties must verify it again.
+func (n *UnreliableNoiseChannel) RotateKey() error {
+	if n.PendingNoisePrivateKey != nil {
+		return errors.New("a key rotation is already pending")
+	}
+	pendingKey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		return err
+	}
+	err = n.writeMessage(noiseRekeyMessage, pendingKey.PublicKey().Bytes())
+	if err != nil {
+		return err
+	}
+	n.PendingNoisePrivateKey = pendingKey
+	return nil
+}
+
+// processRekey switches to the remote party's announced key and
+// acknowledges it.
+func (n *UnreliableNoiseChannel) processRekey(body []byte) error {
+	newKey := new(ecdh.PublicKey)
+	if err := newKey.FromBytes(body); err != nil {
+		return err
+	}
+	previousKey := n.RemoteNoisePublicKey
+	n.RemoteNoisePublicKey = newKey
+	err := n.writeMessage(noiseRekeyAckMessage, body)
+	if err != nil {
+		n.RemoteNoisePublicKey = previousKey
+		return err
+	}
+	n.PreviousRemoteNoisePublicKey = previousKey
+	n.PreviousRemoteKeyExpiration = time.Now().Add(NoiseRekeyGracePeriod)
+	n.Verified = false
+	return nil
+}
+
+// processRekeyAck switches to our pending key.
+func (n *UnreliableNoiseChannel) processRekeyAck(body []byte) error {
+	if n.PendingNoisePrivateKey == nil || !bytes.Equal(n.PendingNoisePrivateKey.PublicKey().Bytes(), body) {
+		return errors.New("unexpected rekey acknowledgement")
+	}
+	n.PreviousNoisePrivateKey = n.NoisePrivateKey
+	n.PreviousNoiseKeyExpiration = time.Now().Add(NoiseRekeyGracePeriod)
+	n.NoisePrivateKey = n.PendingNoisePrivateKey
+	n.PendingNoisePrivateKey = nil
+	n.Verified = false
+	return nil
+}
+
+// noiseNEncrypt encrypts the payload to the given recipient key using
+// the Noise N one-way pattern which does not authenticate the sender.
+// The ciphertext is bound to the spool it is written to.
+func noiseNEncrypt(recipient *ecdh.PublicKey, spool *UnreliableSpoolWriterChannel, payload []byte) ([]byte, error) {
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite: cs,
+		Random:      rand.Reader,
+		Pattern:     noise.HandshakeN,
+		Initiator:   true,
+		PeerStatic:  recipient.Bytes(),
+		Prologue:    spoolBinding(noiseNBindingLabel, spool),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, _, _, err := hs.WriteMessage(nil, payload)
+	if err != nil {
+		return nil, err
+	}
+	return ciphertext, nil
+}
+
+// noiseNDecrypt decrypts a ciphertext created by noiseNEncrypt
+// which was read from the given spool.
+func noiseNDecrypt(recipient *ecdh.PrivateKey, spool *UnreliableSpoolWriterChannel, ciphertext []byte) ([]byte, error) {
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+	recipientDH := noise.DHKey{
+		Private: recipient.Bytes(),
+		Public:  recipient.PublicKey().Bytes(),
+	}
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   cs,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeN,
+		Initiator:     false,
+		StaticKeypair: recipientDH,
+		Prologue:      spoolBinding(noiseNBindingLabel, spool),
+	})
+	if err != nil {
+		return nil, err
+	}
+	plaintext, _, _, err := hs.ReadMessage(nil, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return plaintext, nil
 }
 
 // SetSpoolService sets this channel's spoolService field.
@@ -18,6 +18,7 @@ package channels
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -37,12 +38,10 @@ func newTestNoiseChannelPair(t *testing.T) (*UnreliableNoiseChannel, *Unreliable
 	assert.NoError(err)
 
 	chanADescriptor := chanA.GetRemoteWriter()
-	chanB.WithRemoteWriter(chanADescriptor)
-	assert.NoError(err)
+	assert.NoError(chanB.WithRemoteWriter(chanADescriptor, chanA.IdentityPrivateKey.PublicKey()))
 
 	chanBDescriptor := chanB.GetRemoteWriter()
-	chanA.WithRemoteWriter(chanBDescriptor)
-	assert.NoError(err)
+	assert.NoError(chanA.WithRemoteWriter(chanBDescriptor, chanB.IdentityPrivateKey.PublicKey()))
 
 	return chanA, chanB
 }
@@ -114,3 +113,338 @@ modern political parlance. The author offered mix nets for a solution. 50`)
 	assert.NoError(err)
 	assert.Equal(msg2, msg2Read)
 }
+
+func TestNoiseKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+	chanA, chanB := newTestNoiseChannelPair(t)
+	spool := chanA.spoolService
+	assert.NoError(chanA.MarkVerified())
+	assert.NoError(chanB.MarkVerified())
+	oldKeyA := chanA.NoisePrivateKey.PublicKey()
+
+	assert.NoError(chanA.RotateKey())
+	assert.Error(chanA.RotateKey())
+	msg1 := []byte("Written under the old key.")
+	assert.NoError(chanA.Write(msg1))
+
+	// the pending key survives Save and Load
+	blob, err := chanA.Save()
+	assert.NoError(err)
+	chanA, err = LoadUnreliableNoiseChannel(blob, spool)
+	assert.NoError(err)
+	assert.NotNil(chanA.PendingNoisePrivateKey)
+
+	// Bob's state before he learns of the new key.
+	staleB, err := chanB.Save()
+	assert.NoError(err)
+
+	msg1Read, err := chanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg1, msg1Read)
+	assert.False(chanB.RemoteNoisePublicKey.Equal(oldKeyA))
+
+	msg2 := []byte("Written to the new key.")
+	assert.NoError(chanB.Write(msg2))
+	msg2Read, err := chanA.Read()
+	assert.NoError(err)
+	assert.Equal(msg2, msg2Read)
+	assert.Nil(chanA.PendingNoisePrivateKey)
+
+	// The safety number changed and must be compared again.
+	assert.False(chanA.Verified)
+	assert.False(chanB.Verified)
+
+	numberA, err := chanA.SafetyNumber()
+	assert.NoError(err)
+	numberB, err := chanB.SafetyNumber()
+	assert.NoError(err)
+	assert.Equal(numberA, numberB)
+
+	// A message in flight to the old key is accepted
+	// during the grace period only.
+	chanStaleB, err := LoadUnreliableNoiseChannel(staleB, spool)
+	assert.NoError(err)
+	chanStaleB.Sequence.NextSend = chanB.Sequence.NextSend
+	msg3 := []byte("In flight.")
+	assert.NoError(chanStaleB.Write(msg3))
+	msg3Read, err := chanA.Read()
+	assert.NoError(err)
+	assert.Equal(msg3, msg3Read)
+
+	chanA.PreviousNoiseKeyExpiration = time.Now().Add(-time.Minute)
+	assert.NoError(chanStaleB.Write(msg3))
+	_, err = chanA.Read()
+	assert.Error(err)
+}
+
+func TestNoiseChannelSpoolBinding(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestNoiseChannelPair(t)
+
+	// chanOtherB shares chanB's keys but reads from another spool.
+	chanOtherB, err := NewUnreliableNoiseChannel("receiver_B", "provider_B", chanB.spoolService)
+	assert.NoError(err)
+	chanOtherB.NoisePrivateKey = chanB.NoisePrivateKey
+	assert.NoError(chanOtherB.WithRemoteWriter(chanA.GetRemoteWriter(), chanA.IdentityPrivateKey.PublicKey()))
+
+	msg := []byte("the Provider must not move this message")
+	assert.NoError(chanA.Write(msg))
+	ciphertext, err := chanB.SpoolReaderChan.Read(chanB.spoolService)
+	assert.NoError(err)
+
+	// the Provider replays the ciphertext into the other spool
+	err = chanOtherB.SpoolReaderChan.GetSpoolWriter().Write(chanB.spoolService, ciphertext)
+	assert.NoError(err)
+	_, err = chanOtherB.Read()
+	assert.Error(err)
+
+	// our own spool still works
+	assert.NoError(chanA.Write(msg))
+	msgRead, err := chanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+}
+
+func TestNoiseChannelReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestNoiseChannelPair(t)
+
+	msg := []byte("read me once")
+	assert.NoError(chanA.Write(msg))
+	ciphertext, err := chanB.SpoolReaderChan.Read(chanB.spoolService)
+	assert.NoError(err)
+	chanB.SpoolReaderChan.ReadOffset--
+	msgRead, err := chanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+
+	// the replay cache survives saving and loading the channel
+	serialized, err := chanB.Save()
+	assert.NoError(err)
+	chanB, err = LoadUnreliableNoiseChannel(serialized, chanA.spoolService)
+	assert.NoError(err)
+
+	err = chanB.SpoolReaderChan.GetSpoolWriter().Write(chanB.spoolService, ciphertext)
+	assert.NoError(err)
+	_, err = chanB.Read()
+	assert.EqualError(err, "replayed message")
+
+	assert.NoError(chanA.Write(msg))
+	msgRead, err = chanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+}
+
+func TestNoiseChannelSkipGarbage(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestNoiseChannelPair(t)
+	spool := chanB.spoolService
+	spoolWriter := chanB.SpoolReaderChan.GetSpoolWriter()
+	msg := []byte("hidden among junk")
+
+	assert.NoError(spoolWriter.Write(spool, []byte("junk")))
+	assert.NoError(chanA.Write(msg))
+	_, err := chanB.Read()
+	assert.Error(err)
+	msgRead, err := chanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+
+	chanB.SkipGarbage = true
+	assert.NoError(spoolWriter.Write(spool, []byte("junk")))
+	assert.NoError(spoolWriter.Write(spool, make([]byte, SpoolPayloadLength)))
+	assert.NoError(chanA.Write(msg))
+	msgRead, err = chanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+	assert.Equal(uint64(2), chanB.SkippedEntries)
+
+	for i := 0; i < MaxGarbageEntries; i++ {
+		assert.NoError(spoolWriter.Write(spool, []byte("junk")))
+	}
+	assert.NoError(chanA.Write(msg))
+	_, err = chanB.Read()
+	assert.Equal(ErrTooMuchGarbage, err)
+	msgRead, err = chanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+	assert.Equal(uint64(2+MaxGarbageEntries), chanB.SkippedEntries)
+
+	// Reading at the end of the spool neither skips nor loses entries.
+	readOffset := chanB.SpoolReaderChan.ReadOffset
+	_, err = chanB.Read()
+	assert.Equal(ErrNoMessage, err)
+	assert.Equal(uint64(2+MaxGarbageEntries), chanB.SkippedEntries)
+	assert.Equal(readOffset, chanB.SpoolReaderChan.ReadOffset)
+	assert.NoError(chanA.Write(msg))
+	msgRead, err = chanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+}
+
+func TestNoiseChannelWriteMulti(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestNoiseChannelPair(t)
+	spool := chanA.spoolService
+	chanC, err := NewUnreliableNoiseChannel("receiver_C", "provider_C", spool)
+	assert.NoError(err)
+	assert.NoError(chanC.WithRemoteWriter(chanA.GetRemoteWriter(), chanA.IdentityPrivateKey.PublicKey()))
+	toB := &NoiseRecipient{
+		Descriptor:  chanB.GetRemoteWriter(),
+		IdentityKey: chanB.IdentityPrivateKey.PublicKey(),
+	}
+	toC := &NoiseRecipient{
+		Descriptor:  chanC.GetRemoteWriter(),
+		IdentityKey: chanC.IdentityPrivateKey.PublicKey(),
+	}
+
+	// descriptors not signed by the recipient's identity key are refused
+	incomplete := &NoiseRecipient{
+		Descriptor: &NoiseWriterDescriptor{
+			SpoolWriterChan: chanC.SpoolReaderChan.GetSpoolWriter(),
+		},
+		IdentityKey: chanC.IdentityPrivateKey.PublicKey(),
+	}
+	forged := &NoiseRecipient{
+		Descriptor:  chanB.GetRemoteWriter(),
+		IdentityKey: chanC.IdentityPrivateKey.PublicKey(),
+	}
+	unpinned := &NoiseRecipient{
+		Descriptor: chanC.GetRemoteWriter(),
+	}
+
+	msg := []byte("to everyone")
+	err = chanA.WriteMulti([]*NoiseRecipient{toB, incomplete, forged, unpinned, toC}, msg)
+	multiErr, ok := err.(*MultiWriteError)
+	assert.True(ok)
+	assert.Equal(5, multiErr.Recipients)
+	assert.Len(multiErr.Failures, 3)
+	assert.Equal(incomplete, multiErr.Failures[0].Recipient)
+	assert.Equal(forged, multiErr.Failures[1].Recipient)
+	assert.Equal(unpinned, multiErr.Failures[2].Recipient)
+
+	ciphertext, err := chanB.SpoolReaderChan.Read(chanB.spoolService)
+	assert.NoError(err)
+	chanB.SpoolReaderChan.ReadOffset--
+	msgRead, err := chanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+	msgRead, err = chanC.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+
+	// the messages are unsequenced
+	assert.Equal(uint64(0), chanB.Sequence.HighestReceived)
+
+	// but their nonces are checked for replays
+	assert.NoError(chanB.SpoolReaderChan.GetSpoolWriter().Write(chanB.spoolService, ciphertext))
+	_, err = chanB.Read()
+	assert.EqualError(err, "replayed message")
+
+	// unless NoiseReplayCacheSize newer nonces were read since
+	for i := 0; i < NoiseReplayCacheSize; i++ {
+		assert.NoError(chanB.receivedNonce(uint64(i)))
+	}
+	assert.NoError(chanB.SpoolReaderChan.GetSpoolWriter().Write(chanB.spoolService, ciphertext))
+	msgRead, err = chanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+
+	assert.NoError(chanA.WriteMulti([]*NoiseRecipient{toB, toC}, msg))
+	assert.Error(chanA.WriteMulti([]*NoiseRecipient{toB}, make([]byte, NoisePayloadLength)))
+
+	// a missing descriptor is reported as the recipient's failure
+	missing := &NoiseRecipient{
+		IdentityKey: chanC.IdentityPrivateKey.PublicKey(),
+	}
+	err = chanA.WriteMulti([]*NoiseRecipient{missing, toB}, msg)
+	multiErr, ok = err.(*MultiWriteError)
+	assert.True(ok)
+	assert.Len(multiErr.Failures, 1)
+	assert.Equal(missing, multiErr.Failures[0].Recipient)
+
+	// the message must fit each recipient's spool
+	chanD, err := NewUnreliableNoiseChannel("receiver_D", "provider_D", spool)
+	assert.NoError(err)
+	assert.NoError(chanD.SpoolReaderChan.RequireStamps(8))
+	toD := &NoiseRecipient{
+		Descriptor:  chanD.GetRemoteWriter(),
+		IdentityKey: chanD.IdentityPrivateKey.PublicKey(),
+	}
+	err = chanA.WriteMulti([]*NoiseRecipient{toB, toD}, make([]byte, NoisePayloadLength-noiseMessageHeaderLength))
+	multiErr, ok = err.(*MultiWriteError)
+	assert.True(ok)
+	assert.Len(multiErr.Failures, 1)
+	assert.Equal(toD, multiErr.Failures[0].Recipient)
+
+	// recipients knowing us by the key of another channel are
+	// written to with that key
+	chanE, err := NewUnreliableNoiseChannel("receiver_E", "provider_E", spool)
+	assert.NoError(err)
+	chanF, err := NewUnreliableNoiseChannel("receiver_F", "provider_F", spool)
+	assert.NoError(err)
+	assert.NoError(chanF.WithRemoteWriter(chanE.GetRemoteWriter(), chanE.IdentityPrivateKey.PublicKey()))
+	toF := &NoiseRecipient{
+		Descriptor:  chanF.GetRemoteWriter(),
+		IdentityKey: chanF.IdentityPrivateKey.PublicKey(),
+	}
+	assert.NoError(chanA.WriteMulti([]*NoiseRecipient{toF}, msg))
+	_, err = chanF.Read()
+	assert.EqualError(err, "wtf, wrong partner Noise X key")
+	toF.SenderKey = chanE.NoisePrivateKey
+	assert.NoError(chanA.WriteMulti([]*NoiseRecipient{toF}, msg))
+	msgRead, err = chanF.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+}
+
+func TestNoiseWriterDescriptorSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestNoiseChannelPair(t)
+	assert.True(chanA.RemoteIdentityKey.Equal(chanB.IdentityPrivateKey.PublicKey()))
+
+	// the signature survives the text encoding
+	text, err := chanA.GetRemoteWriter().EncodeText()
+	assert.NoError(err)
+	descriptor := new(NoiseWriterDescriptor)
+	assert.NoError(descriptor.DecodeText(text))
+	assert.NoError(descriptor.Verify(chanA.IdentityPrivateKey.PublicKey()))
+	// the pinned identity key verifies the descriptor
+	assert.NoError(chanB.WithRemoteWriter(descriptor, nil))
+
+	// a forged Noise key is detected
+	chanC, err := NewUnreliableNoiseChannel("receiver_C", "provider_C", chanA.spoolService)
+	assert.NoError(err)
+	forged := chanA.GetRemoteWriter()
+	forged.RemoteNoisePublicKey = chanC.NoisePrivateKey.PublicKey()
+	assert.Error(chanB.WithRemoteWriter(forged, nil))
+
+	// a self-signed forgery neither verifies nor replaces the pinned key
+	forged.Sign(chanC.IdentityPrivateKey, time.Hour)
+	assert.Error(chanB.WithRemoteWriter(forged, nil))
+	assert.Error(chanB.WithRemoteWriter(forged, chanC.IdentityPrivateKey.PublicKey()))
+	assert.True(chanB.RemoteIdentityKey.Equal(chanA.IdentityPrivateKey.PublicKey()))
+
+	unsigned := chanA.GetRemoteWriter()
+	unsigned.Signature = nil
+	assert.Error(chanB.WithRemoteWriter(unsigned, nil))
+
+	expired := chanA.GetRemoteWriter()
+	expired.Sign(chanA.IdentityPrivateKey, -time.Minute)
+	assert.Error(chanB.WithRemoteWriter(expired, nil))
+
+	// a descriptor is refused unless the identity key is known
+	assert.Error(chanC.WithRemoteWriter(chanA.GetRemoteWriter(), nil))
+
+	assert.True(chanB.RemoteNoisePublicKey.Equal(chanA.NoisePrivateKey.PublicKey()))
+	msg := []byte("signed and delivered")
+	assert.NoError(chanB.Write(msg))
+	msgRead, err := chanA.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+}
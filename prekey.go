@@ -0,0 +1,551 @@
+// prekey.go - prekey bundles for asynchronous Double Ratchet session setup
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/memspool/client"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// DefaultPrekeyBatchSize is the default number of one-time
+	// prekeys generated at once.
+	DefaultPrekeyBatchSize = 10
+
+	// PrekeyMessagePayloadLength is the length of the padded
+	// initial message of a prekey session.
+	PrekeyMessagePayloadLength = SpoolPayloadLength - NoiseNOverhead
+
+	// SignedPrekeyLifetime is how long a signed prekey is
+	// published before AcceptSessions replaces it.
+	SignedPrekeyLifetime = 7 * 24 * time.Hour
+
+	// SignedPrekeyGracePeriod is how long a replaced signed prekey
+	// is kept for the initial messages of initiators who used an
+	// older bundle.
+	SignedPrekeyGracePeriod = 7 * 24 * time.Hour
+)
+
+// OneTimePrekey is a published one-time prekey.
+type OneTimePrekey struct {
+	ID        uint32
+	PublicKey *ecdh.PublicKey
+}
+
+// PrivateOneTimePrekey is the publisher's state of a one-time prekey.
+type PrivateOneTimePrekey struct {
+	ID         uint32
+	PrivateKey *ecdh.PrivateKey
+}
+
+// PrekeyBundle is handed out by the publisher, in a directory for
+// instance. Initiators write their initial message to it's spool,
+// whose writer is signed by the publisher's signing key as well.
+// The bundle is signed, initiators must use the most recent one.
+type PrekeyBundle struct {
+	Published      time.Time
+	Expiration     time.Time
+	IdentityKey    *ecdh.PublicKey
+	SignedPrekey   *ecdh.PublicKey
+	OneTimePrekeys []*OneTimePrekey
+	SpoolWriter    *UnreliableSpoolWriterChannel
+}
+
+// signedPrekeyBundle is the serialized PrekeyBundle and it's signature.
+type signedPrekeyBundle struct {
+	Bundle    []byte
+	Signature []byte
+}
+
+// prekeyMessage is the first message of a prekey session, encrypted
+// to the signed prekey and written to the publisher's prekey spool.
+// The initiator creates the spool the publisher reads the session
+// from, so that the prekey spool is only read by the publisher.
+type prekeyMessage struct {
+	// OneTimePrekeyID is zero if the bundle had no one-time prekeys.
+	OneTimePrekeyID uint32
+	IdentityKey     []byte
+	EphemeralKey    []byte
+	SpoolWriter     *UnreliableSpoolWriterChannel
+	SpoolReader     *UnreliableSpoolReaderChannel
+}
+
+// PrekeyAcceptError is returned by AcceptSessions along with the
+// sessions it accepted when some of the initial messages read from
+// the prekey spool could not be accepted.
+type PrekeyAcceptError struct {
+	Messages int
+	Failures []error
+}
+
+func (e *PrekeyAcceptError) Error() string {
+	return fmt.Sprintf("failed to accept %d of %d prekey messages: %s", len(e.Failures), e.Messages, e.Failures[0])
+}
+
+// PrekeyPublisher hands out signed prekey bundles and establishes
+// deniable UnreliableDoubleRatchetChannels with the initiators who used
+// them, without requiring a round trip. The initial messages are
+// written to the publisher's prekey spool, which only the publisher
+// reads.
+type PrekeyPublisher struct {
+	spoolService client.SpoolService
+
+	SpoolReaderChan    *UnreliableSpoolReaderChannel
+	SigningPrivateKey  *eddsa.PrivateKey
+	IdentityPrivateKey *ecdh.PrivateKey
+	OneTimePrekeys     []*PrivateOneTimePrekey
+	NextPrekeyID       uint32
+	BatchSize          int
+
+	// SignedPrekey is replaced by AcceptSessions once it expired,
+	// the previous one is kept for SignedPrekeyGracePeriod.
+	SignedPrekey                   *ecdh.PrivateKey
+	SignedPrekeyExpiration         time.Time
+	PreviousSignedPrekey           *ecdh.PrivateKey
+	PreviousSignedPrekeyExpiration time.Time
+
+	// SeenEphemeralKeys and PreviousSeenEphemeralKeys are the
+	// initiator ephemeral keys of the sessions accepted with the
+	// current and previous signed prekey, a replayed initial message
+	// is refused rather than creating the same session again. They
+	// are forgotten along with their signed prekey.
+	SeenEphemeralKeys         map[string]bool
+	PreviousSeenEphemeralKeys map[string]bool
+
+	// ReplenishThreshold is the number of remaining one-time prekeys
+	// below which a new batch is generated.
+	ReplenishThreshold int
+}
+
+// NewPrekeyPublisher creates a new PrekeyPublisher and
+// generates it's first batch of one-time prekeys.
+func NewPrekeyPublisher(spoolReceiver, spoolProvider string, spool client.SpoolService, batchSize int) (*PrekeyPublisher, error) {
+	if batchSize < 1 {
+		return nil, errors.New("batch size must be positive")
+	}
+	signingPrivateKey, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	identityPrivateKey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	spoolReader, err := NewUnreliableSpoolReaderChannel(spoolReceiver, spoolProvider, spool)
+	if err != nil {
+		return nil, err
+	}
+	p := &PrekeyPublisher{
+		spoolService:       spool,
+		SpoolReaderChan:    spoolReader,
+		SigningPrivateKey:  signingPrivateKey,
+		IdentityPrivateKey: identityPrivateKey,
+		NextPrekeyID:       1,
+		BatchSize:          batchSize,
+		ReplenishThreshold: batchSize / 2,
+	}
+	err = p.RotateSignedPrekey()
+	if err != nil {
+		return nil, err
+	}
+	err = p.Replenish()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadPrekeyPublisher loads a saved PrekeyPublisher and sets it's spoolService.
+func LoadPrekeyPublisher(data []byte, spoolService client.SpoolService) (*PrekeyPublisher, error) {
+	p := new(PrekeyPublisher)
+	err := codec.NewDecoderBytes(data, cborHandle).Decode(p)
+	if err != nil {
+		return nil, err
+	}
+	p.SetSpoolService(spoolService)
+	return p, nil
+}
+
+// SetSpoolService sets this publisher's spoolService field.
+func (p *PrekeyPublisher) SetSpoolService(spoolService client.SpoolService) {
+	p.spoolService = spoolService
+}
+
+// Save returns the serialization of this publisher.
+func (p *PrekeyPublisher) Save() ([]byte, error) {
+	var serialized []byte
+	enc := codec.NewEncoderBytes(&serialized, cborHandle)
+	if err := enc.Encode(p); err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+// SigningPublicKey returns the key verifying our bundles, initiators
+// must learn it from a trusted source.
+func (p *PrekeyPublisher) SigningPublicKey() *eddsa.PublicKey {
+	return p.SigningPrivateKey.PublicKey()
+}
+
+// RemainingPrekeys returns the number of unused one-time prekeys.
+func (p *PrekeyPublisher) RemainingPrekeys() int {
+	return len(p.OneTimePrekeys)
+}
+
+// Replenish generates a new batch of one-time prekeys,
+// they are handed out with the next bundle.
+func (p *PrekeyPublisher) Replenish() error {
+	for i := 0; i < p.BatchSize; i++ {
+		privateKey, err := ecdh.NewKeypair(rand.Reader)
+		if err != nil {
+			return err
+		}
+		p.OneTimePrekeys = append(p.OneTimePrekeys, &PrivateOneTimePrekey{
+			ID:         p.NextPrekeyID,
+			PrivateKey: privateKey,
+		})
+		p.NextPrekeyID++
+	}
+	return nil
+}
+
+// RotateSignedPrekey replaces our signed prekey, the previous
+// one is kept for SignedPrekeyGracePeriod.
+func (p *PrekeyPublisher) RotateSignedPrekey() error {
+	signedPrekey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if p.SignedPrekey != nil {
+		p.PreviousSignedPrekey = p.SignedPrekey
+		p.PreviousSignedPrekeyExpiration = time.Now().Add(SignedPrekeyGracePeriod)
+		p.PreviousSeenEphemeralKeys = p.SeenEphemeralKeys
+	}
+	p.SeenEphemeralKeys = make(map[string]bool)
+	p.SignedPrekey = signedPrekey
+	p.SignedPrekeyExpiration = time.Now().Add(SignedPrekeyLifetime)
+	return nil
+}
+
+// SignedBundle returns a signed bundle of our signed prekey and our
+// remaining one-time prekeys. It changes with every AcceptSessions
+// which used one-time prekeys or rotated the signed prekey and should
+// then be handed out again.
+func (p *PrekeyPublisher) SignedBundle() ([]byte, error) {
+	bundle := PrekeyBundle{
+		Published:    time.Now().UTC(),
+		Expiration:   p.SignedPrekeyExpiration.Add(SignedPrekeyGracePeriod).UTC(),
+		IdentityKey:  p.IdentityPrivateKey.PublicKey(),
+		SignedPrekey: p.SignedPrekey.PublicKey(),
+		SpoolWriter:  p.SpoolReaderChan.GetSpoolWriter(),
+	}
+	bundle.SpoolWriter.Sign(p.SigningPrivateKey, time.Until(bundle.Expiration))
+	for _, prekey := range p.OneTimePrekeys {
+		bundle.OneTimePrekeys = append(bundle.OneTimePrekeys, &OneTimePrekey{
+			ID:        prekey.ID,
+			PublicKey: prekey.PrivateKey.PublicKey(),
+		})
+	}
+	var serializedBundle []byte
+	err := codec.NewEncoderBytes(&serializedBundle, cborHandle).Encode(&bundle)
+	if err != nil {
+		return nil, err
+	}
+	var serialized []byte
+	err = codec.NewEncoderBytes(&serialized, cborHandle).Encode(&signedPrekeyBundle{
+		Bundle:    serializedBundle,
+		Signature: p.SigningPrivateKey.Sign(serializedBundle),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+// AcceptSessions reads all the initial messages written to our prekey
+// spool since the last call and returns a channel for each new session.
+// The initiator's messages are then read from the returned channels.
+// One-time prekeys are discarded once read, a second initial message
+// using the same one-time prekey or a replayed initial message is not
+// accepted: an initiator whose one-time prekey was used by another
+// must connect again with a new bundle. A new batch is generated when
+// the remaining ones run low and the signed prekey is rotated once it
+// expired. If some of the initial messages could not be accepted a
+// *PrekeyAcceptError is returned along with the other sessions.
+func (p *PrekeyPublisher) AcceptSessions() ([]*UnreliableDoubleRatchetChannel, error) {
+	sessions := []*UnreliableDoubleRatchetChannel{}
+	var failures []error
+	used := make(map[uint32]bool)
+	messages := 0
+	spoolReader := p.SpoolReaderChan
+	for {
+		response, err := p.spoolService.ReadFromSpool(spoolReader.SpoolID, spoolReader.ReadOffset, spoolReader.SpoolPrivateKey, spoolReader.SpoolReceiver, spoolReader.SpoolProvider)
+		if err != nil {
+			return sessions, err
+		}
+		if response.Status != "OK" {
+			return sessions, errors.New(response.Status)
+		}
+		if len(response.Message) == 0 {
+			break
+		}
+		spoolReader.ReadOffset++
+		messages++
+		ratchetCh, prekeyID, err := p.acceptSession(response.Message, used)
+		if err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		if prekeyID != 0 {
+			used[prekeyID] = true
+		}
+		sessions = append(sessions, ratchetCh)
+	}
+
+	remaining := []*PrivateOneTimePrekey{}
+	for _, prekey := range p.OneTimePrekeys {
+		if !used[prekey.ID] {
+			remaining = append(remaining, prekey)
+		}
+	}
+	p.OneTimePrekeys = remaining
+	if (len(used) > 0 && len(p.OneTimePrekeys) < p.ReplenishThreshold) || len(p.OneTimePrekeys) == 0 {
+		if err := p.Replenish(); err != nil {
+			return sessions, err
+		}
+	}
+	if p.PreviousSignedPrekey != nil && time.Now().After(p.PreviousSignedPrekeyExpiration) {
+		p.PreviousSignedPrekey = nil
+		p.PreviousSeenEphemeralKeys = nil
+	}
+	if time.Now().After(p.SignedPrekeyExpiration) {
+		if err := p.RotateSignedPrekey(); err != nil {
+			return sessions, err
+		}
+	}
+	if len(failures) > 0 {
+		return sessions, &PrekeyAcceptError{
+			Messages: messages,
+			Failures: failures,
+		}
+	}
+	return sessions, nil
+}
+
+// acceptSession returns the session of the given initial message and
+// the ID of the one-time prekey it used, which must not be among the
+// given used ones.
+func (p *PrekeyPublisher) acceptSession(ciphertext []byte, used map[uint32]bool) (*UnreliableDoubleRatchetChannel, uint32, error) {
+	spoolWriter := p.SpoolReaderChan.GetSpoolWriter()
+	signedPrekey := p.SignedPrekey
+	seen := &p.SeenEphemeralKeys
+	payload, err := noiseNDecrypt(signedPrekey, spoolWriter, ciphertext)
+	if err != nil && p.PreviousSignedPrekey != nil && time.Now().Before(p.PreviousSignedPrekeyExpiration) {
+		signedPrekey = p.PreviousSignedPrekey
+		seen = &p.PreviousSeenEphemeralKeys
+		payload, err = noiseNDecrypt(signedPrekey, spoolWriter, ciphertext)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	serialized, err := unpadPayload(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	message := new(prekeyMessage)
+	err = codec.NewDecoderBytes(serialized, cborHandle).Decode(message)
+	if err != nil {
+		return nil, 0, err
+	}
+	if message.SpoolWriter == nil || message.SpoolReader == nil || message.SpoolReader.SpoolPrivateKey == nil {
+		return nil, 0, errors.New("invalid prekey message")
+	}
+	if len(message.IdentityKey) != keyLength || len(message.EphemeralKey) != keyLength {
+		return nil, 0, errors.New("invalid prekey message")
+	}
+	if p.SeenEphemeralKeys[string(message.EphemeralKey)] || p.PreviousSeenEphemeralKeys[string(message.EphemeralKey)] {
+		return nil, 0, errors.New("replayed prekey message")
+	}
+	if used[message.OneTimePrekeyID] {
+		return nil, 0, fmt.Errorf("one-time prekey used twice: %d", message.OneTimePrekeyID)
+	}
+	var oneTimeDH []byte
+	if message.OneTimePrekeyID != 0 {
+		var prekey *PrivateOneTimePrekey
+		for _, candidate := range p.OneTimePrekeys {
+			if candidate.ID == message.OneTimePrekeyID {
+				prekey = candidate
+				break
+			}
+		}
+		if prekey == nil {
+			return nil, 0, fmt.Errorf("unknown or used one-time prekey: %d", message.OneTimePrekeyID)
+		}
+		oneTimeDH, err = x25519(prekey.PrivateKey.Bytes(), message.EphemeralKey)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	deniableRatchet := &DeniableRatchet{
+		IdentityPrivate:  p.IdentityPrivateKey.Bytes(),
+		EphemeralPrivate: signedPrekey.Bytes(),
+		SkippedKeys:      make(map[string][]byte),
+	}
+	err = deniableRatchet.agree(&DeniableKeyExchange{
+		IdentityKey:  message.IdentityKey,
+		EphemeralKey: message.EphemeralKey,
+	}, false, oneTimeDH)
+	if err != nil {
+		return nil, 0, err
+	}
+	spoolCh := &UnreliableSpoolChannel{
+		spoolService: p.spoolService,
+		readerChan:   message.SpoolReader,
+	}
+	err = spoolCh.WithRemoteWriter(message.SpoolWriter)
+	if err != nil {
+		return nil, 0, err
+	}
+	if *seen == nil {
+		*seen = make(map[string]bool)
+	}
+	(*seen)[string(message.EphemeralKey)] = true
+	return &UnreliableDoubleRatchetChannel{
+		SpoolCh:         spoolCh,
+		Mode:            DeniableKeyExchangeMode,
+		DeniableRatchet: deniableRatchet,
+		LocalIdentity:   p.IdentityPrivateKey.PublicKey().Bytes(),
+		RemoteIdentity:  message.IdentityKey,
+	}, message.OneTimePrekeyID, nil
+}
+
+// OpenPrekeyBundle verifies the signatures of the given signed prekey
+// bundle and of it's spool writer with the publisher's signing key and
+// returns the bundle.
+func OpenPrekeyBundle(signedBundle []byte, signingPublicKey *eddsa.PublicKey) (*PrekeyBundle, error) {
+	signed := new(signedPrekeyBundle)
+	err := codec.NewDecoderBytes(signedBundle, cborHandle).Decode(signed)
+	if err != nil {
+		return nil, err
+	}
+	if !signingPublicKey.Verify(signed.Signature, signed.Bundle) {
+		return nil, errors.New("invalid prekey bundle signature")
+	}
+	bundle := new(PrekeyBundle)
+	err = codec.NewDecoderBytes(signed.Bundle, cborHandle).Decode(bundle)
+	if err != nil {
+		return nil, err
+	}
+	if bundle.IdentityKey == nil || bundle.SignedPrekey == nil || bundle.SpoolWriter == nil {
+		return nil, errors.New("incomplete prekey bundle")
+	}
+	err = bundle.SpoolWriter.Verify(signingPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// ConnectWithPrekeyBundle completes this channel using a randomly chosen
+// one-time prekey of the given bundle, or only it's signed prekey if it
+// has none left, and writes the initial message. The channel may be
+// written to immediately afterwards, the publisher learns of the session
+// the next time it accepts sessions. The channel must use
+// DeniableKeyExchangeMode and must not have exchanged keys.
+func (r *UnreliableDoubleRatchetChannel) ConnectWithPrekeyBundle(bundle *PrekeyBundle) error {
+	if r.Mode != DeniableKeyExchangeMode {
+		return errors.New("prekey sessions require the deniable key exchange mode")
+	}
+	if time.Now().After(bundle.Expiration) {
+		return errors.New("prekey bundle expired")
+	}
+	kx, err := r.DeniableRatchet.KeyExchange()
+	if err != nil {
+		return err
+	}
+	var prekeyID uint32
+	var oneTimeDH []byte
+	if len(bundle.OneTimePrekeys) > 0 {
+		var n [4]byte
+		if _, err := io.ReadFull(rand.Reader, n[:]); err != nil {
+			return err
+		}
+		prekey := bundle.OneTimePrekeys[binary.BigEndian.Uint32(n[:])%uint32(len(bundle.OneTimePrekeys))]
+		if prekey.ID == 0 || prekey.PublicKey == nil {
+			return errors.New("incomplete one-time prekey")
+		}
+		prekeyID = prekey.ID
+		oneTimeDH, err = x25519(r.DeniableRatchet.EphemeralPrivate, prekey.PublicKey.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	// The publisher reads our messages from a spool of
+	// this session we create on it's Provider.
+	spoolReader, err := NewUnreliableSpoolReaderChannel(bundle.SpoolWriter.SpoolReceiver, bundle.SpoolWriter.SpoolProvider, r.SpoolCh.spoolService)
+	if err != nil {
+		return err
+	}
+	var serialized []byte
+	err = codec.NewEncoderBytes(&serialized, cborHandle).Encode(&prekeyMessage{
+		OneTimePrekeyID: prekeyID,
+		IdentityKey:     kx.IdentityKey,
+		EphemeralKey:    kx.EphemeralKey,
+		SpoolWriter:     r.SpoolCh.GetSpoolWriter(),
+		SpoolReader:     spoolReader,
+	})
+	if err != nil {
+		return err
+	}
+	payload, err := padPayload(serialized, PrekeyMessagePayloadLength)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := noiseNEncrypt(bundle.SignedPrekey, bundle.SpoolWriter, payload)
+	if err != nil {
+		return err
+	}
+	err = bundle.SpoolWriter.Write(r.SpoolCh.spoolService, ciphertext)
+	if err != nil {
+		return err
+	}
+
+	err = r.SpoolCh.WithRemoteWriter(spoolReader.GetSpoolWriter())
+	if err != nil {
+		return err
+	}
+	err = r.DeniableRatchet.agree(&DeniableKeyExchange{
+		IdentityKey:  bundle.IdentityKey.Bytes(),
+		EphemeralKey: bundle.SignedPrekey.Bytes(),
+	}, true, oneTimeDH)
+	if err != nil {
+		return err
+	}
+	r.LocalIdentity = kx.IdentityKey
+	r.setRemoteIdentity(bundle.IdentityKey.Bytes())
+	return nil
+}
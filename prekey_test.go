@@ -0,0 +1,266 @@
+// prekey_test.go - prekey bundle tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/memspool/client"
+	"github.com/katzenpost/memspool/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPrekeyInitiator(t *testing.T, name string, spool client.SpoolService) *UnreliableDoubleRatchetChannel {
+	assert := assert.New(t)
+
+	spoolCh, err := NewUnreliableSpoolChannel("receiver_"+name, "provider_"+name, spool)
+	assert.NoError(err)
+	initiator, err := NewUnreliableDoubleRatchetChannelWithMode(spoolCh, DeniableKeyExchangeMode)
+	assert.NoError(err)
+	return initiator
+}
+
+func TestPrekeySession(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	publisher, err := NewPrekeyPublisher("receiver_bob", "provider_bob", spool, 2)
+	assert.NoError(err)
+	signedBundle, err := publisher.SignedBundle()
+	assert.NoError(err)
+
+	alice := newTestPrekeyInitiator(t, "alice", spool)
+	bundle, err := OpenPrekeyBundle(signedBundle, publisher.SigningPublicKey())
+	assert.NoError(err)
+	assert.Len(bundle.OneTimePrekeys, 2)
+	err = alice.ConnectWithPrekeyBundle(bundle)
+	assert.NoError(err)
+
+	// Alice writes before Bob learned of the session.
+	msg1 := []byte("No round trip needed.")
+	err = alice.Write(msg1)
+	assert.NoError(err)
+
+	blob, err := publisher.Save()
+	assert.NoError(err)
+	publisher, err = LoadPrekeyPublisher(blob, spool)
+	assert.NoError(err)
+
+	sessions, err := publisher.AcceptSessions()
+	assert.NoError(err)
+	assert.Len(sessions, 1)
+	bob := sessions[0]
+	msg1Read, err := bob.Read()
+	assert.NoError(err)
+	assert.Equal(msg1, msg1Read)
+
+	msg2 := []byte("Welcome, Alice.")
+	err = bob.Write(msg2)
+	assert.NoError(err)
+	msg2Read, err := alice.Read()
+	assert.NoError(err)
+	assert.Equal(msg2, msg2Read)
+
+	numberA, err := alice.SafetyNumber()
+	assert.NoError(err)
+	numberB, err := bob.SafetyNumber()
+	assert.NoError(err)
+	assert.Equal(numberA, numberB)
+
+	// The used one-time prekey is no longer handed out.
+	assert.Equal(1, publisher.RemainingPrekeys())
+	signedBundle, err = publisher.SignedBundle()
+	assert.NoError(err)
+	bundle, err = OpenPrekeyBundle(signedBundle, publisher.SigningPublicKey())
+	assert.NoError(err)
+	assert.Len(bundle.OneTimePrekeys, 1)
+
+	sessions, err = publisher.AcceptSessions()
+	assert.NoError(err)
+	assert.Len(sessions, 0)
+}
+
+func TestPrekeyReplenishment(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	publisher, err := NewPrekeyPublisher("receiver_bob", "provider_bob", spool, 1)
+	assert.NoError(err)
+	publisher.ReplenishThreshold = 0
+	signedBundle, err := publisher.SignedBundle()
+	assert.NoError(err)
+	bundle, err := OpenPrekeyBundle(signedBundle, publisher.SigningPublicKey())
+	assert.NoError(err)
+
+	// Both initiators use the only one-time prekey before the
+	// publisher accepts sessions, only the first one is accepted.
+	alice := newTestPrekeyInitiator(t, "alice", spool)
+	assert.NoError(alice.ConnectWithPrekeyBundle(bundle))
+	assert.NoError(alice.Write([]byte("alice")))
+	carol := newTestPrekeyInitiator(t, "carol", spool)
+	assert.NoError(carol.ConnectWithPrekeyBundle(bundle))
+	sessions, err := publisher.AcceptSessions()
+	assert.Len(sessions, 1)
+	acceptErr, ok := err.(*PrekeyAcceptError)
+	assert.True(ok)
+	assert.Equal(2, acceptErr.Messages)
+	assert.Len(acceptErr.Failures, 1)
+	msg, err := sessions[0].Read()
+	assert.NoError(err)
+	assert.Equal([]byte("alice"), msg)
+	assert.NoError(sessions[0].Write(msg))
+	msgRead, err := alice.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+
+	// The exhausted batch was replaced, a stale bundle's
+	// one-time prekey is reported as used.
+	assert.Equal(1, publisher.RemainingPrekeys())
+	dave := newTestPrekeyInitiator(t, "dave", spool)
+	assert.NoError(dave.ConnectWithPrekeyBundle(bundle))
+	sessions, err = publisher.AcceptSessions()
+	assert.Len(sessions, 0)
+	acceptErr, ok = err.(*PrekeyAcceptError)
+	assert.True(ok)
+	assert.Equal(1, acceptErr.Messages)
+	assert.Len(acceptErr.Failures, 1)
+
+	// Without one-time prekeys the signed prekey is used alone.
+	bundle.OneTimePrekeys = nil
+	erin := newTestPrekeyInitiator(t, "erin", spool)
+	assert.NoError(erin.ConnectWithPrekeyBundle(bundle))
+	msg = []byte("no one-time prekey")
+	assert.NoError(erin.Write(msg))
+	sessions, err = publisher.AcceptSessions()
+	assert.NoError(err)
+	assert.Len(sessions, 1)
+	msgRead, err = sessions[0].Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+	assert.Equal(1, publisher.RemainingPrekeys())
+}
+
+func TestPrekeySignedPrekeyRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	publisher, err := NewPrekeyPublisher("receiver_bob", "provider_bob", spool, 1)
+	assert.NoError(err)
+	signedBundle, err := publisher.SignedBundle()
+	assert.NoError(err)
+	bundle, err := OpenPrekeyBundle(signedBundle, publisher.SigningPublicKey())
+	assert.NoError(err)
+
+	// The signed prekey expires, an initiator using
+	// the old bundle is accepted during the grace period.
+	previous := publisher.SignedPrekey
+	publisher.SignedPrekeyExpiration = time.Now().Add(-time.Minute)
+	sessions, err := publisher.AcceptSessions()
+	assert.NoError(err)
+	assert.Len(sessions, 0)
+	assert.False(previous.PublicKey().Equal(publisher.SignedPrekey.PublicKey()))
+	assert.Equal(previous, publisher.PreviousSignedPrekey)
+
+	alice := newTestPrekeyInitiator(t, "alice", spool)
+	assert.NoError(alice.ConnectWithPrekeyBundle(bundle))
+	msg := []byte("sent with the old bundle")
+	assert.NoError(alice.Write(msg))
+	sessions, err = publisher.AcceptSessions()
+	assert.NoError(err)
+	assert.Len(sessions, 1)
+	msgRead, err := sessions[0].Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+
+	// Once the grace period is over the old signed prekey is forgotten.
+	publisher.PreviousSignedPrekeyExpiration = time.Now().Add(-time.Minute)
+	carol := newTestPrekeyInitiator(t, "carol", spool)
+	assert.NoError(carol.ConnectWithPrekeyBundle(bundle))
+	sessions, err = publisher.AcceptSessions()
+	assert.Error(err)
+	assert.Len(sessions, 0)
+	assert.Nil(publisher.PreviousSignedPrekey)
+}
+
+func TestPrekeyBundleSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	publisher, err := NewPrekeyPublisher("receiver_bob", "provider_bob", spool, 1)
+	assert.NoError(err)
+	signedBundle, err := publisher.SignedBundle()
+	assert.NoError(err)
+
+	signingKey, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	_, err = OpenPrekeyBundle(signedBundle, signingKey.PublicKey())
+	assert.Error(err)
+
+	// the spool writer is signed as well
+	bundle, err := OpenPrekeyBundle(signedBundle, publisher.SigningPublicKey())
+	assert.NoError(err)
+	assert.NoError(bundle.SpoolWriter.Verify(publisher.SigningPublicKey()))
+}
+
+func TestPrekeyReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	publisher, err := NewPrekeyPublisher("receiver_bob", "provider_bob", spool, 1)
+	assert.NoError(err)
+	signedBundle, err := publisher.SignedBundle()
+	assert.NoError(err)
+	bundle, err := OpenPrekeyBundle(signedBundle, publisher.SigningPublicKey())
+	assert.NoError(err)
+	bundle.OneTimePrekeys = nil
+
+	// an initial message using only the signed prekey
+	alice := newTestPrekeyInitiator(t, "alice", spool)
+	assert.NoError(alice.ConnectWithPrekeyBundle(bundle))
+	mock := spool.(*mockRemoteSpool)
+	spoolID := [common.SpoolIDSize]byte{}
+	copy(spoolID[:], publisher.SpoolReaderChan.SpoolID)
+	initial := mock.spool[spoolID][1]
+	sessions, err := publisher.AcceptSessions()
+	assert.NoError(err)
+	assert.Len(sessions, 1)
+
+	// is not accepted again once replayed by the provider,
+	// even after the publisher was saved and loaded
+	blob, err := publisher.Save()
+	assert.NoError(err)
+	publisher, err = LoadPrekeyPublisher(blob, spool)
+	assert.NoError(err)
+	assert.NoError(publisher.SpoolReaderChan.GetSpoolWriter().Write(spool, initial))
+	sessions, err = publisher.AcceptSessions()
+	assert.Len(sessions, 0)
+	acceptErr, ok := err.(*PrekeyAcceptError)
+	assert.True(ok)
+	assert.EqualError(acceptErr.Failures[0], "replayed prekey message")
+
+	// nor after the signed prekey was rotated
+	publisher.SignedPrekeyExpiration = time.Now().Add(-time.Minute)
+	_, err = publisher.AcceptSessions()
+	assert.NoError(err)
+	assert.NoError(publisher.SpoolReaderChan.GetSpoolWriter().Write(spool, initial))
+	sessions, err = publisher.AcceptSessions()
+	assert.Len(sessions, 0)
+	assert.Error(err)
+}
@@ -0,0 +1,279 @@
+// receipts.go - delivery and read receipts
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// ReceiptHeaderLength is the length of the header of the messages
+	// of channels using receipts: flags, message ID and the number of
+	// delivery and read receipts.
+	ReceiptHeaderLength = 1 + 8 + 1 + 1
+
+	// MaxBatchedReceipts is the maximum number of receipts of each
+	// kind carried by a message, they take the room left by it.
+	MaxBatchedReceipts = 32
+
+	// MaxTrackedMessages is the number of sent messages whose
+	// status is kept, the oldest are forgotten first.
+	MaxTrackedMessages = 1000
+
+	receiptLength          = 8
+	receiptFlagRequestRead = 1
+)
+
+// MessageStatus is the status of a message we sent.
+type MessageStatus uint8
+
+const (
+	// MessageSent is the status of a message no receipt was read for.
+	MessageSent MessageStatus = iota + 1
+
+	// MessageDelivered is the status of a message the remote party read
+	// from the spool.
+	MessageDelivered
+
+	// MessageRead is the status of a message the remote party's user
+	// read, it is only reported for messages which requested it.
+	MessageRead
+)
+
+// ReceiptEvent reports a status change of a message we sent.
+type ReceiptEvent struct {
+	MessageID uint64
+	Status    MessageStatus
+}
+
+// SentMessage is the status of a message we sent.
+type SentMessage struct {
+	ID     uint64
+	Status MessageStatus
+}
+
+// Receipts is the state of the receipt protocol of a channel. The
+// receipts we owe are sent along with our next messages, or alone
+// by FlushReceipts.
+type Receipts struct {
+	NextMessageID uint64
+	Sent          []*SentMessage
+	Events        []*ReceiptEvent
+
+	// Delivered and Read are the IDs of the received messages we
+	// owe receipts for. ReadRequested holds the IDs of the received
+	// messages which requested a read receipt until MarkRead.
+	Delivered     []uint64
+	Read          []uint64
+	ReadRequested []uint64
+
+	// lastID is the ID of the message last read.
+	lastID uint64
+}
+
+// receiptEnvelope is a message of a channel using receipts. Messages
+// with a zero ID only carry receipts.
+type receiptEnvelope struct {
+	ID          uint64
+	RequestRead bool
+	Delivered   []uint64
+	Read        []uint64
+	Message     []byte
+}
+
+func (e *receiptEnvelope) encode() []byte {
+	out := make([]byte, ReceiptHeaderLength, ReceiptHeaderLength+(len(e.Delivered)+len(e.Read))*receiptLength+len(e.Message))
+	if e.RequestRead {
+		out[0] = receiptFlagRequestRead
+	}
+	binary.BigEndian.PutUint64(out[1:9], e.ID)
+	out[9] = byte(len(e.Delivered))
+	out[10] = byte(len(e.Read))
+	var rawID [receiptLength]byte
+	for _, id := range append(append([]uint64{}, e.Delivered...), e.Read...) {
+		binary.BigEndian.PutUint64(rawID[:], id)
+		out = append(out, rawID[:]...)
+	}
+	return append(out, e.Message...)
+}
+
+func decodeReceiptEnvelope(data []byte) (*receiptEnvelope, error) {
+	if len(data) < ReceiptHeaderLength {
+		return nil, errors.New("receipt header is truncated")
+	}
+	e := &receiptEnvelope{
+		ID:          binary.BigEndian.Uint64(data[1:9]),
+		RequestRead: data[0]&receiptFlagRequestRead != 0,
+	}
+	delivered, read := int(data[9]), int(data[10])
+	if delivered > MaxBatchedReceipts || read > MaxBatchedReceipts {
+		return nil, errors.New("too many receipts")
+	}
+	data = data[ReceiptHeaderLength:]
+	if len(data) < (delivered+read)*receiptLength {
+		return nil, errors.New("receipts are truncated")
+	}
+	for i := 0; i < delivered+read; i++ {
+		id := binary.BigEndian.Uint64(data[:receiptLength])
+		data = data[receiptLength:]
+		if i < delivered {
+			e.Delivered = append(e.Delivered, id)
+		} else {
+			e.Read = append(e.Read, id)
+		}
+	}
+	e.Message = data
+	return e, nil
+}
+
+// envelope returns the envelope of the given message, it carries as
+// many of the receipts we owe as fit in the given payload length.
+// The message ID is zero unless track is set.
+func (r *Receipts) envelope(message []byte, track, requestRead bool, payloadLength int) (*receiptEnvelope, error) {
+	room := payloadLength - ReceiptHeaderLength - len(message)
+	if room < 0 {
+		return nil, errors.New("exceeds payload maximum")
+	}
+	take := func(pending []uint64) []uint64 {
+		n := len(pending)
+		if n > MaxBatchedReceipts {
+			n = MaxBatchedReceipts
+		}
+		if n > room/receiptLength {
+			n = room / receiptLength
+		}
+		room -= n * receiptLength
+		return pending[:n]
+	}
+	e := &receiptEnvelope{
+		RequestRead: requestRead,
+		Read:        take(r.Read),
+		Delivered:   take(r.Delivered),
+		Message:     message,
+	}
+	if track {
+		r.NextMessageID++
+		e.ID = r.NextMessageID
+	}
+	return e, nil
+}
+
+// sent records that the given envelope was written.
+func (r *Receipts) sent(e *receiptEnvelope) {
+	r.Delivered = r.Delivered[len(e.Delivered):]
+	r.Read = r.Read[len(e.Read):]
+	if e.ID == 0 {
+		return
+	}
+	r.Sent = append(r.Sent, &SentMessage{
+		ID:     e.ID,
+		Status: MessageSent,
+	})
+	if len(r.Sent) > MaxTrackedMessages {
+		r.Sent = r.Sent[len(r.Sent)-MaxTrackedMessages:]
+	}
+}
+
+// open processes the receipts of the given envelope and records the
+// receipts we owe for it. It returns false if it only carried receipts.
+func (r *Receipts) open(data []byte) ([]byte, bool, error) {
+	e, err := decodeReceiptEnvelope(data)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, id := range e.Delivered {
+		r.setStatus(id, MessageDelivered)
+	}
+	for _, id := range e.Read {
+		r.setStatus(id, MessageRead)
+	}
+	if e.ID == 0 {
+		return nil, false, nil
+	}
+	r.lastID = e.ID
+	r.Delivered = appendReceipt(r.Delivered, e.ID)
+	if e.RequestRead {
+		r.ReadRequested = appendReceipt(r.ReadRequested, e.ID)
+	}
+	return e.Message, true, nil
+}
+
+// appendReceipt appends the given ID, forgetting
+// the oldest once there are MaxTrackedMessages.
+func appendReceipt(ids []uint64, id uint64) []uint64 {
+	ids = append(ids, id)
+	if len(ids) > MaxTrackedMessages {
+		ids = ids[len(ids)-MaxTrackedMessages:]
+	}
+	return ids
+}
+
+// setStatus advances the status of a sent message and records the event.
+func (r *Receipts) setStatus(id uint64, status MessageStatus) {
+	for _, m := range r.Sent {
+		if m.ID != id {
+			continue
+		}
+		if m.Status < status {
+			m.Status = status
+			r.Events = append(r.Events, &ReceiptEvent{
+				MessageID: id,
+				Status:    status,
+			})
+			if len(r.Events) > MaxTrackedMessages {
+				r.Events = r.Events[len(r.Events)-MaxTrackedMessages:]
+			}
+		}
+		return
+	}
+}
+
+// Status returns the status of the sent message with the given ID.
+func (r *Receipts) Status(id uint64) (MessageStatus, error) {
+	for _, m := range r.Sent {
+		if m.ID == id {
+			return m.Status, nil
+		}
+	}
+	return 0, errors.New("unknown message")
+}
+
+// TakeEvents returns and forgets the status changes since the last call.
+func (r *Receipts) TakeEvents() []*ReceiptEvent {
+	events := r.Events
+	r.Events = nil
+	return events
+}
+
+// MarkRead queues the read receipt of the received message with the
+// given ID, it must have requested one.
+func (r *Receipts) MarkRead(id uint64) error {
+	for i, requested := range r.ReadRequested {
+		if requested == id {
+			r.ReadRequested = append(r.ReadRequested[:i], r.ReadRequested[i+1:]...)
+			r.Read = append(r.Read, id)
+			return nil
+		}
+	}
+	return errors.New("no read receipt was requested for this message")
+}
+
+// pending returns true if we owe receipts.
+func (r *Receipts) pending() bool {
+	return len(r.Delivered) > 0 || len(r.Read) > 0
+}
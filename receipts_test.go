@@ -0,0 +1,152 @@
+// receipts_test.go - delivery and read receipt tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiptEnvelope(t *testing.T) {
+	assert := assert.New(t)
+
+	r := new(Receipts)
+	for i := uint64(1); i <= MaxBatchedReceipts+8; i++ {
+		r.Delivered = append(r.Delivered, i)
+	}
+	r.Read = []uint64{3}
+
+	msg := []byte("hello")
+	envelope, err := r.envelope(msg, true, true, 1000)
+	assert.NoError(err)
+	assert.Equal(uint64(1), envelope.ID)
+	assert.Equal(MaxBatchedReceipts, len(envelope.Delivered))
+	decoded, err := decodeReceiptEnvelope(envelope.encode())
+	assert.NoError(err)
+	assert.Equal(envelope, decoded)
+	r.sent(envelope)
+	assert.Equal(8, len(r.Delivered))
+	assert.Empty(r.Read)
+
+	// the receipts only take the room left by the message
+	envelope, err = r.envelope(msg, true, false, ReceiptHeaderLength+len(msg)+2*receiptLength+1)
+	assert.NoError(err)
+	assert.Equal(2, len(envelope.Delivered))
+	_, err = r.envelope(msg, true, false, ReceiptHeaderLength+len(msg)-1)
+	assert.Error(err)
+
+	_, err = decodeReceiptEnvelope(envelope.encode()[:ReceiptHeaderLength+receiptLength])
+	assert.Error(err)
+}
+
+func TestNoiseChannelReceipts(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestNoiseChannelPair(t)
+	_, err := chanA.WriteTracked([]byte("untracked"), false)
+	assert.Error(err)
+	chanA.EnableReceipts()
+
+	msg1 := []byte("please tell me when you read this")
+	id1, err := chanA.WriteTracked(msg1, true)
+	assert.NoError(err)
+	status, err := chanA.Receipts.Status(id1)
+	assert.NoError(err)
+	assert.Equal(MessageSent, status)
+
+	id, msg, err := chanB.ReadTracked()
+	assert.NoError(err)
+	assert.Equal(id1, id)
+	assert.Equal(msg1, msg)
+
+	// the delivery receipt is carried by bob's next message
+	msg2 := []byte("got it")
+	assert.NoError(chanB.Write(msg2))
+	msg, err = chanA.Read()
+	assert.NoError(err)
+	assert.Equal(msg2, msg)
+	status, err = chanA.Receipts.Status(id1)
+	assert.NoError(err)
+	assert.Equal(MessageDelivered, status)
+	assert.Equal([]*ReceiptEvent{{MessageID: id1, Status: MessageDelivered}}, chanA.Receipts.TakeEvents())
+	assert.Empty(chanA.Receipts.TakeEvents())
+
+	// the read receipt is flushed on it's own
+	assert.Error(chanB.Receipts.MarkRead(id1 + 1))
+	assert.NoError(chanB.Receipts.MarkRead(id1))
+	assert.Error(chanB.Receipts.MarkRead(id1))
+	assert.NoError(chanB.FlushReceipts())
+	assert.False(chanB.Receipts.pending())
+	msg3 := []byte("and read it")
+	assert.NoError(chanB.Write(msg3))
+
+	serialized, err := chanA.Save()
+	assert.NoError(err)
+	chanA, err = LoadUnreliableNoiseChannel(serialized, chanA.spoolService)
+	assert.NoError(err)
+	msg, err = chanA.Read()
+	assert.NoError(err)
+	assert.Equal(msg3, msg)
+	status, err = chanA.Receipts.Status(id1)
+	assert.NoError(err)
+	assert.Equal(MessageRead, status)
+	assert.Equal([]*ReceiptEvent{{MessageID: id1, Status: MessageRead}}, chanA.Receipts.TakeEvents())
+
+	// alice owes delivery receipts for bob's messages
+	assert.Equal(2, len(chanA.Receipts.Delivered))
+}
+
+func TestDoubleRatchetReceipts(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	ratchetChanA, ratchetChanB := newTestConnectedRatchetPair(t, "alice", "bob", spool)
+	ratchetChanA.EnableReceipts()
+
+	msg1 := []byte("tracked over the ratchet")
+	id1, err := ratchetChanA.WriteTracked(msg1, true)
+	assert.NoError(err)
+	id, msg, err := ratchetChanB.ReadTracked()
+	assert.NoError(err)
+	assert.Equal(id1, id)
+	assert.Equal(msg1, msg)
+
+	assert.NoError(ratchetChanB.Receipts.MarkRead(id1))
+	msg2 := []byte("read and delivered")
+	assert.NoError(ratchetChanB.Write(msg2))
+	msg, err = ratchetChanA.Read()
+	assert.NoError(err)
+	assert.Equal(msg2, msg)
+	status, err := ratchetChanA.Receipts.Status(id1)
+	assert.NoError(err)
+	assert.Equal(MessageRead, status)
+	assert.Equal([]*ReceiptEvent{
+		{MessageID: id1, Status: MessageDelivered},
+		{MessageID: id1, Status: MessageRead},
+	}, ratchetChanA.Receipts.TakeEvents())
+
+	// messages of a remote party not using receipts have no ID
+	ratchetChanA.Receipts = nil
+	ratchetChanB.Receipts = nil
+	msg3 := []byte("untracked")
+	assert.NoError(ratchetChanA.Write(msg3))
+	id, msg, err = ratchetChanB.ReadTracked()
+	assert.NoError(err)
+	assert.Equal(uint64(0), id)
+	assert.Equal(msg3, msg)
+}
@@ -0,0 +1,387 @@
+// rendezvous.go - password authenticated channel rendezvous
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/big"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/ugorji/go/codec"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	rendezvousArgon2Time    = 3
+	rendezvousArgon2Memory  = 32 * 1024
+	rendezvousArgon2Threads = 4
+
+	rendezvousElementMessage  = 0
+	rendezvousExchangeMessage = 1
+
+	// MaxRendezvousPeers is the number of foreign elements read from
+	// the meeting spool a rendezvous answers. Each answer lets the
+	// poster of the element test one guess of the secret, so the
+	// rendezvous fails once more elements were posted.
+	MaxRendezvousPeers = 4
+)
+
+// ErrRendezvousFailed is returned by Poll once more than
+// MaxRendezvousPeers foreign elements were posted to the meeting
+// spool, the rendezvous must be started again with a new secret.
+var ErrRendezvousFailed = errors.New("rendezvous failed, too many elements were posted to the meeting spool")
+
+var (
+	rendezvousCurve = elliptic.P256()
+
+	// rendezvousS is the SPAKE2 symmetric mode point S. Nobody knows
+	// its discrete logarithm since it is derived by hashing into the curve.
+	rendezvousSX, rendezvousSY = hashToPoint(rendezvousCurve, "katzenpost channels rendezvous S")
+)
+
+// MeetingPlace is where the two parties of a Rendezvous meet. Unlike a
+// spool created with CreateSpool, a meeting spool is addressed by an
+// identifier both parties derive from their shared secret, so neither
+// party needs to learn a spool ID from the other.
+type MeetingPlace interface {
+	// AppendToMeetingSpool appends a message to the meeting spool.
+	AppendToMeetingSpool(meetingID []byte, message []byte) error
+
+	// ReadFromMeetingSpool returns the message at the given offset of
+	// the meeting spool or an empty message if there is none yet.
+	ReadFromMeetingSpool(meetingID []byte, offset uint32) ([]byte, error)
+}
+
+// hashToPoint deterministically maps the given label onto the curve
+// using try and increment.
+func hashToPoint(curve elliptic.Curve, label string) (*big.Int, *big.Int) {
+	params := curve.Params()
+	three := big.NewInt(3)
+	for counter := byte(0); ; counter++ {
+		digest := sha256.Sum256(append([]byte(label), counter))
+		x := new(big.Int).SetBytes(digest[:])
+		if x.Cmp(params.P) >= 0 {
+			continue
+		}
+		// y² = x³ - 3x + b
+		y2 := new(big.Int).Exp(x, three, params.P)
+		y2.Sub(y2, new(big.Int).Mul(three, x))
+		y2.Add(y2, params.B)
+		y2.Mod(y2, params.P)
+		y := new(big.Int).ModSqrt(y2, params.P)
+		if y == nil || !curve.IsOnCurve(x, y) {
+			continue
+		}
+		return x, y
+	}
+}
+
+// randomScalar returns a uniformly random scalar for the curve.
+func randomScalar(curve elliptic.Curve) ([]byte, error) {
+	buf := make([]byte, 64)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return nil, err
+	}
+	k := new(big.Int).SetBytes(buf)
+	return k.Mod(k, curve.Params().N).Bytes(), nil
+}
+
+// Rendezvous connects two parties who share nothing but a low entropy
+// secret. It is similar to Pond's PANDA: both parties derive a meeting
+// spool from the secret, run the symmetric mode of the SPAKE2 password
+// authenticated key exchange over it and then exchange their channel
+// exchanges encrypted with the resulting key. The meeting spool Provider
+// learns neither the secret nor the channel exchanges.
+//
+// As with PANDA, anyone who learned the meeting spool, such as it's
+// Provider, may post elements of their own. Each of them is answered
+// and it's poster gets to test one guess of the secret, the exchanges
+// which fail to open are ignored so that the rendezvous still completes
+// with the peer knowing the secret. An attacker posting more than
+// MaxRendezvousPeers elements denies the rendezvous, Poll then returns
+// ErrRendezvousFailed.
+type Rendezvous struct {
+	meetingPlace MeetingPlace
+
+	MeetingID      []byte
+	PasswordScalar []byte
+	PrivateScalar  []byte
+	Element        []byte
+	Exchange       []byte
+	PostedElement  bool
+	ReadOffset     uint32
+
+	// AnsweredElements are the foreign elements we answered, one
+	// of which is PeerElement once the peer's exchange was opened.
+	AnsweredElements [][]byte
+	Failed           bool
+
+	PeerElement  []byte
+	SharedKey    []byte
+	PeerExchange []byte
+}
+
+// NewRendezvous creates a new Rendezvous which will send the given
+// serialized channel exchange, as returned by ChannelExchange, to the
+// party knowing the same secret.
+func NewRendezvous(secret, exchange []byte, meetingPlace MeetingPlace) (*Rendezvous, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("secret must not be empty")
+	}
+	if len(exchange) == 0 {
+		return nil, errors.New("exchange must not be empty")
+	}
+	stretched := argon2.IDKey(secret, []byte("katzenpost channels rendezvous"),
+		rendezvousArgon2Time, rendezvousArgon2Memory, rendezvousArgon2Threads, 64)
+	meetingID := sha256.Sum256(stretched[:32])
+	w := new(big.Int).SetBytes(stretched[32:])
+	w.Mod(w, rendezvousCurve.Params().N)
+
+	x, err := randomScalar(rendezvousCurve)
+	if err != nil {
+		return nil, err
+	}
+	// X = xG + wS
+	xGx, xGy := rendezvousCurve.ScalarBaseMult(x)
+	wSx, wSy := rendezvousCurve.ScalarMult(rendezvousSX, rendezvousSY, w.Bytes())
+	elementX, elementY := rendezvousCurve.Add(xGx, xGy, wSx, wSy)
+
+	return &Rendezvous{
+		meetingPlace:   meetingPlace,
+		MeetingID:      meetingID[:],
+		PasswordScalar: w.Bytes(),
+		PrivateScalar:  x,
+		Element:        elliptic.Marshal(rendezvousCurve, elementX, elementY),
+		Exchange:       exchange,
+		ReadOffset:     1,
+	}, nil
+}
+
+// LoadRendezvous loads a saved Rendezvous and sets it's MeetingPlace.
+func LoadRendezvous(data []byte, meetingPlace MeetingPlace) (*Rendezvous, error) {
+	r := new(Rendezvous)
+	err := codec.NewDecoderBytes(data, cborHandle).Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	r.SetMeetingPlace(meetingPlace)
+	return r, nil
+}
+
+// SetMeetingPlace sets this rendezvous' MeetingPlace.
+func (r *Rendezvous) SetMeetingPlace(meetingPlace MeetingPlace) {
+	r.meetingPlace = meetingPlace
+}
+
+// Save returns the serialization of this rendezvous.
+func (r *Rendezvous) Save() ([]byte, error) {
+	var serialized []byte
+	enc := codec.NewEncoderBytes(&serialized, cborHandle)
+	if err := enc.Encode(r); err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+// Done returns true once the peer's channel exchange was received.
+func (r *Rendezvous) Done() bool {
+	return r.PeerExchange != nil
+}
+
+// PeerIdentityKey returns the identity key which signed the spool
+// writer of the peer's channel exchange, to be passed along with it
+// to ProcessChannelExchange. The shared secret authenticates it.
+func (r *Rendezvous) PeerIdentityKey() (*eddsa.PublicKey, error) {
+	if !r.Done() {
+		return nil, errors.New("rendezvous is not done")
+	}
+	exchange := new(UnreliableDoubleRatchetChannelExchange)
+	err := codec.NewDecoderBytes(r.PeerExchange, cborHandle).Decode(exchange)
+	if err != nil {
+		return nil, err
+	}
+	return exchangeSigner(exchange)
+}
+
+// Poll advances the rendezvous as far as the meeting spool allows. It
+// returns true once PeerExchange holds the peer's serialized channel
+// exchange, ready to be passed to ProcessChannelExchange.
+func (r *Rendezvous) Poll() (bool, error) {
+	if r.Done() {
+		return true, nil
+	}
+	if r.Failed {
+		return false, ErrRendezvousFailed
+	}
+	if !r.PostedElement {
+		err := r.meetingPlace.AppendToMeetingSpool(r.MeetingID, r.message(rendezvousElementMessage, nil))
+		if err != nil {
+			return false, err
+		}
+		r.PostedElement = true
+	}
+	for !r.Done() {
+		message, err := r.meetingPlace.ReadFromMeetingSpool(r.MeetingID, r.ReadOffset)
+		if err != nil {
+			return false, err
+		}
+		if len(message) == 0 {
+			break
+		}
+		r.ReadOffset++
+		if err = r.processMessage(message); err != nil {
+			return false, err
+		}
+	}
+	return r.Done(), nil
+}
+
+func (r *Rendezvous) message(messageType byte, body []byte) []byte {
+	message := make([]byte, 0, 1+len(r.Element)+len(body))
+	message = append(message, messageType)
+	message = append(message, r.Element...)
+	return append(message, body...)
+}
+
+func (r *Rendezvous) processMessage(message []byte) error {
+	elementLen := len(r.Element)
+	if len(message) < 1+elementLen {
+		return nil // not a rendezvous message
+	}
+	sender := message[1 : 1+elementLen]
+	if bytes.Equal(sender, r.Element) {
+		return nil
+	}
+	switch message[0] {
+	case rendezvousElementMessage:
+		if r.answered(sender) {
+			return nil
+		}
+		sharedKey, err := r.deriveSharedKey(sender)
+		if err != nil {
+			// not an element, it's poster learns nothing
+			return nil
+		}
+		if len(r.AnsweredElements) == MaxRendezvousPeers {
+			r.Failed = true
+			return ErrRendezvousFailed
+		}
+		sealed, err := r.seal(sharedKey)
+		if err != nil {
+			return err
+		}
+		err = r.meetingPlace.AppendToMeetingSpool(r.MeetingID, r.message(rendezvousExchangeMessage, sealed))
+		if err != nil {
+			return err
+		}
+		r.AnsweredElements = append(r.AnsweredElements, sender)
+	case rendezvousExchangeMessage:
+		if !r.answered(sender) {
+			return nil
+		}
+		sharedKey, err := r.deriveSharedKey(sender)
+		if err != nil {
+			return err
+		}
+		exchange, err := r.open(sharedKey, sender, message[1+elementLen:])
+		if err != nil {
+			// the poster of the element does not know the secret
+			return nil
+		}
+		r.PeerElement = sender
+		r.SharedKey = sharedKey
+		r.PeerExchange = exchange
+	}
+	return nil
+}
+
+// answered returns true if we answered the given element.
+func (r *Rendezvous) answered(element []byte) bool {
+	for _, answered := range r.AnsweredElements {
+		if bytes.Equal(answered, element) {
+			return true
+		}
+	}
+	return false
+}
+
+// deriveSharedKey returns the key shared with the poster of the given
+// element, if they know the secret.
+func (r *Rendezvous) deriveSharedKey(peerElement []byte) ([]byte, error) {
+	peerX, peerY := elliptic.Unmarshal(rendezvousCurve, peerElement)
+	if peerX == nil {
+		return nil, errors.New("invalid rendezvous peer element")
+	}
+	// K = x(Y - wS)
+	wSx, wSy := rendezvousCurve.ScalarMult(rendezvousSX, rendezvousSY, r.PasswordScalar)
+	wSy.Sub(rendezvousCurve.Params().P, wSy)
+	tx, ty := rendezvousCurve.Add(peerX, peerY, wSx, wSy)
+	kx, ky := rendezvousCurve.ScalarMult(tx, ty, r.PrivateScalar)
+	if kx.Sign() == 0 && ky.Sign() == 0 {
+		return nil, errors.New("invalid rendezvous peer element")
+	}
+
+	// Sort the elements so that both parties hash the same transcript.
+	first, second := r.Element, peerElement
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+	h := sha256.New()
+	h.Write(r.MeetingID)
+	h.Write(first)
+	h.Write(second)
+	h.Write(elliptic.Marshal(rendezvousCurve, kx, ky))
+	return h.Sum(nil), nil
+}
+
+// rendezvousSenderKey returns the key used to encrypt the exchange
+// sent by the owner of the given element.
+func rendezvousSenderKey(sharedKey, element []byte) []byte {
+	h := sha256.New()
+	h.Write(sharedKey)
+	h.Write(element)
+	return h.Sum(nil)
+}
+
+func (r *Rendezvous) seal(sharedKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(rendezvousSenderKey(sharedKey, r.Element))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, r.Exchange, r.MeetingID), nil
+}
+
+func (r *Rendezvous) open(sharedKey, peerElement, sealed []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(rendezvousSenderKey(sharedKey, peerElement))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed exchange is truncated")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], r.MeetingID)
+}
@@ -0,0 +1,225 @@
+// rendezvous_test.go - password authenticated channel rendezvous tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockMeetingPlace struct {
+	spools map[string][][]byte
+}
+
+func newMockMeetingPlace() *mockMeetingPlace {
+	return &mockMeetingPlace{
+		spools: make(map[string][][]byte),
+	}
+}
+
+func (m *mockMeetingPlace) AppendToMeetingSpool(meetingID []byte, message []byte) error {
+	m.spools[string(meetingID)] = append(m.spools[string(meetingID)], message)
+	return nil
+}
+
+func (m *mockMeetingPlace) ReadFromMeetingSpool(meetingID []byte, offset uint32) ([]byte, error) {
+	spool := m.spools[string(meetingID)]
+	if offset == 0 || int(offset) > len(spool) {
+		return nil, nil
+	}
+	return spool[offset-1], nil
+}
+
+func newTestUnexchangedRatchetPair(t *testing.T) (*UnreliableDoubleRatchetChannel, *UnreliableDoubleRatchetChannel) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestSpoolChannelPair(t)
+	chanA.writerChan = nil
+	chanB.writerChan = nil
+	ratchetChanA, err := NewUnreliableDoubleRatchetChannel(chanA)
+	assert.NoError(err)
+	ratchetChanB, err := NewUnreliableDoubleRatchetChannel(chanB)
+	assert.NoError(err)
+	return ratchetChanA, ratchetChanB
+}
+
+func TestRendezvous(t *testing.T) {
+	assert := assert.New(t)
+
+	meetingPlace := newMockMeetingPlace()
+	ratchetChanA, ratchetChanB := newTestUnexchangedRatchetPair(t)
+	secret := []byte("correct horse")
+
+	exchangeA, err := ratchetChanA.ChannelExchange()
+	assert.NoError(err)
+	rendezvousA, err := NewRendezvous(secret, exchangeA, meetingPlace)
+	assert.NoError(err)
+	exchangeB, err := ratchetChanB.ChannelExchange()
+	assert.NoError(err)
+	rendezvousB, err := NewRendezvous(secret, exchangeB, meetingPlace)
+	assert.NoError(err)
+	assert.Equal(rendezvousA.MeetingID, rendezvousB.MeetingID)
+
+	done, err := rendezvousA.Poll()
+	assert.NoError(err)
+	assert.False(done)
+
+	// Alice goes offline and comes back later.
+	blob, err := rendezvousA.Save()
+	assert.NoError(err)
+
+	done, err = rendezvousB.Poll()
+	assert.NoError(err)
+	assert.False(done)
+
+	rendezvousA, err = LoadRendezvous(blob, meetingPlace)
+	assert.NoError(err)
+	done, err = rendezvousA.Poll()
+	assert.NoError(err)
+	assert.True(done)
+	done, err = rendezvousB.Poll()
+	assert.NoError(err)
+	assert.True(done)
+
+	assert.Equal(exchangeB, rendezvousA.PeerExchange)
+	assert.Equal(exchangeA, rendezvousB.PeerExchange)
+
+	// The meeting spool never contains the exchanges in the clear.
+	for _, message := range meetingPlace.spools[string(rendezvousA.MeetingID)] {
+		assert.False(bytes.Contains(message, exchangeA))
+		assert.False(bytes.Contains(message, exchangeB))
+	}
+
+	peerIdentityA, err := rendezvousA.PeerIdentityKey()
+	assert.NoError(err)
+	assert.True(ratchetChanB.IdentityPrivateKey.PublicKey().Equal(peerIdentityA))
+	peerIdentityB, err := rendezvousB.PeerIdentityKey()
+	assert.NoError(err)
+	err = ratchetChanA.ProcessChannelExchange(rendezvousA.PeerExchange, peerIdentityA)
+	assert.NoError(err)
+	err = ratchetChanB.ProcessChannelExchange(rendezvousB.PeerExchange, peerIdentityB)
+	assert.NoError(err)
+
+	msg := []byte("Cryptography rearranges power.")
+	err = ratchetChanA.Write(msg)
+	assert.NoError(err)
+	msgRead, err := ratchetChanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+}
+
+func TestRendezvousDifferentSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	meetingPlace := newMockMeetingPlace()
+	rendezvousA, err := NewRendezvous([]byte("correct horse"), []byte("exchange A"), meetingPlace)
+	assert.NoError(err)
+	rendezvousB, err := NewRendezvous([]byte("battery staple"), []byte("exchange B"), meetingPlace)
+	assert.NoError(err)
+	assert.NotEqual(rendezvousA.MeetingID, rendezvousB.MeetingID)
+
+	for i := 0; i < 2; i++ {
+		done, err := rendezvousA.Poll()
+		assert.NoError(err)
+		assert.False(done)
+		done, err = rendezvousB.Poll()
+		assert.NoError(err)
+		assert.False(done)
+	}
+}
+
+func TestRendezvousWrongGuess(t *testing.T) {
+	assert := assert.New(t)
+
+	meetingPlace := newMockMeetingPlace()
+	rendezvousA, err := NewRendezvous([]byte("correct horse"), []byte("exchange A"), meetingPlace)
+	assert.NoError(err)
+	attacker, err := NewRendezvous([]byte("a wrong guess"), []byte("exchange M"), meetingPlace)
+	assert.NoError(err)
+
+	// The attacker learned the meeting spool but not the secret.
+	attacker.MeetingID = rendezvousA.MeetingID
+
+	_, err = attacker.Poll()
+	assert.NoError(err)
+	_, err = rendezvousA.Poll()
+	assert.NoError(err)
+	done, err := attacker.Poll()
+	assert.NoError(err)
+	assert.False(done)
+	assert.Nil(attacker.PeerExchange)
+	done, err = rendezvousA.Poll()
+	assert.NoError(err)
+	assert.False(done)
+	assert.Nil(rendezvousA.PeerExchange)
+
+	// the attacker posted first, the peer knowing the secret
+	// still completes the rendezvous
+	rendezvousB, err := NewRendezvous([]byte("correct horse"), []byte("exchange B"), meetingPlace)
+	assert.NoError(err)
+	_, err = rendezvousB.Poll()
+	assert.NoError(err)
+	_, err = rendezvousA.Poll()
+	assert.NoError(err)
+	done, err = rendezvousB.Poll()
+	assert.NoError(err)
+	assert.True(done)
+	assert.Equal([]byte("exchange A"), rendezvousB.PeerExchange)
+	done, err = rendezvousA.Poll()
+	assert.NoError(err)
+	assert.True(done)
+	assert.Equal([]byte("exchange B"), rendezvousA.PeerExchange)
+	assert.Equal(rendezvousB.Element, rendezvousA.PeerElement)
+}
+
+func TestRendezvousTooManyPeers(t *testing.T) {
+	assert := assert.New(t)
+
+	meetingPlace := newMockMeetingPlace()
+	rendezvousA, err := NewRendezvous([]byte("correct horse"), []byte("exchange A"), meetingPlace)
+	assert.NoError(err)
+
+	// the meeting spool's Provider posts elements of it's own
+	for i := 0; i < MaxRendezvousPeers; i++ {
+		attacker, err := NewRendezvous([]byte("a wrong guess"), []byte("exchange M"), meetingPlace)
+		assert.NoError(err)
+		attacker.MeetingID = rendezvousA.MeetingID
+		_, err = attacker.Poll()
+		assert.NoError(err)
+	}
+	done, err := rendezvousA.Poll()
+	assert.NoError(err)
+	assert.False(done)
+	assert.Len(rendezvousA.AnsweredElements, MaxRendezvousPeers)
+
+	// one more element fails the rendezvous for good, the
+	// peer knowing the secret fails as well
+	rendezvousB, err := NewRendezvous([]byte("correct horse"), []byte("exchange B"), meetingPlace)
+	assert.NoError(err)
+	_, err = rendezvousB.Poll()
+	assert.Equal(ErrRendezvousFailed, err)
+	_, err = rendezvousA.Poll()
+	assert.Equal(ErrRendezvousFailed, err)
+	serialized, err := rendezvousA.Save()
+	assert.NoError(err)
+	rendezvousA, err = LoadRendezvous(serialized, meetingPlace)
+	assert.NoError(err)
+	_, err = rendezvousA.Poll()
+	assert.Equal(ErrRendezvousFailed, err)
+}
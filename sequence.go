@@ -0,0 +1,135 @@
+// sequence.go - message sequence numbers and loss detection
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// MaxMissingGaps is the number of gaps kept, the oldest
+	// are forgotten first.
+	MaxMissingGaps = 100
+
+	sequenceLength = 8
+)
+
+// MessageGap is a range of sequence numbers of messages
+// which were written to us but not read.
+type MessageGap struct {
+	First uint64
+	Last  uint64
+}
+
+// String returns a description of the gap such as "messages 14-16 missing".
+func (g MessageGap) String() string {
+	if g.First == g.Last {
+		return fmt.Sprintf("message %d missing", g.First)
+	}
+	return fmt.Sprintf("messages %d-%d missing", g.First, g.Last)
+}
+
+// Sequence numbers the messages written in each direction of a
+// channel so that lost or withheld messages are detected. Sequence
+// numbers start at one, zero is carried by unsequenced messages.
+type Sequence struct {
+	NextSend        uint64
+	HighestReceived uint64
+
+	// Missing holds the gaps which were not filled by a late message.
+	Missing []MessageGap
+
+	// Detected holds the gaps detected since the last TakeGaps.
+	Detected []MessageGap
+}
+
+// next returns the encoded sequence number of our next message.
+func (s *Sequence) next() []byte {
+	s.NextSend++
+	return encodeSequence(s.NextSend)
+}
+
+func encodeSequence(sequence uint64) []byte {
+	rawSequence := make([]byte, sequenceLength)
+	binary.BigEndian.PutUint64(rawSequence, sequence)
+	return rawSequence
+}
+
+func decodeSequence(rawSequence []byte) uint64 {
+	return binary.BigEndian.Uint64(rawSequence)
+}
+
+// received records the encoded sequence number of a message read,
+// it returns false if the message was read already or is too old
+// to fill a gap still kept.
+func (s *Sequence) received(rawSequence []byte) bool {
+	sequence := decodeSequence(rawSequence)
+	if sequence == 0 {
+		return true
+	}
+	if sequence <= s.HighestReceived {
+		return s.fill(sequence)
+	}
+	if sequence > s.HighestReceived+1 {
+		gap := MessageGap{
+			First: s.HighestReceived + 1,
+			Last:  sequence - 1,
+		}
+		s.Missing = appendGap(s.Missing, gap)
+		s.Detected = appendGap(s.Detected, gap)
+	}
+	s.HighestReceived = sequence
+	return true
+}
+
+// fill removes the sequence number of a late message from the gaps,
+// it returns false if no gap contains it.
+func (s *Sequence) fill(sequence uint64) bool {
+	for i, gap := range s.Missing {
+		if sequence < gap.First || sequence > gap.Last {
+			continue
+		}
+		var remaining []MessageGap
+		if gap.First < sequence {
+			remaining = append(remaining, MessageGap{First: gap.First, Last: sequence - 1})
+		}
+		if sequence < gap.Last {
+			remaining = append(remaining, MessageGap{First: sequence + 1, Last: gap.Last})
+		}
+		missing := append([]MessageGap{}, s.Missing[:i]...)
+		missing = append(missing, remaining...)
+		s.Missing = append(missing, s.Missing[i+1:]...)
+		return true
+	}
+	return false
+}
+
+func appendGap(gaps []MessageGap, gap MessageGap) []MessageGap {
+	gaps = append(gaps, gap)
+	if len(gaps) > MaxMissingGaps {
+		gaps = gaps[len(gaps)-MaxMissingGaps:]
+	}
+	return gaps
+}
+
+// TakeGaps returns and forgets the gaps detected since the last call.
+func (s *Sequence) TakeGaps() []MessageGap {
+	gaps := s.Detected
+	s.Detected = nil
+	return gaps
+}
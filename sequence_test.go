@@ -0,0 +1,107 @@
+// sequence_test.go - message sequence number tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSequenceGaps(t *testing.T) {
+	assert := assert.New(t)
+
+	sender := new(Sequence)
+	receiver := new(Sequence)
+	sequences := make([][]byte, 20)
+	for i := range sequences {
+		sequences[i] = sender.next()
+	}
+	receiver.received(sequences[0])
+	assert.Empty(receiver.TakeGaps())
+
+	// messages 2 and 14-16 are withheld
+	for i := 2; i < 13; i++ {
+		receiver.received(sequences[i])
+	}
+	receiver.received(sequences[16])
+	gaps := receiver.TakeGaps()
+	assert.Equal([]MessageGap{{First: 2, Last: 2}, {First: 14, Last: 16}}, gaps)
+	assert.Equal("message 2 missing", gaps[0].String())
+	assert.Equal("messages 14-16 missing", gaps[1].String())
+	assert.Empty(receiver.TakeGaps())
+
+	// a late message fills it's gap
+	assert.True(receiver.received(sequences[14]))
+	assert.Equal([]MessageGap{{First: 2, Last: 2}, {First: 14, Last: 14}, {First: 16, Last: 16}}, receiver.Missing)
+	assert.True(receiver.received(sequences[1]))
+	assert.Equal([]MessageGap{{First: 14, Last: 14}, {First: 16, Last: 16}}, receiver.Missing)
+	assert.Empty(receiver.TakeGaps())
+
+	// messages read already are reported
+	assert.False(receiver.received(sequences[14]))
+	assert.False(receiver.received(sequences[5]))
+	assert.Equal([]MessageGap{{First: 14, Last: 14}, {First: 16, Last: 16}}, receiver.Missing)
+
+	// unsequenced messages are ignored
+	receiver.received(make([]byte, sequenceLength))
+	assert.Equal(uint64(17), receiver.HighestReceived)
+}
+
+func TestNoiseChannelGaps(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestNoiseChannelPair(t)
+	for i := byte(1); i <= 4; i++ {
+		assert.NoError(chanA.Write([]byte{i}))
+	}
+	msg, gaps, err := chanB.ReadWithGaps()
+	assert.NoError(err)
+	assert.Equal([]byte{1}, msg)
+	assert.Empty(gaps)
+
+	// the Provider withholds two entries
+	chanB.SpoolReaderChan.ReadOffset += 2
+	msg, gaps, err = chanB.ReadWithGaps()
+	assert.NoError(err)
+	assert.Equal([]byte{4}, msg)
+	assert.Equal([]MessageGap{{First: 2, Last: 3}}, gaps)
+
+	serialized, err := chanB.Save()
+	assert.NoError(err)
+	chanB, err = LoadUnreliableNoiseChannel(serialized, chanB.spoolService)
+	assert.NoError(err)
+	assert.Equal([]MessageGap{{First: 2, Last: 3}}, chanB.Sequence.Missing)
+}
+
+func TestDoubleRatchetGaps(t *testing.T) {
+	assert := assert.New(t)
+
+	ratchetChanA, ratchetChanB := newTestConnectedRatchetPair(t, "alice", "bob", newMockRemoteSpool())
+	for i := byte(1); i <= 3; i++ {
+		assert.NoError(ratchetChanA.Write([]byte{i}))
+	}
+	ratchetChanB.SpoolCh.readerChan.ReadOffset++
+	msg, gaps, err := ratchetChanB.ReadWithGaps()
+	assert.NoError(err)
+	assert.Equal([]byte{2}, msg)
+	assert.Equal([]MessageGap{{First: 1, Last: 1}}, gaps)
+	msg, gaps, err = ratchetChanB.ReadWithGaps()
+	assert.NoError(err)
+	assert.Equal([]byte{3}, msg)
+	assert.Empty(gaps)
+}
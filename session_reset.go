@@ -0,0 +1,242 @@
+// session_reset.go - Double Ratchet desynchronization recovery
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/katzenpost/core/crypto/rand"
+	ratchet "github.com/katzenpost/doubleratchet"
+	"github.com/ugorji/go/codec"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// DesyncThreshold is the number of consecutive messages failing
+	// to decrypt after which the ratchet is considered desynchronized,
+	// for instance because one party restored an old backup.
+	DesyncThreshold = 3
+
+	sessionResetIDLength    = 16
+	sessionResetNonceLength = 24
+
+	// sessionResetOverhead is the difference between the length of the
+	// padded session reset messages and the one of the ratchet payloads,
+	// which makes both messages as long.
+	sessionResetOverhead = sessionResetNonceLength + secretbox.Overhead - ratchet.DoubleRatchetOverhead - identityMACLength
+
+	sessionResetLabel = "katzenpost channels session reset"
+)
+
+// ErrSessionReset is returned by UnreliableDoubleRatchetChannel.Read
+// when the session was reset. The reset was authenticated by the
+// previous identity keys, but the new ratchet's keys are not yet
+// verified and the safety numbers must therefore be compared again.
+var ErrSessionReset = errors.New("session was reset, safety numbers must be verified again")
+
+// PendingReset is the state kept by the party which requested a session
+// reset until the response is read. The current ratchet is kept in use
+// until then.
+type PendingReset struct {
+	ID              []byte
+	Ratchet         *ratchet.Ratchet
+	DeniableRatchet *DeniableRatchet
+	LocalIdentity   []byte
+}
+
+// sessionReset is written to the remote spool without ratchet
+// encryption, which may be desynchronized. It is encrypted with
+// the key derived by identityKey instead.
+type sessionReset struct {
+	ID       []byte
+	Response bool
+	Exchange *UnreliableDoubleRatchetChannelExchange
+}
+
+// openSessionReset returns the session reset carried by the given
+// ciphertext read from the given spool, if it is one.
+func (r *UnreliableDoubleRatchetChannel) openSessionReset(ciphertext []byte, spool *UnreliableSpoolWriterChannel) (*sessionReset, bool) {
+	if len(ciphertext) < sessionResetNonceLength+secretbox.Overhead {
+		return nil, false
+	}
+	key, err := r.identityKey(sessionResetLabel, spool, r.SpoolCh.writerChan)
+	if err != nil {
+		return nil, false
+	}
+	var nonce [sessionResetNonceLength]byte
+	copy(nonce[:], ciphertext)
+	payload, ok := secretbox.Open(nil, ciphertext[sessionResetNonceLength:], &nonce, key)
+	if !ok {
+		return nil, false
+	}
+	serialized, err := unpadPayload(payload)
+	if err != nil {
+		return nil, false
+	}
+	reset := new(sessionReset)
+	err = codec.NewDecoderBytes(serialized, cborHandle).Decode(reset)
+	if err != nil || len(reset.ID) != sessionResetIDLength || reset.Exchange == nil {
+		return nil, false
+	}
+	return reset, true
+}
+
+func (r *UnreliableDoubleRatchetChannel) writeSessionReset(reset *sessionReset) error {
+	key, err := r.identityKey(sessionResetLabel, r.destination(), r.SpoolCh.GetSpoolWriter())
+	if err != nil {
+		return err
+	}
+	var serialized []byte
+	err = codec.NewEncoderBytes(&serialized, cborHandle).Encode(reset)
+	if err != nil {
+		return err
+	}
+	payload, err := padPayload(serialized, r.payloadLength()-sessionResetOverhead)
+	if err != nil {
+		return err
+	}
+	var nonce [sessionResetNonceLength]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return err
+	}
+	return r.writeCiphertext(secretbox.Seal(nonce[:], payload, &nonce, key))
+}
+
+// newSession returns a channel holding a new ratchet for our mode
+// which replaces our current ratchet once it's key exchange completed.
+func (r *UnreliableDoubleRatchetChannel) newSession() (*UnreliableDoubleRatchetChannel, error) {
+	session := &UnreliableDoubleRatchetChannel{
+		Mode: r.Mode,
+	}
+	err := session.newRatchet()
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// adoptSession replaces our ratchet with the one of the given session.
+func (r *UnreliableDoubleRatchetChannel) adoptSession(session *UnreliableDoubleRatchetChannel) {
+	r.Ratchet = session.Ratchet
+	r.DeniableRatchet = session.DeniableRatchet
+	r.LocalIdentity = session.LocalIdentity
+	r.setRemoteIdentity(session.RemoteIdentity)
+	r.DecryptFailures = 0
+	r.PendingReset = nil
+}
+
+// RequestSessionReset asks the remote party to replace our ratchets with
+// new ones while keeping our spools. It is called by Read once the ratchet
+// is desynchronized and may also be called by hand.
+func (r *UnreliableDoubleRatchetChannel) RequestSessionReset() error {
+	if r.PendingReset != nil {
+		return errors.New("a session reset is already pending")
+	}
+	session, err := r.newSession()
+	if err != nil {
+		return err
+	}
+	exchange, err := session.ratchetExchange()
+	if err != nil {
+		return err
+	}
+	id := make([]byte, sessionResetIDLength)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return err
+	}
+	err = r.writeSessionReset(&sessionReset{
+		ID:       id,
+		Exchange: exchange,
+	})
+	if err != nil {
+		return err
+	}
+	r.PendingReset = &PendingReset{
+		ID:              id,
+		Ratchet:         session.Ratchet,
+		DeniableRatchet: session.DeniableRatchet,
+		LocalIdentity:   session.LocalIdentity,
+	}
+	return nil
+}
+
+// decryptFailed counts a message which was written by the remote party,
+// as it's identity MAC shows, but failed to decrypt, and requests a
+// session reset once the ratchet appears to be desynchronized.
+func (r *UnreliableDoubleRatchetChannel) decryptFailed(err error) error {
+	r.DecryptFailures++
+	if r.DecryptFailures >= DesyncThreshold && r.PendingReset == nil {
+		if resetErr := r.RequestSessionReset(); resetErr != nil {
+			return resetErr
+		}
+	}
+	return err
+}
+
+// processSessionReset answers a session reset request or completes
+// our pending one, it was authenticated by openSessionReset. Of two
+// concurrent requests, the one with the lesser ID is answered, the
+// other one is ignored and nil returned. ErrSessionReset is returned
+// once the session was reset.
+func (r *UnreliableDoubleRatchetChannel) processSessionReset(reset *sessionReset) error {
+	if reset.Response {
+		if r.PendingReset == nil || !bytes.Equal(r.PendingReset.ID, reset.ID) {
+			return errors.New("unexpected session reset response")
+		}
+		session := &UnreliableDoubleRatchetChannel{
+			Mode:            r.Mode,
+			Ratchet:         r.PendingReset.Ratchet,
+			DeniableRatchet: r.PendingReset.DeniableRatchet,
+			LocalIdentity:   r.PendingReset.LocalIdentity,
+		}
+		err := session.processRatchetExchange(reset.Exchange)
+		if err != nil {
+			return err
+		}
+		r.adoptSession(session)
+		return ErrSessionReset
+	}
+
+	if r.PendingReset != nil && bytes.Compare(r.PendingReset.ID, reset.ID) < 0 {
+		// the remote party answers our request instead
+		return nil
+	}
+	session, err := r.newSession()
+	if err != nil {
+		return err
+	}
+	exchange, err := session.ratchetExchange()
+	if err != nil {
+		return err
+	}
+	err = session.processRatchetExchange(reset.Exchange)
+	if err != nil {
+		return err
+	}
+	err = r.writeSessionReset(&sessionReset{
+		ID:       reset.ID,
+		Response: true,
+		Exchange: exchange,
+	})
+	if err != nil {
+		return err
+	}
+	r.adoptSession(session)
+	return ErrSessionReset
+}
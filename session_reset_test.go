@@ -0,0 +1,177 @@
+// session_reset_test.go - Double Ratchet session reset tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestConnectedDeniablePair(t *testing.T) (*UnreliableDoubleRatchetChannel, *UnreliableDoubleRatchetChannel) {
+	assert := assert.New(t)
+
+	ratchetChanA, ratchetChanB := newTestDeniableRatchetPair(t)
+	exchangeA, err := ratchetChanA.ChannelExchange()
+	assert.NoError(err)
+	exchangeB, err := ratchetChanB.ChannelExchange()
+	assert.NoError(err)
+	err = ratchetChanB.ProcessChannelExchange(exchangeA, ratchetChanA.IdentityPrivateKey.PublicKey())
+	assert.NoError(err)
+	err = ratchetChanA.ProcessChannelExchange(exchangeB, ratchetChanB.IdentityPrivateKey.PublicKey())
+	assert.NoError(err)
+	return ratchetChanA, ratchetChanB
+}
+
+func TestSessionResetAfterRestoredBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	ratchetChanA, ratchetChanB := newTestConnectedDeniablePair(t)
+	spool := ratchetChanA.SpoolCh.spoolService
+	assert.NoError(ratchetChanA.MarkVerified())
+	assert.NoError(ratchetChanB.MarkVerified())
+
+	backup, err := ratchetChanA.Save()
+	assert.NoError(err)
+	for i := 0; i < 2; i++ {
+		assert.NoError(ratchetChanA.Write([]byte("a")))
+		_, err = ratchetChanB.Read()
+		assert.NoError(err)
+		assert.NoError(ratchetChanB.Write([]byte("b")))
+		_, err = ratchetChanA.Read()
+		assert.NoError(err)
+	}
+	for i := 0; i < DesyncThreshold; i++ {
+		assert.NoError(ratchetChanB.Write([]byte("lost")))
+	}
+
+	// Alice restores her backup, but not her spool's read offset,
+	// and can no longer decrypt Bob's messages.
+	readOffset := ratchetChanA.SpoolCh.readerChan.ReadOffset
+	ratchetChanA, err = LoadUnreliableDoubleRatchetChannel(backup, spool)
+	assert.NoError(err)
+	assert.Nil(ratchetChanA.PendingReset)
+	ratchetChanA.SpoolCh.readerChan.ReadOffset = readOffset
+	for i := 0; i < DesyncThreshold; i++ {
+		_, err = ratchetChanA.Read()
+		assert.Error(err)
+		assert.NotEqual(ErrSessionReset, err)
+	}
+	assert.NotNil(ratchetChanA.PendingReset)
+
+	// The pending reset survives Save and Load.
+	blob, err := ratchetChanA.Save()
+	assert.NoError(err)
+	ratchetChanA, err = LoadUnreliableDoubleRatchetChannel(blob, spool)
+	assert.NoError(err)
+	assert.NotNil(ratchetChanA.PendingReset)
+
+	_, err = ratchetChanB.Read()
+	assert.Equal(ErrSessionReset, err)
+	assert.False(ratchetChanB.Verified)
+	_, err = ratchetChanA.Read()
+	assert.Equal(ErrSessionReset, err)
+	assert.False(ratchetChanA.Verified)
+	assert.Nil(ratchetChanA.PendingReset)
+
+	msg1 := []byte("Back in sync.")
+	assert.NoError(ratchetChanA.Write(msg1))
+	msg1Read, err := ratchetChanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg1, msg1Read)
+	msg2 := []byte("Let's compare safety numbers again.")
+	assert.NoError(ratchetChanB.Write(msg2))
+	msg2Read, err := ratchetChanA.Read()
+	assert.NoError(err)
+	assert.Equal(msg2, msg2Read)
+
+	numberA, err := ratchetChanA.SafetyNumber()
+	assert.NoError(err)
+	numberB, err := ratchetChanB.SafetyNumber()
+	assert.NoError(err)
+	assert.Equal(numberA, numberB)
+}
+
+func TestConcurrentSessionReset(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	ratchetChanA, ratchetChanB := newTestConnectedRatchetPair(t, "alice", "bob", spool)
+	assert.NoError(ratchetChanA.RequestSessionReset())
+	assert.Error(ratchetChanA.RequestSessionReset())
+	assert.NoError(ratchetChanB.RequestSessionReset())
+
+	// The request with the lesser ID wins, the loser answers it
+	// and the winner ignores the loser's request.
+	winner, loser := ratchetChanA, ratchetChanB
+	if bytes.Compare(ratchetChanB.PendingReset.ID, ratchetChanA.PendingReset.ID) < 0 {
+		winner, loser = ratchetChanB, ratchetChanA
+	}
+	_, err := loser.Read()
+	assert.Equal(ErrSessionReset, err)
+	assert.Nil(loser.PendingReset)
+	_, err = winner.Read()
+	assert.Equal(ErrSessionReset, err)
+	assert.Nil(winner.PendingReset)
+
+	msg := []byte("Only one reset took place.")
+	assert.NoError(winner.Write(msg))
+	msgRead, err := loser.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+}
+
+func TestSessionResetAuthentication(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	ratchetChanA, ratchetChanB := newTestConnectedRatchetPair(t, "alice", "bob", spool)
+	assert.NoError(ratchetChanB.MarkVerified())
+	ratchetChanM, _ := newTestConnectedRatchetPair(t, "mallory", "mallory_peer", spool)
+
+	// Mallory may write to Bob's spool but does not know the
+	// identity keys of Alice's and Bob's ratchets.
+	ratchetChanM.SpoolCh.writerChan = ratchetChanB.SpoolCh.GetSpoolWriter()
+	assert.NoError(ratchetChanM.RequestSessionReset())
+	_, err := ratchetChanB.Read()
+	assert.Error(err)
+	assert.NotEqual(ErrSessionReset, err)
+	assert.True(ratchetChanB.Verified)
+
+	// Alice's request is as long as her other messages and the
+	// Provider can not reflect it back into her own spool.
+	assert.NoError(ratchetChanA.RequestSessionReset())
+	request, err := ratchetChanB.SpoolCh.readerChan.Read(spool)
+	assert.NoError(err)
+	ratchetChanB.SpoolCh.readerChan.ReadOffset--
+	assert.NoError(ratchetChanA.SpoolCh.GetSpoolWriter().Write(spool, request))
+	_, err = ratchetChanA.Read()
+	assert.Error(err)
+	assert.NotEqual(ErrSessionReset, err)
+	assert.NotNil(ratchetChanA.PendingReset)
+
+	_, err = ratchetChanB.Read()
+	assert.Equal(ErrSessionReset, err)
+	_, err = ratchetChanA.Read()
+	assert.Equal(ErrSessionReset, err)
+	msg := []byte("after the reset")
+	assert.NoError(ratchetChanB.Write(msg))
+	message, err := ratchetChanA.SpoolCh.readerChan.Read(spool)
+	assert.NoError(err)
+	assert.Equal(len(message), len(request))
+}
@@ -0,0 +1,340 @@
+// shared_inbox.go - spool shared by many double ratchet channels
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/katzenpost/memspool/client"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// InboxTagLength is the length of the tag prepended to
+	// SharedInbox entries.
+	InboxTagLength = 16
+
+	// InboxTagWindow is the number of tags of each channel a SharedInbox
+	// looks for, lost messages beyond it stall the channel's tags.
+	InboxTagWindow = 32
+
+	inboxTagLabel = "katzenpost channels inbox tag"
+)
+
+// InboxTags holds the tag key of a channel added to our SharedInbox
+// and the counter of the next tag we expect. Both parties derive the
+// tag key from their ratchet identity keys with identityKey.
+type InboxTags struct {
+	TagKey      []byte
+	NextCounter uint64
+}
+
+// RemoteInbox is the remote party's SharedInbox we write to.
+type RemoteInbox struct {
+	SpoolWriter *UnreliableSpoolWriterChannel
+	TagKey      []byte
+	Counter     uint64
+}
+
+// inboxInvite is sent over the ratchet to move the remote
+// party's writes to our SharedInbox.
+type inboxInvite struct {
+	SpoolWriter *UnreliableSpoolWriterChannel
+}
+
+// inboxTag returns the tag of the given counter. Tags are pseudorandom
+// so that the Provider can not link the entries of a channel.
+func inboxTag(tagKey []byte, counter uint64) []byte {
+	mac := hmac.New(sha256.New, tagKey)
+	mac.Write([]byte(inboxTagLabel))
+	var rawCounter [8]byte
+	binary.BigEndian.PutUint64(rawCounter[:], counter)
+	mac.Write(rawCounter[:])
+	return mac.Sum(nil)[:InboxTagLength]
+}
+
+// write writes a tagged ciphertext to the remote inbox.
+func (i *RemoteInbox) write(spoolService client.SpoolService, ciphertext []byte) error {
+	entry := append(inboxTag(i.TagKey, i.Counter), ciphertext...)
+	i.Counter++
+	return i.SpoolWriter.Write(spoolService, entry)
+}
+
+// processInboxMessage moves our writes to the remote party's SharedInbox.
+func (r *UnreliableDoubleRatchetChannel) processInboxMessage(body []byte) error {
+	invite := new(inboxInvite)
+	err := codec.NewDecoderBytes(body, cborHandle).Decode(invite)
+	if err != nil {
+		return err
+	}
+	if invite.SpoolWriter == nil {
+		return errors.New("invalid inbox message")
+	}
+	tagKey, err := r.identityKey(inboxTagLabel, invite.SpoolWriter, r.SpoolCh.GetSpoolWriter())
+	if err != nil {
+		return err
+	}
+	r.RemoteInbox = &RemoteInbox{
+		SpoolWriter: invite.SpoolWriter,
+		TagKey:      tagKey[:],
+	}
+	return nil
+}
+
+// readInboxEntry decrypts the ciphertext of a SharedInbox entry routed
+// to this channel. Control messages and session resets are processed
+// and false returned.
+func (r *UnreliableDoubleRatchetChannel) readInboxEntry(entry []byte, inbox *UnreliableSpoolWriterChannel) ([]byte, bool, error) {
+	ciphertext, ok := r.openIdentityMAC(entry, inbox)
+	if !ok {
+		if reset, ok := r.openSessionReset(entry, inbox); ok {
+			return nil, false, r.processSessionReset(reset)
+		}
+		return nil, false, &garbageError{errors.New("message failed to authenticate")}
+	}
+	plaintext, err := r.decrypt(ciphertext)
+	if err != nil {
+		if failErr := r.decryptFailed(err); failErr != err {
+			return nil, false, failErr
+		}
+		return nil, false, &garbageError{err}
+	}
+	r.DecryptFailures = 0
+	messageType, body, err := r.openPayload(plaintext, inbox)
+	if err != nil {
+		return nil, false, err
+	}
+	return r.processMessage(messageType, body)
+}
+
+// SerializedSharedInbox is a type used to serialize/save the SharedInbox type.
+type SerializedSharedInbox struct {
+	SpoolReaderChan *UnreliableSpoolReaderChannel
+	Channels        map[string][]byte
+	SkipGarbage     bool
+	SkippedEntries  uint64
+}
+
+// SharedInbox is a spool read in place of the spools of many
+// UnreliableDoubleRatchetChannels, so that a single spool is polled.
+// Each entry carries a tag derived from the channel's ratchet identity
+// keys, which routes the entry to it's channel without trial
+// decryption. Entries written to a channel's own spool before the
+// remote party learned of the SharedInbox are read from that spool.
+type SharedInbox struct {
+	spoolService client.SpoolService
+
+	// routes maps the tags we expect to their channel,
+	// it is built on the first Read.
+	routes map[string]*inboxRoute
+
+	SpoolReaderChan *UnreliableSpoolReaderChannel
+	Channels        map[string]*UnreliableDoubleRatchetChannel
+
+	// SkipGarbage makes Read skip entries which do not
+	// carry an expected tag or fail to authenticate.
+	SkipGarbage    bool
+	SkippedEntries uint64
+}
+
+// NewSharedInbox creates a new SharedInbox with a new spool.
+func NewSharedInbox(spoolReceiver, spoolProvider string, spool client.SpoolService) (*SharedInbox, error) {
+	spoolReader, err := NewUnreliableSpoolReaderChannel(spoolReceiver, spoolProvider, spool)
+	if err != nil {
+		return nil, err
+	}
+	return &SharedInbox{
+		spoolService:    spool,
+		SpoolReaderChan: spoolReader,
+		Channels:        make(map[string]*UnreliableDoubleRatchetChannel),
+	}, nil
+}
+
+// LoadSharedInbox loads a saved SharedInbox and sets it's spoolService.
+func LoadSharedInbox(data []byte, spoolService client.SpoolService) (*SharedInbox, error) {
+	s := new(SerializedSharedInbox)
+	err := codec.NewDecoderBytes(data, cborHandle).Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	i := &SharedInbox{
+		spoolService:    spoolService,
+		SpoolReaderChan: s.SpoolReaderChan,
+		Channels:        make(map[string]*UnreliableDoubleRatchetChannel),
+		SkipGarbage:     s.SkipGarbage,
+		SkippedEntries:  s.SkippedEntries,
+	}
+	for name, serialized := range s.Channels {
+		i.Channels[name], err = LoadUnreliableDoubleRatchetChannel(serialized, spoolService)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return i, nil
+}
+
+// SetSpoolService sets the spoolService of the inbox and it's channels.
+func (i *SharedInbox) SetSpoolService(spoolService client.SpoolService) {
+	i.spoolService = spoolService
+	for _, ch := range i.Channels {
+		ch.SpoolCh.SetSpoolService(spoolService)
+	}
+}
+
+// Save returns the serialization of this inbox and it's channels.
+func (i *SharedInbox) Save() ([]byte, error) {
+	s := &SerializedSharedInbox{
+		SpoolReaderChan: i.SpoolReaderChan,
+		Channels:        make(map[string][]byte),
+		SkipGarbage:     i.SkipGarbage,
+		SkippedEntries:  i.SkippedEntries,
+	}
+	for name, ch := range i.Channels {
+		serialized, err := ch.Save()
+		if err != nil {
+			return nil, err
+		}
+		s.Channels[name] = serialized
+	}
+	var serialized []byte
+	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode(s)
+	if err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+// AddChannel adds the given exchanged channel under the given name and
+// asks the remote party to write to this inbox from now on.
+func (i *SharedInbox) AddChannel(name string, ch *UnreliableDoubleRatchetChannel) error {
+	if _, ok := i.Channels[name]; ok {
+		return errors.New("channel name already in use")
+	}
+	if ch.InboxTags != nil {
+		return errors.New("channel already uses a shared inbox")
+	}
+	tagKey, err := ch.identityKey(inboxTagLabel, i.SpoolReaderChan.GetSpoolWriter(), ch.SpoolCh.writerChan)
+	if err != nil {
+		return err
+	}
+	var serialized []byte
+	err = codec.NewEncoderBytes(&serialized, cborHandle).Encode(&inboxInvite{
+		SpoolWriter: i.SpoolReaderChan.GetSpoolWriter(),
+	})
+	if err != nil {
+		return err
+	}
+	err = ch.writeMessage(inboxMessage, serialized)
+	if err != nil {
+		return err
+	}
+	ch.InboxTags = &InboxTags{
+		TagKey: tagKey[:],
+	}
+	i.Channels[name] = ch
+	if i.routes != nil {
+		i.addRoutes(name, ch.InboxTags, 0, InboxTagWindow)
+	}
+	return nil
+}
+
+// inboxRoute is the channel expecting a tag and the tag's counter.
+type inboxRoute struct {
+	name    string
+	counter uint64
+}
+
+// addRoutes adds the tags of the given counters to the routes.
+func (i *SharedInbox) addRoutes(name string, tags *InboxTags, from, to uint64) {
+	for counter := from; counter < to; counter++ {
+		i.routes[string(inboxTag(tags.TagKey, counter))] = &inboxRoute{
+			name:    name,
+			counter: counter,
+		}
+	}
+}
+
+// route returns the channel expecting the given tag and the tag's
+// counter, the tags of each channel are computed once.
+func (i *SharedInbox) route(tag []byte) (*inboxRoute, bool) {
+	if i.routes == nil {
+		i.routes = make(map[string]*inboxRoute)
+		for name, ch := range i.Channels {
+			i.addRoutes(name, ch.InboxTags, ch.InboxTags.NextCounter, ch.InboxTags.NextCounter+InboxTagWindow)
+		}
+	}
+	route, ok := i.routes[string(tag)]
+	return route, ok
+}
+
+// consume moves the tag window of the routed channel past the tag's
+// counter, the tags left behind are no longer accepted.
+func (i *SharedInbox) consume(route *inboxRoute) {
+	tags := i.Channels[route.name].InboxTags
+	for counter := tags.NextCounter; counter <= route.counter; counter++ {
+		delete(i.routes, string(inboxTag(tags.TagKey, counter)))
+	}
+	from := tags.NextCounter + InboxTagWindow
+	tags.NextCounter = route.counter + 1
+	i.addRoutes(route.name, tags, from, tags.NextCounter+InboxTagWindow)
+}
+
+// Read reads the next message from the inbox and returns it along with
+// the name of the channel it was routed to. Control messages are
+// processed and the next message is read in their place. The errors
+// of a channel, such as ErrSessionReset, are returned along with it's
+// name.
+func (i *SharedInbox) Read() (string, []byte, error) {
+	var name string
+	message, err := skipGarbage(i.SkipGarbage, &i.SkippedEntries, func() ([]byte, error) {
+		var err error
+		var message []byte
+		name, message, err = i.readMessage()
+		return message, err
+	})
+	if err != nil {
+		return name, nil, err
+	}
+	return name, message, nil
+}
+
+func (i *SharedInbox) readMessage() (string, []byte, error) {
+	for {
+		entry, err := i.SpoolReaderChan.Read(i.spoolService)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(entry) < InboxTagLength {
+			return "", nil, &garbageError{errors.New("inbox entry is truncated")}
+		}
+		route, ok := i.route(entry[:InboxTagLength])
+		if !ok {
+			return "", nil, &garbageError{errors.New("unknown inbox tag")}
+		}
+		i.consume(route)
+		message, isData, err := i.Channels[route.name].readInboxEntry(entry[InboxTagLength:], i.SpoolReaderChan.GetSpoolWriter())
+		if err != nil {
+			return route.name, nil, err
+		}
+		if isData {
+			return route.name, message, nil
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// shared_inbox_test.go - shared inbox tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"testing"
+
+	"github.com/katzenpost/memspool/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedInbox(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	aliceBob, bobAlice := newTestConnectedRatchetPair(t, "alice", "bob", spool)
+	aliceCarol, carolAlice := newTestConnectedRatchetPair(t, "alice", "carol", spool)
+
+	inbox, err := NewSharedInbox("receiver_alice", "provider_alice", spool)
+	assert.NoError(err)
+	assert.NoError(inbox.AddChannel("bob", aliceBob))
+	assert.NoError(inbox.AddChannel("carol", aliceCarol))
+	assert.Error(inbox.AddChannel("bob", aliceBob))
+
+	hello := []byte("write to my inbox")
+	assert.NoError(aliceBob.Write(hello))
+	assert.NoError(aliceCarol.Write(hello))
+	msg, err := bobAlice.Read()
+	assert.NoError(err)
+	assert.Equal(hello, msg)
+	assert.NotNil(bobAlice.RemoteInbox)
+	msg, err = carolAlice.Read()
+	assert.NoError(err)
+	assert.Equal(hello, msg)
+
+	fromBob1 := []byte("bob one")
+	fromCarol := []byte("carol one")
+	fromBob2 := []byte("bob two")
+	assert.NoError(bobAlice.Write(fromBob1))
+	assert.NoError(carolAlice.Write(fromCarol))
+	assert.NoError(bobAlice.Write(fromBob2))
+
+	// the tags of a channel's entries are not linkable
+	mock := spool.(*mockRemoteSpool)
+	inboxID := [common.SpoolIDSize]byte{}
+	copy(inboxID[:], inbox.SpoolReaderChan.SpoolID)
+	assert.NotEqual(mock.spool[inboxID][1][:InboxTagLength], mock.spool[inboxID][3][:InboxTagLength])
+
+	name, msg, err := inbox.Read()
+	assert.NoError(err)
+	assert.Equal("bob", name)
+	assert.Equal(fromBob1, msg)
+
+	serialized, err := inbox.Save()
+	assert.NoError(err)
+	inbox, err = LoadSharedInbox(serialized, spool)
+	assert.NoError(err)
+
+	name, msg, err = inbox.Read()
+	assert.NoError(err)
+	assert.Equal("carol", name)
+	assert.Equal(fromCarol, msg)
+	name, msg, err = inbox.Read()
+	assert.NoError(err)
+	assert.Equal("bob", name)
+	assert.Equal(fromBob2, msg)
+
+	// replayed and unknown entries are skipped
+	inbox.SkipGarbage = true
+	inboxWriter := inbox.SpoolReaderChan.GetSpoolWriter()
+	assert.NoError(inboxWriter.Write(spool, mock.spool[inboxID][3]))
+	assert.NoError(inboxWriter.Write(spool, []byte("junk")))
+	assert.NoError(carolAlice.Write(fromCarol))
+	name, msg, err = inbox.Read()
+	assert.NoError(err)
+	assert.Equal("carol", name)
+	assert.Equal(fromCarol, msg)
+	assert.Equal(uint64(2), inbox.SkippedEntries)
+
+	// polling at the end of the inbox does not lose the next entry
+	_, _, err = inbox.Read()
+	assert.Equal(ErrNoMessage, err)
+	assert.NoError(bobAlice.Write(fromBob1))
+	name, msg, err = inbox.Read()
+	assert.NoError(err)
+	assert.Equal("bob", name)
+	assert.Equal(fromBob1, msg)
+
+	// the remote parties still read from their own spools
+	assert.NoError(inbox.Channels["bob"].Write(hello))
+	msg, err = bobAlice.Read()
+	assert.NoError(err)
+	assert.Equal(hello, msg)
+}
+
+func TestSharedInboxSessionReset(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	aliceBob, bobAlice := newTestConnectedRatchetPair(t, "alice", "bob", spool)
+	inbox, err := NewSharedInbox("receiver_alice", "provider_alice", spool)
+	assert.NoError(err)
+	assert.NoError(inbox.AddChannel("bob", aliceBob))
+	hello := []byte("write to my inbox")
+	assert.NoError(aliceBob.Write(hello))
+	msgRead, err := bobAlice.Read()
+	assert.NoError(err)
+	assert.Equal(hello, msgRead)
+
+	// both parties derived the same tag key
+	assert.NotNil(bobAlice.RemoteInbox)
+	assert.Equal(aliceBob.InboxTags.TagKey, bobAlice.RemoteInbox.TagKey)
+
+	// only the inbox entries carry a tag
+	assert.Equal(DoubleRatchetPayloadLength, aliceBob.payloadLength())
+	assert.Equal(DoubleRatchetPayloadLength-InboxTagLength, bobAlice.payloadLength())
+	mock := spool.(*mockRemoteSpool)
+	inboxID := [common.SpoolIDSize]byte{}
+	copy(inboxID[:], inbox.SpoolReaderChan.SpoolID)
+	assert.NoError(bobAlice.Write([]byte("hello")))
+	assert.Len(mock.spool[inboxID][1], SpoolPayloadLength)
+	_, _, err = inbox.Read()
+	assert.NoError(err)
+
+	// session resets are routed through the inbox
+	assert.NoError(bobAlice.RequestSessionReset())
+	assert.Len(mock.spool[inboxID][2], SpoolPayloadLength)
+	name, _, err := inbox.Read()
+	assert.Equal("bob", name)
+	assert.Equal(ErrSessionReset, err)
+	_, err = bobAlice.Read()
+	assert.Equal(ErrSessionReset, err)
+
+	msg := []byte("after the reset")
+	assert.NoError(bobAlice.Write(msg))
+	name, msgRead, err = inbox.Read()
+	assert.NoError(err)
+	assert.Equal("bob", name)
+	assert.Equal(msg, msgRead)
+}
@@ -17,7 +17,10 @@
 package channels
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"time"
 
 	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/crypto/eddsa"
@@ -35,6 +38,10 @@ const (
 
 	// SpoolPayloadLength is the length of the spool payload.
 	SpoolPayloadLength = (constants.UserForwardPayloadLength - 4) - SpoolChannelOverhead
+
+	// StampedSpoolPayloadLength is the length of the spool payload
+	// of spools requiring stamps, room is left for the stamp.
+	StampedSpoolPayloadLength = SpoolPayloadLength - StampLength
 )
 
 // UnreliableSpoolWriterChannel is an unreliable channel which
@@ -43,14 +50,181 @@ type UnreliableSpoolWriterChannel struct {
 	SpoolID       []byte
 	SpoolReceiver string
 	SpoolProvider string
+
+	// StampDifficulty is the difficulty of the proof-of-work
+	// stamp required by the spool reader, zero if none is.
+	StampDifficulty uint8
+
+	// Signature is set if the spool's owner signed this writer.
+	Signature *WriterSignature
+}
+
+// PayloadLength returns the maximum length of the messages written
+// to the spool, which is shorter if the spool requires stamps.
+func (w *UnreliableSpoolWriterChannel) PayloadLength() int {
+	if w.StampDifficulty > 0 {
+		return StampedSpoolPayloadLength
+	}
+	return SpoolPayloadLength
 }
 
 // Write writes the given message to a remote spool.
 func (w *UnreliableSpoolWriterChannel) Write(spool client.SpoolService, message []byte) error {
+	if len(message) > w.PayloadLength() {
+		return errors.New("exceeds payload maximum")
+	}
+	if w.StampDifficulty > 0 {
+		stamp, err := newStamp(w.SpoolID, message, w.StampDifficulty)
+		if err != nil {
+			return err
+		}
+		message = append(stamp, message...)
+	}
 	err := spool.AppendToSpool(w.SpoolID[:], message, w.SpoolReceiver, w.SpoolProvider)
 	return err
 }
 
+// signedData returns the data covered by the signature of this writer.
+func (w *UnreliableSpoolWriterChannel) signedData() []byte {
+	return append(spoolBinding(writerSignatureLabel, w), w.StampDifficulty)
+}
+
+// Sign signs this writer with the identity key of the spool's
+// owner, the signature expires after the given lifetime.
+func (w *UnreliableSpoolWriterChannel) Sign(identity *eddsa.PrivateKey, lifetime time.Duration) {
+	w.Signature = signWriter(identity, lifetime, w.signedData())
+}
+
+// Verify returns an error unless this writer carries an unexpired
+// signature by the given identity key.
+func (w *UnreliableSpoolWriterChannel) Verify(identity *eddsa.PublicKey) error {
+	return verifyWriter(w.Signature, identity, w.signedData())
+}
+
+// WriterDescriptorLifetime is the lifetime of the
+// writer descriptors signed by our channels.
+const WriterDescriptorLifetime = 30 * 24 * time.Hour
+
+const writerSignatureLabel = "katzenpost channels writer descriptor"
+
+// WriterSignature is the signature of a writer descriptor by the
+// identity key of the spool's owner. It expires at NotAfter so that
+// a descriptor, published in a directory for instance, can not be
+// replayed forever.
+type WriterSignature struct {
+	Identity  *eddsa.PublicKey
+	NotAfter  time.Time
+	Signature []byte
+}
+
+// writerSignatureMessage returns the message signed by a WriterSignature.
+// The encoding is explicit so that it does not depend on the CBOR encoding.
+func writerSignatureMessage(identity *eddsa.PublicKey, notAfter time.Time, descriptor []byte) []byte {
+	message := []byte(writerSignatureLabel)
+	message = append(message, identity.Bytes()...)
+	var rawNotAfter [8]byte
+	binary.BigEndian.PutUint64(rawNotAfter[:], uint64(notAfter.Unix()))
+	message = append(message, rawNotAfter[:]...)
+	return append(message, descriptor...)
+}
+
+func signWriter(identity *eddsa.PrivateKey, lifetime time.Duration, descriptor []byte) *WriterSignature {
+	// the signature covers NotAfter in seconds
+	notAfter := time.Now().Add(lifetime).UTC().Truncate(time.Second)
+	return &WriterSignature{
+		Identity:  identity.PublicKey(),
+		NotAfter:  notAfter,
+		Signature: identity.Sign(writerSignatureMessage(identity.PublicKey(), notAfter, descriptor)),
+	}
+}
+
+func verifyWriter(s *WriterSignature, identity *eddsa.PublicKey, descriptor []byte) error {
+	if identity == nil {
+		return errors.New("identity key must not be nil")
+	}
+	if s == nil || s.Identity == nil {
+		return errors.New("writer descriptor is not signed")
+	}
+	if !identity.Equal(s.Identity) {
+		return errors.New("writer descriptor is signed by another identity")
+	}
+	if time.Now().After(s.NotAfter) {
+		return errors.New("writer descriptor expired")
+	}
+	if !s.Identity.Verify(s.Signature, writerSignatureMessage(s.Identity, s.NotAfter, descriptor)) {
+		return errors.New("invalid writer descriptor signature")
+	}
+	return nil
+}
+
+// spoolBindingLength is the length of the data returned by spoolBinding.
+const spoolBindingLength = sha256.Size
+
+// spoolBinding returns the data which binds a ciphertext to the given
+// spools, the spool written to first. It is authenticated along with
+// the ciphertext so that a Provider can not move ciphertexts between
+// spools or channels.
+func spoolBinding(label string, spools ...*UnreliableSpoolWriterChannel) []byte {
+	h := sha256.New()
+	writeField := func(field []byte) {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+		h.Write(length[:])
+		h.Write(field)
+	}
+	writeField([]byte(label))
+	for _, spool := range spools {
+		writeField(spool.SpoolID)
+		writeField([]byte(spool.SpoolReceiver))
+		writeField([]byte(spool.SpoolProvider))
+	}
+	return h.Sum(nil)
+}
+
+// MaxGarbageEntries is the number of consecutive garbage spool entries
+// a channel in skip garbage mode skips before Read gives up.
+const MaxGarbageEntries = 32
+
+// ErrTooMuchGarbage is returned by Read in skip garbage mode once
+// MaxGarbageEntries consecutive garbage spool entries were skipped.
+// The next Read continues after them.
+var ErrTooMuchGarbage = errors.New("too many garbage spool entries")
+
+// ErrNoMessage is returned by Read at the end of a spool. The read
+// offset is kept so that the entry appended next is read.
+var ErrNoMessage = errors.New("no message")
+
+// garbageError wraps the error of a spool entry which failed to
+// authenticate, such entries may have been appended by anyone.
+type garbageError struct {
+	err error
+}
+
+func (e *garbageError) Error() string {
+	return e.err.Error()
+}
+
+// skipGarbage calls read until it returns an entry which is not
+// garbage, at most MaxGarbageEntries times, if skip is set. The
+// skipped entries are added to skipped.
+func skipGarbage(skip bool, skipped *uint64, read func() ([]byte, error)) ([]byte, error) {
+	message, err := read()
+	for i := 0; skip && err != nil; i++ {
+		if _, ok := err.(*garbageError); !ok {
+			break
+		}
+		*skipped++
+		if i == MaxGarbageEntries-1 {
+			return nil, ErrTooMuchGarbage
+		}
+		message, err = read()
+	}
+	if garbage, ok := err.(*garbageError); ok {
+		return nil, garbage.err
+	}
+	return message, err
+}
+
 // UnreliableSpoolReaderChannel is an unreliable channel
 // which reads from a remote spool.
 type UnreliableSpoolReaderChannel struct {
@@ -59,6 +233,10 @@ type UnreliableSpoolReaderChannel struct {
 	SpoolReceiver   string
 	SpoolProvider   string
 	ReadOffset      uint32
+
+	// StampDifficulty is the difficulty of the proof-of-work
+	// stamp required of the entries, zero if none is.
+	StampDifficulty uint8
 }
 
 // NewUnreliableSpoolReaderChannel creates and returns a new UnreliableSpoolReaderChannel or an error.
@@ -88,13 +266,27 @@ func NewUnreliableSpoolReaderChannel(spoolReceiver, spoolProvider string, spool
 // writes to the spool that this spool reader channel is reading.
 func (s *UnreliableSpoolReaderChannel) GetSpoolWriter() *UnreliableSpoolWriterChannel {
 	return &UnreliableSpoolWriterChannel{
-		SpoolID:       s.SpoolID,
-		SpoolReceiver: s.SpoolReceiver,
-		SpoolProvider: s.SpoolProvider,
+		SpoolID:         s.SpoolID,
+		SpoolReceiver:   s.SpoolReceiver,
+		SpoolProvider:   s.SpoolProvider,
+		StampDifficulty: s.StampDifficulty,
 	}
 }
 
-// Read reads and returns a message from a remote spool.
+// RequireStamps makes Read reject the entries lacking a proof-of-work
+// stamp of the given difficulty, before any attempt to decrypt them.
+// It must be set before the spool writer is handed out, as writers
+// learn the difficulty from it.
+func (s *UnreliableSpoolReaderChannel) RequireStamps(difficulty uint8) error {
+	if difficulty > MaxStampDifficulty {
+		return errors.New("stamp difficulty exceeds maximum")
+	}
+	s.StampDifficulty = difficulty
+	return nil
+}
+
+// Read reads and returns a message from a remote spool,
+// ErrNoMessage is returned at the end of the spool.
 func (s *UnreliableSpoolReaderChannel) Read(spool client.SpoolService) ([]byte, error) {
 	spoolResponse, err := spool.ReadFromSpool(s.SpoolID[:], s.ReadOffset, s.SpoolPrivateKey, s.SpoolReceiver, s.SpoolProvider)
 	if err != nil {
@@ -103,9 +295,19 @@ func (s *UnreliableSpoolReaderChannel) Read(spool client.SpoolService) ([]byte,
 	if spoolResponse.Status != "OK" {
 		return nil, errors.New(spoolResponse.Status)
 	}
+	message := spoolResponse.Message
+	if len(message) == 0 {
+		return nil, ErrNoMessage
+	}
 	s.ReadOffset++
 
-	return spoolResponse.Message, nil
+	if s.StampDifficulty == 0 {
+		return message, nil
+	}
+	if len(message) < StampLength || !verifyStamp(s.SpoolID, message[:StampLength], message[StampLength:], s.StampDifficulty) {
+		return nil, &garbageError{errors.New("spool entry lacks a valid stamp")}
+	}
+	return message[StampLength:], nil
 }
 
 // SerializedUnreliableSpoolChannel is a type used to serialize/save the UnreliableSpoolChannel type.
@@ -151,7 +353,10 @@ func (s *UnreliableSpoolChannel) GetSpoolWriter() *UnreliableSpoolWriterChannel
 	return s.readerChan.GetSpoolWriter()
 }
 
-// WithRemoteWriter sets this channels writer to the given UnreliableSpoolWriterChannel.
+// WithRemoteWriter sets this channels writer to the given
+// UnreliableSpoolWriterChannel. The writer is not authenticated,
+// WithVerifiedRemoteWriter must be used unless it was authenticated
+// by other means.
 func (s *UnreliableSpoolChannel) WithRemoteWriter(writer *UnreliableSpoolWriterChannel) error {
 	if writer == nil {
 		return errors.New("writer must not be nil")
@@ -163,7 +368,26 @@ func (s *UnreliableSpoolChannel) WithRemoteWriter(writer *UnreliableSpoolWriterC
 	return nil
 }
 
-// Read reads and returns a message from the remote spool.
+// WithVerifiedRemoteWriter is like WithRemoteWriter except that the
+// writer must carry an unexpired signature by the given identity key.
+func (s *UnreliableSpoolChannel) WithVerifiedRemoteWriter(writer *UnreliableSpoolWriterChannel, identity *eddsa.PublicKey) error {
+	if writer == nil {
+		return errors.New("writer must not be nil")
+	}
+	if err := writer.Verify(identity); err != nil {
+		return err
+	}
+	return s.WithRemoteWriter(writer)
+}
+
+// RequireStamps makes this channel reject the entries lacking a
+// proof-of-work stamp of the given difficulty.
+func (s *UnreliableSpoolChannel) RequireStamps(difficulty uint8) error {
+	return s.readerChan.RequireStamps(difficulty)
+}
+
+// Read reads and returns a message from the remote spool,
+// ErrNoMessage is returned at the end of the spool.
 func (s *UnreliableSpoolChannel) Read() ([]byte, error) {
 	return s.readerChan.Read(s.spoolService)
 }
@@ -173,9 +397,6 @@ func (s *UnreliableSpoolChannel) Write(message []byte) error {
 	if s.writerChan == nil {
 		return errors.New("writerChan must not be nil")
 	}
-	if len(message) > SpoolPayloadLength {
-		return errors.New("exceeds payload maximum")
-	}
 	return s.writerChan.Write(s.spoolService, message)
 }
 
@@ -19,8 +19,10 @@ package channels
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/memspool/client"
 	"github.com/katzenpost/memspool/common"
 	"github.com/stretchr/testify/assert"
@@ -133,6 +135,24 @@ of power. 52`)
 	assert.Equal(msg2, msg2Read)
 }
 
+func TestSpoolChannelReadAtEnd(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestSpoolChannelPair(t)
+	_, err := chanB.Read()
+	assert.Equal(ErrNoMessage, err)
+	assert.Equal(uint32(1), chanB.readerChan.ReadOffset)
+
+	// the entry appended after reading at the end is read
+	msg := []byte("appended after polling")
+	assert.NoError(chanA.Write(msg))
+	msgRead, err := chanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+	_, err = chanB.Read()
+	assert.Equal(ErrNoMessage, err)
+}
+
 func TestSimpleSpoolChannelSerialize(t *testing.T) {
 	assert := assert.New(t)
 	chanA, chanB := newTestSpoolChannelPair(t)
@@ -170,3 +190,43 @@ modern political parlance. The author offered mix nets for a solution. 50`)
 	assert.NoError(err)
 	assert.Equal(msg2, msg2Read)
 }
+
+func TestSpoolWriterSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	reader, err := NewUnreliableSpoolReaderChannel("receiver", "provider", spool)
+	assert.NoError(err)
+	identity, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	otherIdentity, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+
+	writer := reader.GetSpoolWriter()
+	assert.Error(writer.Verify(nil))
+	writer.Sign(identity, time.Hour)
+	// a self-signed writer is not accepted without an identity key
+	assert.Error(writer.Verify(nil))
+	assert.NoError(writer.Verify(identity.PublicKey()))
+	assert.Error(writer.Verify(otherIdentity.PublicKey()))
+
+	// the spool and the expiration are signed
+	tampered := *writer
+	tampered.SpoolProvider = "provider_mallory"
+	assert.Error(tampered.Verify(identity.PublicKey()))
+	tamperedSignature := *writer.Signature
+	tamperedSignature.NotAfter = tamperedSignature.NotAfter.Add(time.Hour)
+	tampered = *writer
+	tampered.Signature = &tamperedSignature
+	assert.Error(tampered.Verify(identity.PublicKey()))
+
+	spoolCh, err := NewUnreliableSpoolChannel("receiver_b", "provider_b", spool)
+	assert.NoError(err)
+	assert.Error(spoolCh.WithVerifiedRemoteWriter(&tampered, identity.PublicKey()))
+	expired := reader.GetSpoolWriter()
+	expired.Sign(identity, -time.Minute)
+	assert.Error(expired.Verify(identity.PublicKey()))
+	assert.Error(spoolCh.WithVerifiedRemoteWriter(expired, identity.PublicKey()))
+	assert.Error(spoolCh.WithVerifiedRemoteWriter(writer, otherIdentity.PublicKey()))
+	assert.NoError(spoolCh.WithVerifiedRemoteWriter(writer, identity.PublicKey()))
+}
@@ -0,0 +1,85 @@
+// stamp.go - proof-of-work stamps gating spool appends
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+const (
+	// StampLength is the length of the proof-of-work stamp prepended
+	// to the entries of spools requiring one.
+	StampLength = 8
+
+	// MaxStampDifficulty is the greatest number of leading zero bits
+	// a spool reader may require of the stamps.
+	MaxStampDifficulty = 32
+
+	stampLabel = "katzenpost channels spool stamp"
+)
+
+// stampHash returns the hash which must begin with the required number
+// of zero bits. The message is hashed beforehand so that the cost of
+// a stamp does not depend on the message length.
+func stampHash(spoolID, messageHash, nonce []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(stampLabel))
+	h.Write(spoolID)
+	h.Write(messageHash)
+	h.Write(nonce)
+	return h.Sum(nil)
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, x := range b {
+		n += bits.LeadingZeros8(x)
+		if x != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// newStamp returns a stamp for the given message appended to the given
+// spool, the work grows exponentially with the difficulty.
+func newStamp(spoolID, message []byte, difficulty uint8) ([]byte, error) {
+	if difficulty > MaxStampDifficulty {
+		return nil, errors.New("stamp difficulty exceeds maximum")
+	}
+	messageHash := sha256.Sum256(message)
+	nonce := make([]byte, StampLength)
+	for counter := uint64(0); ; counter++ {
+		binary.BigEndian.PutUint64(nonce, counter)
+		if leadingZeroBits(stampHash(spoolID, messageHash[:], nonce)) >= int(difficulty) {
+			return nonce, nil
+		}
+	}
+}
+
+// verifyStamp returns true if the stamp of the message
+// appended to the given spool meets the difficulty.
+func verifyStamp(spoolID, stamp, message []byte, difficulty uint8) bool {
+	if len(stamp) != StampLength {
+		return false
+	}
+	messageHash := sha256.Sum256(message)
+	return leadingZeroBits(stampHash(spoolID, messageHash[:], stamp)) >= int(difficulty)
+}
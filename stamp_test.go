@@ -0,0 +1,121 @@
+// stamp_test.go - proof-of-work stamp tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeadingZeroBits(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, leadingZeroBits([]byte{0x80, 0x00}))
+	assert.Equal(7, leadingZeroBits([]byte{0x01, 0x00}))
+	assert.Equal(12, leadingZeroBits([]byte{0x00, 0x08, 0xff}))
+	assert.Equal(16, leadingZeroBits([]byte{0x00, 0x00}))
+}
+
+func TestStamp(t *testing.T) {
+	assert := assert.New(t)
+
+	spoolID := []byte("spool")
+	message := []byte("costly message")
+	stamp, err := newStamp(spoolID, message, 12)
+	assert.NoError(err)
+	assert.True(verifyStamp(spoolID, stamp, message, 12))
+	assert.False(verifyStamp(spoolID, stamp[1:], message, 12))
+
+	_, err = newStamp(spoolID, message, MaxStampDifficulty+1)
+	assert.Error(err)
+}
+
+func TestNoiseChannelRequireStamps(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	chanA, err := NewUnreliableNoiseChannel("receiver_A", "provider_A", spool)
+	assert.NoError(err)
+	chanB, err := NewUnreliableNoiseChannel("receiver_B", "provider_B", spool)
+	assert.NoError(err)
+	assert.Error(chanB.SpoolReaderChan.RequireStamps(MaxStampDifficulty + 1))
+	assert.NoError(chanB.SpoolReaderChan.RequireStamps(12))
+	assert.NoError(chanA.WithRemoteWriter(chanB.GetRemoteWriter(), chanB.IdentityPrivateKey.PublicKey()))
+	assert.NoError(chanB.WithRemoteWriter(chanA.GetRemoteWriter(), chanA.IdentityPrivateKey.PublicKey()))
+	assert.Equal(uint8(12), chanA.SpoolWriterChan.StampDifficulty)
+
+	// the difficulty survives the text encoding of the writer
+	text, err := chanB.GetRemoteWriter().EncodeText()
+	assert.NoError(err)
+	descriptor := new(NoiseWriterDescriptor)
+	assert.NoError(descriptor.DecodeText(text))
+	assert.Equal(uint8(12), descriptor.SpoolWriterChan.StampDifficulty)
+
+	// unstamped entries are rejected before decryption
+	unstamped := chanB.SpoolReaderChan.GetSpoolWriter()
+	unstamped.StampDifficulty = 0
+	assert.NoError(unstamped.Write(spool, []byte("junk")))
+	_, err = chanB.Read()
+	assert.EqualError(err, "spool entry lacks a valid stamp")
+
+	msg := []byte("worth the work")
+	assert.NoError(chanA.Write(msg))
+	msgRead, err := chanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+
+	// unstamped entries are skipped like any other garbage
+	chanB.SkipGarbage = true
+	assert.NoError(unstamped.Write(spool, []byte("junk")))
+	assert.NoError(chanA.Write(msg))
+	msgRead, err = chanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+	assert.Equal(uint64(1), chanB.SkippedEntries)
+}
+
+func TestStampedPayloadLength(t *testing.T) {
+	assert := assert.New(t)
+
+	spool := newMockRemoteSpool()
+	chanA, err := NewUnreliableNoiseChannel("receiver_A", "provider_A", spool)
+	assert.NoError(err)
+	chanB, err := NewUnreliableNoiseChannel("receiver_B", "provider_B", spool)
+	assert.NoError(err)
+	assert.NoError(chanB.SpoolReaderChan.RequireStamps(1))
+	assert.NoError(chanA.WithRemoteWriter(chanB.GetRemoteWriter(), chanB.IdentityPrivateKey.PublicKey()))
+	assert.NoError(chanB.WithRemoteWriter(chanA.GetRemoteWriter(), chanA.IdentityPrivateKey.PublicKey()))
+
+	// only the spools requiring stamps leave room for them
+	assert.Equal(StampedSpoolPayloadLength, chanA.SpoolWriterChan.PayloadLength())
+	assert.Equal(SpoolPayloadLength, chanB.SpoolWriterChan.PayloadLength())
+	assert.Error(chanA.SpoolWriterChan.Write(spool, make([]byte, SpoolPayloadLength)))
+
+	assert.Error(chanA.Write(make([]byte, NoisePayloadLength-noiseMessageHeaderLength)))
+	msg := make([]byte, NoisePayloadLength-noiseMessageHeaderLength-StampLength)
+	assert.NoError(chanA.Write(msg))
+	msgRead, err := chanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+
+	msg = make([]byte, NoisePayloadLength-noiseMessageHeaderLength)
+	assert.NoError(chanB.Write(msg))
+	msgRead, err = chanA.Read()
+	assert.NoError(err)
+	assert.Equal(msg, msgRead)
+}
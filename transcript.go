@@ -0,0 +1,230 @@
+// transcript.go - transcript consistency checks
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// TranscriptDigestInterval is the number of messages we write
+	// between the transcript digests sent to the remote party.
+	TranscriptDigestInterval = 16
+
+	// TranscriptHistoryLength is the number of hashes of our sent
+	// transcript kept to check the remote party's digests against.
+	TranscriptHistoryLength = 256
+
+	// MaxTranscriptAlerts is the number of alerts kept until TakeAlerts.
+	MaxTranscriptAlerts = 100
+
+	transcriptLabel = "katzenpost channels transcript"
+)
+
+// TranscriptAlert is returned by Read when the remote party's
+// transcript digest shows that our views of the conversation
+// diverged: messages were dropped, reordered or withheld, by the
+// Provider for instance.
+type TranscriptAlert struct {
+	// Outgoing is set if the remote party's view of the messages we
+	// wrote diverged, and not set if our view of it's messages did.
+	Outgoing bool
+
+	// Sequence is the sequence number of the message up to
+	// which the transcript was compared.
+	Sequence uint64
+}
+
+func (a *TranscriptAlert) Error() string {
+	if a.Outgoing {
+		return fmt.Sprintf("remote transcript of our messages up to %d diverged", a.Sequence)
+	}
+	return fmt.Sprintf("our transcript of the remote messages up to %d diverged", a.Sequence)
+}
+
+// TranscriptCheckpoint is the hash of a transcript up to a sequence number.
+type TranscriptCheckpoint struct {
+	Sequence uint64
+	Hash     []byte
+}
+
+// transcriptDigest is sent in band to the remote party.
+type transcriptDigest struct {
+	Sent     TranscriptCheckpoint
+	Received TranscriptCheckpoint
+}
+
+// Transcript holds running hash chains of the sequenced messages
+// written and read by a channel.
+type Transcript struct {
+	Sent     TranscriptCheckpoint
+	Received TranscriptCheckpoint
+
+	// SentHistory holds the last checkpoints of Sent.
+	SentHistory []TranscriptCheckpoint
+
+	// SinceDigest counts the messages written since our last digest.
+	SinceDigest int
+
+	// OutgoingDiverged is set from an outgoing alert until
+	// the remote party's digest matches ours again.
+	OutgoingDiverged bool
+
+	Alerts []TranscriptAlert
+
+	// previousReceived and lastEntry are Received before and the
+	// entry of the message last read.
+	previousReceived TranscriptCheckpoint
+	lastEntry        []byte
+}
+
+// transcriptEntry returns the hash of a message which is chained.
+func transcriptEntry(sequence []byte, messageType byte, message []byte) []byte {
+	h := sha256.New()
+	h.Write(sequence)
+	h.Write([]byte{messageType})
+	h.Write(message)
+	return h.Sum(nil)
+}
+
+func chainTranscript(previous, entry []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(transcriptLabel))
+	h.Write(previous)
+	h.Write(entry)
+	return h.Sum(nil)
+}
+
+// sent chains a message we wrote. Unsequenced messages are not chained.
+func (t *Transcript) sent(sequence []byte, messageType byte, message []byte) {
+	checkpoint, ok := chainCheckpoint(t.Sent, sequence, transcriptEntry(sequence, messageType, message))
+	if !ok {
+		return
+	}
+	t.Sent = checkpoint
+	t.SentHistory = append(t.SentHistory, checkpoint)
+	if len(t.SentHistory) > TranscriptHistoryLength {
+		t.SentHistory = t.SentHistory[len(t.SentHistory)-TranscriptHistoryLength:]
+	}
+	t.SinceDigest++
+}
+
+// received chains a message we read. Unsequenced messages are not chained.
+func (t *Transcript) received(sequence []byte, messageType byte, message []byte) {
+	entry := transcriptEntry(sequence, messageType, message)
+	checkpoint, ok := chainCheckpoint(t.Received, sequence, entry)
+	if !ok {
+		return
+	}
+	t.previousReceived = t.Received
+	t.lastEntry = entry
+	t.Received = checkpoint
+}
+
+func chainCheckpoint(previous TranscriptCheckpoint, rawSequence, entry []byte) (TranscriptCheckpoint, bool) {
+	sequence := decodeSequence(rawSequence)
+	if sequence == 0 {
+		return TranscriptCheckpoint{}, false
+	}
+	return TranscriptCheckpoint{
+		Sequence: sequence,
+		Hash:     chainTranscript(previous.Hash, entry),
+	}, true
+}
+
+// due returns true if a digest is to be sent.
+func (t *Transcript) due() bool {
+	return t.SinceDigest >= TranscriptDigestInterval
+}
+
+// digest returns the serialized digest of our transcripts.
+func (t *Transcript) digest() ([]byte, error) {
+	var serialized []byte
+	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode(&transcriptDigest{
+		Sent:     t.Sent,
+		Received: t.Received,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+// processDigest compares the remote party's digest, which was the
+// message last read, with our transcripts. A *TranscriptAlert is
+// returned if they diverged.
+func (t *Transcript) processDigest(body []byte) error {
+	digest := new(transcriptDigest)
+	err := codec.NewDecoderBytes(body, cborHandle).Decode(digest)
+	if err != nil {
+		return err
+	}
+	var alert *TranscriptAlert
+
+	// The digest covers the remote messages before itself. Once they
+	// diverged our transcript continues from the remote one so that
+	// the following digests only compare the following messages.
+	remote := digest.Sent
+	if remote.Sequence != t.previousReceived.Sequence || !hmac.Equal(remote.Hash, t.previousReceived.Hash) {
+		alert = t.alert(false, remote.Sequence)
+		t.Received.Hash = chainTranscript(remote.Hash, t.lastEntry)
+	}
+
+	// The remote party's view of our messages may only be compared
+	// with our recent checkpoints.
+	for _, checkpoint := range t.SentHistory {
+		if checkpoint.Sequence != digest.Received.Sequence {
+			continue
+		}
+		if hmac.Equal(checkpoint.Hash, digest.Received.Hash) {
+			t.OutgoingDiverged = false
+		} else if !t.OutgoingDiverged {
+			t.OutgoingDiverged = true
+			if outgoing := t.alert(true, checkpoint.Sequence); alert == nil {
+				alert = outgoing
+			}
+		}
+		break
+	}
+	if alert != nil {
+		return alert
+	}
+	return nil
+}
+
+func (t *Transcript) alert(outgoing bool, sequence uint64) *TranscriptAlert {
+	alert := TranscriptAlert{
+		Outgoing: outgoing,
+		Sequence: sequence,
+	}
+	t.Alerts = append(t.Alerts, alert)
+	if len(t.Alerts) > MaxTranscriptAlerts {
+		t.Alerts = t.Alerts[len(t.Alerts)-MaxTranscriptAlerts:]
+	}
+	return &alert
+}
+
+// TakeAlerts returns and forgets the alerts raised since the last call.
+func (t *Transcript) TakeAlerts() []TranscriptAlert {
+	alerts := t.Alerts
+	t.Alerts = nil
+	return alerts
+}
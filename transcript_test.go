@@ -0,0 +1,112 @@
+// transcript_test.go - transcript consistency check tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoiseChannelTranscript(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestNoiseChannelPair(t)
+	assert.NoError(chanA.Write([]byte{1}))
+	assert.NoError(chanA.SendTranscriptDigest())
+	assert.NoError(chanA.Write([]byte{2}))
+	msg, err := chanB.Read()
+	assert.NoError(err)
+	assert.Equal([]byte{1}, msg)
+	msg, err = chanB.Read()
+	assert.NoError(err)
+	assert.Equal([]byte{2}, msg)
+	assert.Equal(chanA.Transcript.Sent, chanB.Transcript.Received)
+
+	// the Provider drops an entry
+	assert.NoError(chanA.Write([]byte{3}))
+	assert.NoError(chanA.Write([]byte{4}))
+	assert.NoError(chanA.SendTranscriptDigest())
+	assert.NoError(chanA.Write([]byte{5}))
+	chanB.SpoolReaderChan.ReadOffset++
+	msg, err = chanB.Read()
+	assert.NoError(err)
+	assert.Equal([]byte{4}, msg)
+	_, err = chanB.Read()
+	alert, ok := err.(*TranscriptAlert)
+	assert.True(ok)
+	assert.False(alert.Outgoing)
+	assert.Equal(uint64(5), alert.Sequence)
+	assert.Equal([]TranscriptAlert{*alert}, chanB.Transcript.TakeAlerts())
+
+	// our transcript continues from the remote one
+	msg, err = chanB.Read()
+	assert.NoError(err)
+	assert.Equal([]byte{5}, msg)
+	assert.Equal(chanA.Transcript.Sent, chanB.Transcript.Received)
+
+	serialized, err := chanB.Save()
+	assert.NoError(err)
+	chanB, err = LoadUnreliableNoiseChannel(serialized, chanB.spoolService)
+	assert.NoError(err)
+	assert.Equal(chanA.Transcript.Sent, chanB.Transcript.Received)
+}
+
+func TestNoiseChannelTranscriptInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	chanA, chanB := newTestNoiseChannelPair(t)
+	for i := 0; i <= TranscriptDigestInterval; i++ {
+		assert.NoError(chanA.Write([]byte{byte(i)}))
+	}
+	assert.Equal(uint64(TranscriptDigestInterval+2), chanA.Sequence.NextSend)
+	assert.Equal(1, chanA.Transcript.SinceDigest)
+	for i := 0; i <= TranscriptDigestInterval; i++ {
+		msg, err := chanB.Read()
+		assert.NoError(err)
+		assert.Equal([]byte{byte(i)}, msg)
+	}
+	assert.Equal(chanA.Transcript.Sent, chanB.Transcript.Received)
+}
+
+func TestDoubleRatchetTranscript(t *testing.T) {
+	assert := assert.New(t)
+
+	ratchetChanA, ratchetChanB := newTestConnectedRatchetPair(t, "alice", "bob", newMockRemoteSpool())
+	assert.NoError(ratchetChanA.Write([]byte{1}))
+	assert.NoError(ratchetChanA.Write([]byte{2}))
+
+	// the Provider withholds the first entry
+	ratchetChanB.SpoolCh.readerChan.ReadOffset++
+	msg, err := ratchetChanB.Read()
+	assert.NoError(err)
+	assert.Equal([]byte{2}, msg)
+	assert.NoError(ratchetChanB.SendTranscriptDigest())
+	_, err = ratchetChanA.Read()
+	alert, ok := err.(*TranscriptAlert)
+	assert.True(ok)
+	assert.True(alert.Outgoing)
+	assert.Equal(uint64(2), alert.Sequence)
+
+	// the outgoing alert is raised once until the transcripts match
+	assert.NoError(ratchetChanB.SendTranscriptDigest())
+	assert.NoError(ratchetChanB.Write([]byte{3}))
+	msg, err = ratchetChanA.Read()
+	assert.NoError(err)
+	assert.Equal([]byte{3}, msg)
+	assert.Len(ratchetChanA.Transcript.TakeAlerts(), 1)
+}
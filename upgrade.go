@@ -0,0 +1,235 @@
+// upgrade.go - upgrade of a Noise channel to a Double Ratchet channel
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/katzenpost/memspool/client"
+	"github.com/ugorji/go/codec"
+)
+
+// upgradeMagic marks the Noise messages carrying an exchange.
+var upgradeMagic = []byte("KPUPGRD0")
+
+// ErrUpgradeDone is returned by DoubleRatchetUpgrade.Read when it read
+// the remote exchange and the UnreliableDoubleRatchetChannel is ready.
+var ErrUpgradeDone = errors.New("double ratchet channel upgrade is done")
+
+// SerializedDoubleRatchetUpgrade is a type used to serialize/save the
+// DoubleRatchetUpgrade type.
+type SerializedDoubleRatchetUpgrade struct {
+	NoiseCh          []byte
+	RatchetCh        []byte
+	ExchangeSent     bool
+	ExchangeReceived bool
+	Queued           [][]byte
+}
+
+// DoubleRatchetUpgrade upgrades an UnreliableNoiseChannel to an
+// UnreliableDoubleRatchetChannel using the same spools, so that the
+// exchanges need not be transferred out of band. Both parties read and
+// write through their DoubleRatchetUpgrade until it is done. Each party
+// writes to the Noise channel until it sent it's exchange and writes to
+// the ratchet once it read the remote exchange. Messages written in
+// between are queued.
+type DoubleRatchetUpgrade struct {
+	NoiseCh          *UnreliableNoiseChannel
+	RatchetCh        *UnreliableDoubleRatchetChannel
+	ExchangeSent     bool
+	ExchangeReceived bool
+
+	// Queued holds the messages written after our exchange was
+	// sent, they are written to the ratchet once it is ready.
+	Queued [][]byte
+}
+
+// NewDoubleRatchetUpgrade creates a new DoubleRatchetUpgrade for the given
+// connected Noise channel. The ratchet uses the given key exchange mode.
+func NewDoubleRatchetUpgrade(noiseCh *UnreliableNoiseChannel, mode KeyExchangeMode) (*DoubleRatchetUpgrade, error) {
+	if noiseCh.SpoolWriterChan == nil {
+		return nil, errors.New("noise channel must have a remote writer")
+	}
+	u := &DoubleRatchetUpgrade{
+		NoiseCh: noiseCh,
+	}
+	ratchetCh, err := NewUnreliableDoubleRatchetChannelWithMode(u.spoolChannel(), mode)
+	if err != nil {
+		return nil, err
+	}
+	u.RatchetCh = ratchetCh
+	return u, nil
+}
+
+// LoadDoubleRatchetUpgrade loads a saved DoubleRatchetUpgrade and sets it's spoolService.
+func LoadDoubleRatchetUpgrade(data []byte, spoolService client.SpoolService) (*DoubleRatchetUpgrade, error) {
+	s := new(SerializedDoubleRatchetUpgrade)
+	err := codec.NewDecoderBytes(data, cborHandle).Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	noiseCh, err := LoadUnreliableNoiseChannel(s.NoiseCh, spoolService)
+	if err != nil {
+		return nil, err
+	}
+	ratchetCh, err := LoadUnreliableDoubleRatchetChannel(s.RatchetCh, spoolService)
+	if err != nil {
+		return nil, err
+	}
+	u := &DoubleRatchetUpgrade{
+		NoiseCh:          noiseCh,
+		RatchetCh:        ratchetCh,
+		ExchangeSent:     s.ExchangeSent,
+		ExchangeReceived: s.ExchangeReceived,
+		Queued:           s.Queued,
+	}
+	// both channels must share the spool read offset
+	u.RatchetCh.SpoolCh = u.spoolChannel()
+	return u, nil
+}
+
+// spoolChannel returns a spool channel using the Noise channel's spools.
+func (u *DoubleRatchetUpgrade) spoolChannel() *UnreliableSpoolChannel {
+	return &UnreliableSpoolChannel{
+		spoolService: u.NoiseCh.spoolService,
+		readerChan:   u.NoiseCh.SpoolReaderChan,
+		writerChan:   u.NoiseCh.SpoolWriterChan,
+	}
+}
+
+// SetSpoolService sets the spoolService of both channels.
+func (u *DoubleRatchetUpgrade) SetSpoolService(spoolService client.SpoolService) {
+	u.NoiseCh.SetSpoolService(spoolService)
+	u.RatchetCh.SpoolCh.SetSpoolService(spoolService)
+}
+
+// Save returns the serialization of this upgrade.
+func (u *DoubleRatchetUpgrade) Save() ([]byte, error) {
+	noiseCh, err := u.NoiseCh.Save()
+	if err != nil {
+		return nil, err
+	}
+	ratchetCh, err := u.RatchetCh.Save()
+	if err != nil {
+		return nil, err
+	}
+	var serialized []byte
+	err = codec.NewEncoderBytes(&serialized, cborHandle).Encode(&SerializedDoubleRatchetUpgrade{
+		NoiseCh:          noiseCh,
+		RatchetCh:        ratchetCh,
+		ExchangeSent:     u.ExchangeSent,
+		ExchangeReceived: u.ExchangeReceived,
+		Queued:           u.Queued,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+// Start writes our exchange to the Noise channel. The remote party
+// also writes it's exchange once it reads ours, if it did not already.
+func (u *DoubleRatchetUpgrade) Start() error {
+	if u.ExchangeSent {
+		return errors.New("exchange already sent")
+	}
+	exchange, err := u.RatchetCh.ratchetExchange()
+	if err != nil {
+		return err
+	}
+	var serialized []byte
+	err = codec.NewEncoderBytes(&serialized, cborHandle).Encode(exchange)
+	if err != nil {
+		return err
+	}
+	err = u.NoiseCh.Write(append(append([]byte{}, upgradeMagic...), serialized...))
+	if err != nil {
+		return err
+	}
+	u.ExchangeSent = true
+	return nil
+}
+
+// Done returns true once the UnreliableDoubleRatchetChannel is ready.
+func (u *DoubleRatchetUpgrade) Done() bool {
+	return u.ExchangeSent && u.ExchangeReceived
+}
+
+// Channel returns the UnreliableDoubleRatchetChannel once the upgrade is
+// done, afterwards the Noise channel must no longer be used.
+func (u *DoubleRatchetUpgrade) Channel() (*UnreliableDoubleRatchetChannel, error) {
+	if !u.Done() {
+		return nil, errors.New("upgrade is not done")
+	}
+	return u.RatchetCh, nil
+}
+
+// Write writes a message to whichever channel the remote party reads.
+func (u *DoubleRatchetUpgrade) Write(message []byte) error {
+	switch {
+	case u.Done():
+		return u.RatchetCh.Write(message)
+	case u.ExchangeSent:
+		if len(message) > DoubleRatchetPayloadLength-doubleRatchetMessageOverhead {
+			return errors.New("exceeds payload maximum")
+		}
+		u.Queued = append(u.Queued, message)
+		return nil
+	default:
+		return u.NoiseCh.Write(message)
+	}
+}
+
+// Read reads a message from whichever channel the remote party writes
+// to. ErrUpgradeDone is returned in place of the remote exchange, our
+// queued messages are then written to the ratchet.
+func (u *DoubleRatchetUpgrade) Read() ([]byte, error) {
+	if u.ExchangeReceived {
+		return u.RatchetCh.Read()
+	}
+	message, err := u.NoiseCh.Read()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(message, upgradeMagic) {
+		return message, nil
+	}
+	exchange := new(UnreliableDoubleRatchetChannelExchange)
+	err = codec.NewDecoderBytes(message[len(upgradeMagic):], cborHandle).Decode(exchange)
+	if err != nil {
+		return nil, err
+	}
+	if !u.ExchangeSent {
+		// our key exchange must be created before the remote one is processed
+		if err := u.Start(); err != nil {
+			return nil, err
+		}
+	}
+	err = u.RatchetCh.processRatchetExchange(exchange)
+	if err != nil {
+		return nil, err
+	}
+	u.ExchangeReceived = true
+	for len(u.Queued) > 0 {
+		if err := u.RatchetCh.Write(u.Queued[0]); err != nil {
+			return nil, err
+		}
+		u.Queued = u.Queued[1:]
+	}
+	return nil, ErrUpgradeDone
+}
@@ -0,0 +1,100 @@
+// upgrade_test.go - Noise to Double Ratchet channel upgrade tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package channels
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoubleRatchetUpgrade(t *testing.T) {
+	assert := assert.New(t)
+
+	noiseChanA, noiseChanB := newTestNoiseChannelPair(t)
+	spool := noiseChanA.spoolService
+	upgradeA, err := NewDoubleRatchetUpgrade(noiseChanA, SignedKeyExchangeMode)
+	assert.NoError(err)
+	upgradeB, err := NewDoubleRatchetUpgrade(noiseChanB, SignedKeyExchangeMode)
+	assert.NoError(err)
+
+	msg1 := []byte("Still over Noise.")
+	assert.NoError(upgradeA.Write(msg1))
+	assert.NoError(upgradeA.Start())
+	assert.Error(upgradeA.Start())
+	msg2 := []byte("Bob has not answered yet.")
+	assert.NoError(upgradeA.Write(msg2))
+
+	// Bob's upgrade state survives Save and Load.
+	blob, err := upgradeB.Save()
+	assert.NoError(err)
+	upgradeB, err = LoadDoubleRatchetUpgrade(blob, spool)
+	assert.NoError(err)
+
+	msg1Read, err := upgradeB.Read()
+	assert.NoError(err)
+	assert.Equal(msg1, msg1Read)
+	_, err = upgradeB.Read()
+	assert.Equal(ErrUpgradeDone, err)
+	assert.True(upgradeB.Done())
+	_, err = upgradeA.Channel()
+	assert.Error(err)
+
+	msg3 := []byte("Over the ratchet now.")
+	assert.NoError(upgradeB.Write(msg3))
+
+	blob, err = upgradeA.Save()
+	assert.NoError(err)
+	upgradeA, err = LoadDoubleRatchetUpgrade(blob, spool)
+	assert.NoError(err)
+	assert.Len(upgradeA.Queued, 1)
+
+	_, err = upgradeA.Read()
+	assert.Equal(ErrUpgradeDone, err)
+	assert.True(upgradeA.Done())
+	assert.Len(upgradeA.Queued, 0)
+	msg3Read, err := upgradeA.Read()
+	assert.NoError(err)
+	assert.Equal(msg3, msg3Read)
+
+	// Alice's queued message was written to the ratchet.
+	msg2Read, err := upgradeB.Read()
+	assert.NoError(err)
+	assert.Equal(msg2, msg2Read)
+
+	ratchetChanA, err := upgradeA.Channel()
+	assert.NoError(err)
+	ratchetChanB, err := upgradeB.Channel()
+	assert.NoError(err)
+
+	blob, err = ratchetChanB.Save()
+	assert.NoError(err)
+	ratchetChanB, err = LoadUnreliableDoubleRatchetChannel(blob, spool)
+	assert.NoError(err)
+
+	msg4 := []byte("The Noise channel is retired.")
+	assert.NoError(ratchetChanA.Write(msg4))
+	msg4Read, err := ratchetChanB.Read()
+	assert.NoError(err)
+	assert.Equal(msg4, msg4Read)
+
+	numberA, err := ratchetChanA.SafetyNumber()
+	assert.NoError(err)
+	numberB, err := ratchetChanB.SafetyNumber()
+	assert.NoError(err)
+	assert.Equal(numberA, numberB)
+}